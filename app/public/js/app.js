@@ -1,6 +1,11 @@
 // Globals
 debugMode = true;
 recovering = false;
+reloading = false;
+
+// Latest clock of each client whose operations have been applied, so only
+// the missed operations are fetched when recovering
+sessionVersion = {};
 
 workerIP = '';
 userID = '';
@@ -44,26 +49,7 @@ function initSession() {
             sessionID: sessionID
         },
         success: function(data) {
-            // CRDT Init
-            const crdt = data.SessionRecord.CRDT;
-
-            const ids = Object.keys(data.SessionRecord.CRDT);
-            ids.forEach(function(id) {
-                const element = crdt[id];
-                const prev = element.PrevID == "" ? undefined : element.PrevID;
-                const next = element.NextID == "" ? undefined : element.NextID;
-                const val = element.Text;
-                const del = element.Deleted;
-
-                CRDT.seq[id] = new Element(id, prev, next, val, del)
-            });
-
-            CRDT.head = CRDT.getHead();
-            CRDT.length = ids.length;
-
-            mapping = CRDT.toMapping();
-
-            editor.setValue(CRDT.toSnippet());
+            loadCRDT(data.SessionRecord);
 
             // Log Records Init 
             const logs = data.LogRecord
@@ -87,6 +73,169 @@ function initSession() {
     })
 }
 
+/*
+    Replaces the documents, the files and the editor's contents with the given
+    session. The editor stays on the same file unless it was deleted.*/
+function loadCRDT(record) {
+    lamportClock = 0;
+    sessionVersion = record.Version || {};
+    scheduleAck();
+
+    documents.clear();
+    documents.set('', newDocument(record.CRDT));
+
+    const _documents = record.Documents || {};
+    Object.keys(_documents).forEach(function(id) {
+        documents.set(id, newDocument(_documents[id].CRDT));
+    });
+
+    documents.forEach(function(_document, id) {
+        withDocument(id, function() {
+            editorDoc.setValue(CRDT.toSnippet());
+        });
+    });
+
+    files.clear();
+    const _files = record.Files || {};
+    Object.keys(_files).forEach(function(id) {
+        files.set(id, _files[id]);
+        getDocument(id);
+    });
+
+    const current = files.get(currentDocument);
+    switchDocument(current !== undefined && !current.Deleted ? currentDocument : '');
+    showFiles();
+}
+
+/*
+    Builds a document from the CRDT of a session or of one of its documents.*/
+function newDocument(crdt) {
+    const _CRDT = new SeqCRDT();
+
+    const ids = Object.keys(crdt);
+    ids.forEach(function(id) {
+        const element = crdt[id];
+        const prev = element.PrevID == "" ? undefined : element.PrevID;
+        const next = element.NextID == "" ? undefined : element.NextID;
+        const val = element.Text;
+        const del = element.Deleted;
+
+        _CRDT.seq[id] = new Element(id, prev, next, val, del)
+        _CRDT.observe(id);
+    });
+
+    _CRDT.head = _CRDT.getHead();
+    _CRDT.length = ids.length;
+
+    return { crdt: _CRDT, mapping: _CRDT.toMapping(), doc: CodeMirror.Doc('', 'text/x-go') };
+}
+
+/*
+    Loads the whole session again, when the worker can't tell which of its
+    operations were missed.*/
+function reloadSession() {
+    $.ajax({
+        type: 'get',
+        url: 'http://' + workerIP + '/session',
+        data: {
+            sessionID: sessionID
+        },
+        success: function(data) {
+            annotationMarks.forEach(function(mark) {
+                mark.clear();
+            });
+            annotationMarks.clear();
+            annotations.clear();
+
+            loadCRDT(data.SessionRecord);
+        }
+    });
+}
+
+/*
+    Records that an operation from the worker has been applied. The version
+    keeps the ranges of clocks applied of every replica that stamps operations,
+    since operations can arrive out of order. The worker sends one element per
+    character, so each element has a single clock.*/
+function observeVersion(element) {
+    if (!element.Clock) {
+        return;
+    }
+
+    const stamper = element.Stamper || element.ClientID;
+    const clock = element.Clock;
+    const ranges = sessionVersion[stamper] || [];
+
+    var i = 0;
+    while (i < ranges.length && ranges[i].To < clock - 1) {
+        i++;
+    }
+
+    if (i < ranges.length && ranges[i].From <= clock + 1) {
+        if (clock >= ranges[i].From && clock <= ranges[i].To) {
+            return;
+        }
+
+        ranges[i].From = Math.min(ranges[i].From, clock);
+        ranges[i].To = Math.max(ranges[i].To, clock);
+
+        // The clock may have closed the gap to the next range
+        if (i + 1 < ranges.length && ranges[i + 1].From <= ranges[i].To + 1) {
+            ranges[i].To = ranges[i + 1].To;
+            ranges.splice(i + 1, 1);
+        }
+    } else {
+        ranges.splice(i, 0, {From: clock, To: clock});
+    }
+
+    sessionVersion[stamper] = ranges;
+}
+
+/******************************* FILES *******************************/
+
+$(document).ready(function() {
+    $('.new-file').on('click', function(e) {
+        e.preventDefault();
+        newFile();
+    });
+});
+
+/*
+    Lists the files of the session by name, marking the one in the editor.
+    Clicking a file shows it in the editor.*/
+function showFiles() {
+    const ids = Array.from(files.keys()).filter(function(id) {
+        return !files.get(id).Deleted;
+    }).sort(function(a, b) {
+        return files.get(a).Name.localeCompare(files.get(b).Name);
+    });
+
+    const fileList = $('#fileList').empty();
+    ids.forEach(function(id) {
+        const link = $('<a href=#></a>').text(files.get(id).Name);
+        if (id == currentDocument) link.addClass('log-selected');
+
+        link.on('click', function(e) {
+            e.preventDefault();
+
+            switchDocument(id);
+            showFiles();
+        });
+
+        fileList.append($('<li></li>').append(link));
+    });
+}
+
+/*
+    Asks for a name and creates a file with it. The file is listed once the
+    worker sends back its file element.*/
+function newFile() {
+    const name = prompt("File name:");
+    if (name == null || name.trim() == "") return;
+
+    sendFileCommand(CREATE_FILE_COMMAND, '', name.trim());
+}
+
 function closeSession() {
     $.ajax({
         type: 'post',
@@ -257,9 +406,12 @@ function execute() {
     sessInput.setAttribute('value', sessionID);
     sessInput.setAttribute('type', 'hidden');
 
+    // The snippet is always the main file, whichever file is in the editor
     var snippet = document.createElement('textarea');
     snippet.setAttribute('name', 'snippet');
-    snippet.value = CRDT.toSnippet();
+    snippet.value = withDocument('', function() {
+        return CRDT.toSnippet();
+    });
     snippet.setAttribute('class', 'text');
     snippet.setAttribute('form', 'executeForm');
 
@@ -1,5 +1,9 @@
 outOfSync = false;
 
+// Lamport clock of the session. Every document of a session shares it, so IDs
+// are unique across the session's files.
+lamportClock = 0;
+
 /* =============================================================================
                             ELEMENT CLASS DEFINITION
    =============================================================================*/
@@ -36,18 +40,27 @@ class SeqCRDT {
     set(id, elem) {
         this.seq[id] = elem;
         this.length++;
+        this.observe(id);
 
         if (elem.prev == undefined) this.head = elem;
     }
 
+    /*
+    Advances the Lamport clock past the counter of the given ID. */
+    observe(id) {
+        const counter = parseInt(id);
+        if (!isNaN(counter) && counter > lamportClock) lamportClock = counter;
+    }
+
     length() {
         return this.seq.length;
     }
 
     /*
-    Creates UID based on increment. */
+    Creates UID from the Lamport clock and the user ID. */
     getNewID() {
-        return this.length + "_" + userID;
+        lamportClock++;
+        return lamportClock + "_" + userID;
     }
 
     /*
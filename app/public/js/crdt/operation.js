@@ -50,9 +50,19 @@ $(document).ready(function() {
         electricChars: true,
         smartIndent: false,
         mode: "text/x-go",
-        lineNumbers: true
+        lineNumbers: true,
+        extraKeys: {
+            "Ctrl-Z": undoEdit,
+            "Cmd-Z": undoEdit,
+            "Ctrl-Y": redoEdit,
+            "Shift-Ctrl-Z": redoEdit,
+            "Shift-Cmd-Z": redoEdit
+        }
     });
 
+    editorDoc = editor.getDoc();
+    documents.set(currentDocument, { crdt: CRDT, mapping: mapping, doc: editorDoc });
+
     editor_readOnly = CodeMirror.fromTextArea(document.getElementById("code_readOnly"), {
        theme: "dracula",
        matchBrackets: true,
@@ -186,6 +196,76 @@ function handleOperation(op) {
     }
 }
 
+/*
+    Undo and redo are done by the worker, which only undoes this user's edits
+    even if others have edited since. The result arrives like a remote operation.*/
+function undoEdit() {
+    sendCommand(UNDO_COMMAND);
+}
+
+function redoEdit() {
+    sendCommand(REDO_COMMAND);
+}
+
+/******************************* DOCUMENTS *******************************/
+
+// The CRDT, mapping and editor document of every file of the session, by
+// document ID. The main file's document ID is empty.
+documents = new Map();
+
+// Document shown in the editor, which local operations apply to
+currentDocument = '';
+
+// Editor document of the CRDT and mapping, which remote operations apply to.
+// It is the editor's unless an operation on another document is being applied.
+editorDoc = undefined;
+
+/*
+    Returns the document with the given ID, creating an empty one if it hasn't
+    been seen yet, eg. because its elements arrived before its file element.*/
+function getDocument(id) {
+    var _document = documents.get(id);
+    if (_document === undefined) {
+        _document = { crdt: new SeqCRDT(), mapping: new Mapping(), doc: CodeMirror.Doc('', 'text/x-go') };
+        documents.set(id, _document);
+    }
+
+    return _document;
+}
+
+/*
+    Calls fn with the CRDT, mapping and editor document of the given document
+    in place of the current ones, which are put back afterwards. Operations
+    and annotations apply to whichever document is in place.*/
+function withDocument(id, fn) {
+    const _document = getDocument(id);
+    const _CRDT = CRDT, _mapping = mapping, _editorDoc = editorDoc;
+
+    CRDT = _document.crdt;
+    mapping = _document.mapping;
+    editorDoc = _document.doc;
+    try {
+        return fn();
+    } finally {
+        CRDT = _CRDT;
+        mapping = _mapping;
+        editorDoc = _editorDoc;
+    }
+}
+
+/*
+    Shows a document in the editor, so local operations apply to it.*/
+function switchDocument(id) {
+    const _document = getDocument(id);
+
+    currentDocument = id;
+    CRDT = _document.crdt;
+    mapping = _document.mapping;
+    editorDoc = _document.doc;
+
+    if (editor.getDoc() !== editorDoc) editor.swapDoc(editorDoc);
+}
+
 /******************************* LOCAL OPERATIONS *******************************/
 
 // Cache of local elements that haven't been ACK'd yet
@@ -213,6 +293,7 @@ function handleLocalInput(line, ch, val) {
 
     // Update CRDT and mapping
     const elem = new Element(id, prev, next, val, false);
+    elem.document = currentDocument;
     CRDT.set(id, elem);
     mapping.update(line, ch, id);
 
@@ -242,6 +323,7 @@ function handleLocalDeleteByID(id, line, ch) {
     const elem = CRDT.get(id);
     if (elem === undefined) return;
     else elem.del = true;
+    elem.document = currentDocument;
 
     // Push to the cache
     cache.push(elem);
@@ -285,12 +367,17 @@ function handleRemoteInput(id, prevId, val) {
     var prevElem, nextElem, prev, next;
 
     prevElem = CRDT.get(prevId);
+
+    // An element inserted at the start skips the elements at the start with
+    // greater IDs, the same as an element inserted after prevElem would.
+    if (prevElem === undefined && CRDT.head != undefined && isGreaterID(CRDT.head.id, id)) {
+        prevElem = CRDT.head;
+    }
+
     while (prevElem !== undefined) {
         next = prevElem.next;
 
-        if (next === undefined || parseInt(next) < parseInt(id)) {
-            break;
-        } else if (parseInt(next) == parseInt(id) && next < id) {
+        if (next === undefined || !isGreaterID(next, id)) {
             break;
         } else {
             prevElem = CRDT.get(next);
@@ -355,12 +442,19 @@ function handleRemoteInput(id, prevId, val) {
         ch: ch
     };
     
-    editor.getDoc().replaceRange(val, pos, pos, IGNORE_OP);
+    editorDoc.replaceRange(val, pos, pos, IGNORE_OP);
     mapping.update(line, ch, id);
 
     if (debugMode) console.log("Observed input at line: " + line + " pos: " + ch + " char: " + unescape(val));
 }
 
+/*
+    Compares IDs by Lamport counter first, then by user ID.*/
+function isGreaterID(id, other) {
+    if (parseInt(id) != parseInt(other)) return parseInt(id) > parseInt(other);
+    else return id > other;
+}
+
 function handleRemoteDelete(id) {
     const elem = CRDT.get(id);
 
@@ -380,13 +474,79 @@ function handleRemoteDelete(id) {
     }
 
     if (pos1.line != undefined && pos1.ch !== undefined) {
-        editor.getDoc().replaceRange('', pos1, pos2, IGNORE_OP);
+        editorDoc.replaceRange('', pos1, pos2, IGNORE_OP);
         mapping.delete(pos1.line, pos1.ch);
     }
 
     if (debugMode) console.log("Observed remove at line: " + pos1.line + " pos: " + pos1.ch);
 }
 
+/******************************* ANNOTATIONS *******************************/
+
+// Annotations of the session by ID, and the editor marks showing them
+annotations = new Map();
+annotationMarks = new Map();
+
+/*
+    Handles an annotation element from the worker, with its document in place
+    (see withDocument). The annotation covers the characters From through To,
+    which are marked in the editor until the annotation is deleted. Marks are drawn from the mapping, so an annotation
+    whose characters haven't arrived yet isn't shown.*/
+function handleAnnotation(element) {
+    const annotation = element.Annotation;
+    const id = annotation.ID;
+
+    const current = annotations.get(id);
+    if (current !== undefined && isGreaterID(current.Edit, element.ID)) return;
+
+    annotation.Edit = element.ID;
+    annotation.Deleted = element.Deleted;
+    annotations.set(id, annotation);
+
+    const mark = annotationMarks.get(id);
+    if (mark !== undefined) {
+        mark.clear();
+        annotationMarks.delete(id);
+    }
+
+    if (annotation.Deleted) return;
+
+    const from = mapping.getPosition(annotation.From);
+    const to = mapping.getPosition(annotation.To);
+    if (from.line === undefined || to.line === undefined) return;
+
+    annotationMarks.set(id, editorDoc.markText(from, { line: to.line, ch: to.ch + 1 }, {
+        css: annotation.Resolved ? 'background-color: #e8f5e9' : 'background-color: #fff3b0',
+        title: annotation.Author + ': ' + annotation.Text
+    }));
+
+    if (debugMode) console.log("Observed annotation " + id + " by " + annotation.Author + ": " + annotation.Text);
+}
+
+/******************************* FILES *******************************/
+
+// The file of every document of the session, by document ID: its name, whether
+// it was deleted and the ID of the file element that last changed it
+files = new Map();
+
+/*
+    Handles a file element from the worker, which names its document or
+    deletes its file. The element with the greatest ID wins, as on the worker.*/
+function handleFile(element) {
+    const id = element.Document || '';
+
+    const current = files.get(id);
+    if (current !== undefined && current.ID != '' && !isGreaterID(element.ID, current.ID)) return;
+
+    files.set(id, { Name: element.Text, Deleted: element.Deleted, ID: element.ID });
+    getDocument(id);
+
+    if (id == currentDocument && element.Deleted) switchDocument('');
+    showFiles();
+
+    if (debugMode) console.log("Observed file " + id + ": " + element.Text + (element.Deleted ? " (deleted)" : ""));
+}
+
 /******************************* BULK OPERATIONS *******************************/
 
 /*
@@ -2,6 +2,24 @@ socket = undefined;
 unload = false;
 disconnectAlerted = false
 
+// Commands understood by the worker
+UNDO_COMMAND = 'undo';
+REDO_COMMAND = 'redo';
+CREATE_FILE_COMMAND = 'create_file';
+RENAME_FILE_COMMAND = 'rename_file';
+DELETE_FILE_COMMAND = 'delete_file';
+ANNOTATE_COMMAND = 'annotate';
+EDIT_ANNOTATION_COMMAND = 'edit_annotation';
+RESOLVE_ANNOTATION_COMMAND = 'resolve_annotation';
+REOPEN_ANNOTATION_COMMAND = 'reopen_annotation';
+DELETE_ANNOTATION_COMMAND = 'delete_annotation';
+ACK_COMMAND = 'ack';
+
+// Time in milliseconds to wait before telling the worker which operations
+// have been applied, so that deletes applied close together are acked at once
+ACK_DELAY = 1000;
+ackTimer = undefined;
+
 /******************************* EVENT HANDLERS *******************************/
 
 
@@ -24,9 +42,16 @@ function initWS() {
 }
 
 function onOpen() {
+    scheduleAck();
+
     if (recovering) {
         sendCachedElements();
         recovering = false;
+
+        if (reloading) {
+            reloadSession();
+            reloading = false;
+        }
     } else {
         initSession();
     }
@@ -56,7 +81,51 @@ function onMessage(_msg) {
     } else if (element.hasOwnProperty('Job')) {
         matchLog(element);
     } else {
-        handleRemoteOperation(element);
+        handleWorkerElement(element);
+    }
+}
+
+/*
+    Tells the worker the version of the session applied here, so it knows
+    which deletes this browser has applied and can collect their tombstones
+    once every replica has.*/
+function scheduleAck() {
+    if (ackTimer !== undefined) return;
+
+    ackTimer = setTimeout(function() {
+        ackTimer = undefined;
+        if (socket === undefined || socket.readyState != 1) return;
+
+        const message = {
+            SessionID: sessionID,
+            ClientID: userID,
+            Command: ACK_COMMAND,
+            Version: sessionVersion
+        };
+
+        socket.send(JSON.stringify(message));
+    }, ACK_DELAY);
+}
+
+/*
+    Applies an element from the worker, which is either a file, an annotation
+    or an operation on one of the session's documents.*/
+function handleWorkerElement(element) {
+    if (element.File) {
+        handleFile(element);
+    } else if (element.Annotation) {
+        withDocument(element.Annotation.Document || '', function() {
+            handleAnnotation(element);
+        });
+    } else {
+        withDocument(element.Document || '', function() {
+            handleRemoteOperation(element);
+        });
+    }
+
+    observeVersion(element);
+    if (element.Deleted && !element.File && !element.Annotation) {
+        scheduleAck();
     }
 }
 
@@ -69,7 +138,8 @@ function sendElement(_element) {
         ID: _element.id,
         PrevID: _element.prev,
         Text: _element.val,
-        Deleted: _element.del
+        Deleted: _element.del,
+        Document: _element.document || ''
     };
 
     socket.send(JSON.stringify(element));
@@ -92,6 +162,76 @@ function sendElement(_element) {
     }
 }
 
+/*
+    Asks the worker to run a command for this user on the document in the
+    editor, eg. undo their last edit.*/
+function sendCommand(command) {
+    if (socket.readyState != 1) return;
+
+    const message = {
+        SessionID: sessionID,
+        ClientID: userID,
+        Document: currentDocument,
+        Command: command
+    };
+
+    socket.send(JSON.stringify(message));
+}
+
+/*
+    Asks the worker to create, rename or delete a file of the session. The file
+    is named by its document ID, which is empty for the main file, and new
+    files are only named by name.*/
+function sendFileCommand(command, documentID, name) {
+    if (socket.readyState != 1) return;
+
+    const message = {
+        SessionID: sessionID,
+        ClientID: userID,
+        Document: documentID,
+        Text: name,
+        Command: command
+    };
+
+    socket.send(JSON.stringify(message));
+}
+
+/*
+    Asks the worker to annotate the characters of the file in the editor from
+    start up to end, which are offsets into the editor's text.*/
+function sendAnnotation(start, end, text) {
+    if (socket.readyState != 1) return;
+
+    const message = {
+        SessionID: sessionID,
+        ClientID: userID,
+        Document: currentDocument,
+        Text: text,
+        Start: start,
+        End: end,
+        Command: ANNOTATE_COMMAND
+    };
+
+    socket.send(JSON.stringify(message));
+}
+
+/*
+    Asks the worker to edit, resolve, reopen or delete an annotation. Only
+    editing uses the text.*/
+function sendAnnotationCommand(command, annotationID, text) {
+    if (socket.readyState != 1) return;
+
+    const message = {
+        SessionID: sessionID,
+        ClientID: userID,
+        ID: annotationID,
+        Text: text,
+        Command: command
+    };
+
+    socket.send(JSON.stringify(message));
+}
+
 function sendElementByID(id) {
     const _element = CRDT.get(id);
     sendElement(_element);
@@ -141,16 +281,24 @@ function recover() {
 
             $.ajax({
                 type: 'get',
-                url: 'http://' + workerIP + '/recover?sessionID=' + sessionID,
+                url: 'http://' + workerIP + '/recover?sessionID=' + sessionID +
+                    '&version=' + encodeURIComponent(JSON.stringify(sessionVersion)),
                 success: function(data) {
                     recoverSuccess();
 
-                    if (data != null && data.Session != null) {
+                    if (data != null && data.Reload) {
+                        reloading = true;
+                    } else if (data != null && data.Session != null) {
                         data.Session.forEach(function(element) {
-                            handleRemoteOperation(element);
+                            handleWorkerElement(element);
                         });
                     }
 
+                    if (data != null && data.Version != null) {
+                        sessionVersion = data.Version;
+                        scheduleAck();
+                    }
+
                     if (data.hasOwnProperty('LogRecord')) {
                         const logs = data.LogRecord
                         if (logs != null) {
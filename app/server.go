@@ -14,6 +14,9 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"time"
+
+	. "../lib/types"
 )
 
 type SessionSettings struct {
@@ -26,6 +29,10 @@ type SessionsAndUsers struct {
 	AllUsernames     []string `json:"AllUsernames"`
 }
 
+type MergeResult struct {
+	Merged int `json:"Merged"`
+}
+
 type AppServer struct {
 	LBConn          *rpc.Client
 	CurrentSessions []string
@@ -56,6 +63,9 @@ func main() {
 	http.Handle("/", http.FileServer(http.Dir("./public")))
 	http.HandleFunc("/register", appserver.RegisterHandler)
 	http.HandleFunc("/sessions", appserver.SessionHandler)
+	http.HandleFunc("/fork", appserver.ForkHandler)
+	http.HandleFunc("/merge", appserver.MergeHandler)
+	http.HandleFunc("/snapshot", appserver.SnapshotHandler)
 	appserver.logger.Println("Listening on: ", PORT)
 	http.ListenAndServe(PORT, nil)
 }
@@ -134,3 +144,117 @@ func (ap *AppServer) SessionHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(sessAndUsers)
 	}
 }
+
+// Function to branch a new session off an existing one
+// Expects the existing session (session) and the new session's ID (fork) as form values
+// Returns a SessionSetting for the fork to the browser, like /register
+//
+func (ap *AppServer) ForkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		ap.logger.Println("Got a /fork POST Request")
+		err := r.ParseForm()
+		if err != nil {
+			ap.logger.Println("Error Parsing Form: ", err)
+			return
+		}
+		srcID := r.FormValue("session")
+		forkID := r.FormValue("fork")
+		if len(srcID) == 0 || len(forkID) == 0 {
+			http.Error(w, "Missing session or fork in form", http.StatusBadRequest)
+			return
+		}
+
+		request := WorkerRequest{Payload: []interface{}{srcID, forkID}}
+		var retWorkerIP string
+		err = ap.LBConn.Call("LBServer.ForkSession", request, &retWorkerIP)
+		if err != nil || len(retWorkerIP) == 0 {
+			ap.logger.Println("Error forking session: ", err)
+			http.Error(w, "Could not fork session "+srcID, http.StatusInternalServerError)
+			return
+		}
+
+		sessionSettings := *new(SessionSettings)
+		sessionSettings.SessID = forkID
+		sessionSettings.WorkerIP = retWorkerIP
+		ap.logger.Println("Session Settings: ", sessionSettings)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(sessionSettings)
+		ap.CurrentSessions = append(ap.CurrentSessions, forkID)
+	}
+}
+
+// Function to fold the edits made to a fork back into a session
+// Expects the fork (fork) and the session to merge it into (target) as form values
+// Returns the number of elements applied to the target
+//
+func (ap *AppServer) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		ap.logger.Println("Got a /merge POST Request")
+		err := r.ParseForm()
+		if err != nil {
+			ap.logger.Println("Error Parsing Form: ", err)
+			return
+		}
+		forkID := r.FormValue("fork")
+		targetID := r.FormValue("target")
+		if len(forkID) == 0 || len(targetID) == 0 {
+			http.Error(w, "Missing fork or target in form", http.StatusBadRequest)
+			return
+		}
+
+		request := WorkerRequest{Payload: []interface{}{forkID, targetID}}
+		response := new(WorkerResponse)
+		err = ap.LBConn.Call("LBServer.MergeSession", request, response)
+		if err != nil || len(response.Payload) == 0 {
+			ap.logger.Println("Error merging session: ", err)
+			http.Error(w, "Could not merge session "+forkID+" into "+targetID, http.StatusInternalServerError)
+			return
+		}
+
+		result := MergeResult{Merged: response.Payload[0].(int)}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// Function to save a named snapshot of a session
+// Expects the session (session) and the snapshot's name (name) as form values, and optionally
+// the time to take the snapshot at (time) in RFC 3339 format, eg. 2006-01-02T15:04:05Z
+// The snapshot is of the session as it is now if no time is given
+//
+func (ap *AppServer) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		ap.logger.Println("Got a /snapshot POST Request")
+		err := r.ParseForm()
+		if err != nil {
+			ap.logger.Println("Error Parsing Form: ", err)
+			return
+		}
+		sessionID := r.FormValue("session")
+		name := r.FormValue("name")
+		if len(sessionID) == 0 || len(name) == 0 {
+			http.Error(w, "Missing session or name in form", http.StatusBadRequest)
+			return
+		}
+
+		request := WorkerRequest{Payload: []interface{}{sessionID, name}}
+		if at := r.FormValue("time"); len(at) > 0 {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				http.Error(w, "Invalid time in form: "+at, http.StatusBadRequest)
+				return
+			}
+			request.Payload = append(request.Payload, t.UnixNano())
+		}
+
+		var ignored bool
+		err = ap.LBConn.Call("LBServer.SaveSnapshot", request, &ignored)
+		if err != nil {
+			ap.logger.Println("Error saving snapshot: ", err)
+			http.Error(w, "Could not save snapshot "+name+" of session "+sessionID, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
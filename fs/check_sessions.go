@@ -0,0 +1,118 @@
+package main
+
+// Usage: go run check_sessions.go [-repair] [session dir]
+
+/*
+Checks every session saved by an FSNode for structural violations (see
+Session.Validate) and prints them. With -repair, corrupted sessions are
+repaired and written back in place.
+
+The session directory defaults to ./session. FSNodes run in TEMP_MODE keep
+their sessions in ./session_<nodeid> instead.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "../lib/session"
+)
+
+const DEFAULT_SESSION_DIR = "./session"
+
+func main() {
+	repair := flag.Bool("repair", false, "repair corrupted sessions and save them")
+	flag.Parse()
+
+	sessionDir := DEFAULT_SESSION_DIR
+	if flag.NArg() > 1 {
+		fmt.Println("Usage: go run check_sessions.go [-repair] [session dir]")
+		os.Exit(1)
+	} else if flag.NArg() == 1 {
+		sessionDir = flag.Arg(0)
+	}
+
+	files, err := ioutil.ReadDir(sessionDir)
+	if checkError(err) != nil {
+		os.Exit(1)
+	}
+
+	numCorrupted, numFailed := 0, 0
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		filePath := path.Join(sessionDir, file.Name())
+		corrupted, err := checkSession(filePath, *repair)
+		if checkError(err) != nil {
+			fmt.Println("Failed to check session [" + file.Name() + "]")
+			numFailed++
+		} else if corrupted {
+			numCorrupted++
+		}
+	}
+
+	fmt.Printf("Checked %d sessions: %d corrupted, %d failed\n", len(files), numCorrupted, numFailed)
+	if numFailed > 0 || (numCorrupted > 0 && !*repair) {
+		os.Exit(1)
+	}
+}
+
+// Validates the session saved at filePath, repairing it if repair is set.
+// Returns whether the session was corrupted.
+func checkSession(filePath string, repair bool) (bool, error) {
+	sessionBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	session, err := DecodeSession(sessionBytes)
+	if err != nil {
+		return false, err
+	}
+
+	violations := session.Validate()
+	if violations == nil {
+		return false, nil
+	}
+
+	fmt.Printf("Session [%s] has %d violations:\n", session.ID, len(violations))
+	for _, violation := range violations {
+		fmt.Println("\t" + violation.Error())
+	}
+
+	if !repair {
+		return true, nil
+	}
+
+	session.Repair()
+	if violations := session.Validate(); violations != nil {
+		return true, fmt.Errorf("%d violations left after repair", len(violations))
+	}
+
+	sessionBytes, err = EncodeSession(session)
+	if err != nil {
+		return true, err
+	}
+
+	err = ioutil.WriteFile(filePath, sessionBytes, 0644)
+	if err != nil {
+		return true, err
+	}
+
+	fmt.Println("Session [" + session.ID + "] repaired")
+
+	return true, nil
+}
+
+func checkError(err error) error {
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
+	return nil
+}
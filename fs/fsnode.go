@@ -22,6 +22,12 @@ import (
 )
 
 const NODE_ID_PATH = "nodeID"
+
+// Named snapshots of a session are saved in their own directory under the
+// session directory, ie. <session dir>/snapshots/<session ID>/<name>. Names
+// are relative paths like file names, so "v1" and "a/v1" are different
+// snapshots
+const SNAPSHOT_DIR = "snapshots"
 const HEARTBEAT_INTERVAL = 500
 const VERBOSE_LOG = false
 
@@ -201,9 +207,10 @@ func (f *FSNode) SaveSession(request *FSRequest, response *FSResponse) (_ error)
 	var recbuf []byte
 	f.golog.UnpackReceive(logMsg, request.Payload[1].([]byte), &recbuf)
 
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	err := enc.Encode(session)
+	sessionBytes, err := EncodeSession(&session)
+	if checkError(err) != nil {
+		return
+	}
 
 	filePath := path.Join(f.sessionDir, session.ID)
 	file, err := openFile(filePath)
@@ -217,7 +224,7 @@ func (f *FSNode) SaveSession(request *FSRequest, response *FSResponse) (_ error)
 		return
 	}
 
-	_, err = file.Write(buffer.Bytes())
+	_, err = file.Write(sessionBytes)
 	if checkError(err) != nil {
 		return
 	}
@@ -257,9 +264,8 @@ func (f *FSNode) GetSession(request *FSRequest, response *FSResponse) (_ error)
 		return
 	}
 
-	dec := gob.NewDecoder(bytes.NewReader(sessionBytes))
-	session := new(Session)
-	err = dec.Decode(session)
+	// Sessions saved with string element IDs are migrated on load
+	session, err := DecodeSession(sessionBytes)
 	if checkError(err) != nil {
 		return
 	}
@@ -276,6 +282,178 @@ func (f *FSNode) GetSession(request *FSRequest, response *FSResponse) (_ error)
 	return
 }
 
+// Merges a delta into a session saved on disk. The delta is only merged if
+// the saved session has every operation the delta was taken since, otherwise
+// the node is missing operations and needs the whole session saved again.
+func (f *FSNode) MergeSession(request *FSRequest, response *FSResponse) (_ error) {
+	delta := request.Payload[0].(Delta)
+	logMsg := "Merging delta of session [" + delta.SessionID + "] to disk"
+
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+	var recbuf []byte
+	f.golog.UnpackReceive(logMsg, request.Payload[1].([]byte), &recbuf)
+
+	filePath := path.Join(f.sessionDir, delta.SessionID)
+	sessionExists, err := checkFileOrDirectory(filePath)
+	if checkError(err) != nil || !sessionExists {
+		return
+	}
+
+	sessionBytes, err := ioutil.ReadFile(filePath)
+	if checkError(err) != nil {
+		return
+	}
+
+	session, err := DecodeSession(sessionBytes)
+	if checkError(err) != nil {
+		return
+	}
+
+	if !session.Version().Covers(delta.Since) {
+		logMsg = "Session [" + delta.SessionID + "] is missing operations, delta not merged"
+		f.logger.Println(logMsg)
+		return
+	}
+
+	session.Merge(delta)
+	sessionBytes, err = EncodeSession(session)
+	if checkError(err) != nil {
+		return
+	}
+
+	file, err := openFile(filePath)
+	if checkError(err) != nil {
+		return
+	}
+
+	defer file.Close()
+	err = file.Truncate(0)
+	if checkError(err) != nil {
+		return
+	}
+
+	_, err = file.Write(sessionBytes)
+	if checkError(err) != nil {
+		return
+	}
+
+	file.Sync()
+
+	logMsg = "Delta of session [" + delta.SessionID + "] merged"
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = true
+	response.Payload[1] = f.golog.PrepareSend(logMsg, []byte{})
+
+	return
+}
+
+func (f *FSNode) SaveSnapshot(request *FSRequest, response *FSResponse) (_ error) {
+	session := request.Payload[0].(Session)
+	name := request.Payload[1].(string)
+	logMsg := "Saving snapshot [" + name + "] of session [" + session.ID + "] to disk"
+
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+	var recbuf []byte
+	f.golog.UnpackReceive(logMsg, request.Payload[2].([]byte), &recbuf)
+
+	if !ValidFileName(name) {
+		checkError(InvalidFileNameError(name))
+		return
+	}
+
+	sessionBytes, err := EncodeSession(&session)
+	if checkError(err) != nil {
+		return
+	}
+
+	filePath := path.Join(f.sessionDir, SNAPSHOT_DIR, session.ID, name)
+	err = os.MkdirAll(path.Dir(filePath), 0755)
+	if checkError(err) != nil {
+		return
+	}
+
+	file, err := openFile(filePath)
+	if checkError(err) != nil {
+		return
+	}
+
+	defer file.Close()
+	err = file.Truncate(0)
+	if checkError(err) != nil {
+		return
+	}
+
+	_, err = file.Write(sessionBytes)
+	if checkError(err) != nil {
+		return
+	}
+
+	file.Sync()
+
+	logMsg = "Snapshot [" + name + "] of session [" + session.ID + "] saved"
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = true
+	response.Payload[1] = f.golog.PrepareSend(logMsg, []byte{})
+
+	return
+}
+
+func (f *FSNode) GetSnapshot(request *FSRequest, response *FSResponse) (_ error) {
+	sessionID := request.Payload[0].(string)
+	name := request.Payload[1].(string)
+	logMsg := "Retrieving snapshot [" + name + "] of session [" + sessionID + "] from disk"
+
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+	var recbuf []byte
+	f.golog.UnpackReceive(logMsg, request.Payload[2].([]byte), &recbuf)
+
+	if !ValidFileName(name) {
+		checkError(InvalidFileNameError(name))
+		return
+	}
+
+	filePath := path.Join(f.sessionDir, SNAPSHOT_DIR, sessionID, name)
+	snapshotExists, err := checkFileOrDirectory(filePath)
+	if checkError(err) != nil || !snapshotExists {
+		return
+	}
+
+	sessionBytes, err := ioutil.ReadFile(filePath)
+	if checkError(err) != nil {
+		return
+	}
+
+	session, err := DecodeSession(sessionBytes)
+	if checkError(err) != nil {
+		return
+	}
+
+	logMsg = "Sending snapshot [" + name + "] of session [" + sessionID + "] to server"
+	if VERBOSE_LOG {
+		f.logger.Println(logMsg)
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = *session
+	response.Payload[1] = f.golog.PrepareSend(logMsg, []byte{})
+
+	return
+}
+
 func (f *FSNode) SaveLog(request *FSRequest, response *FSResponse) (_ error) {
 	_log := request.Payload[0].(Log)
 	logMsg := "Saving log [" + _log.Job.JobID + "] to disk"
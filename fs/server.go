@@ -25,18 +25,20 @@ import (
 const HEARTBEAT_INTERVAL = 2000
 const VERBOSE_LOG = false
 
-// nodes:    All known FS nodes, connected or not
-// sessions: All known sessions
-// logs:     All known logs
-// index:    A structure mapping sessionIDs to logs
+// nodes:     All known FS nodes, connected or not
+// sessions:  All known sessions
+// snapshots: All known named snapshots, keyed by snapshotKey
+// logs:      All known logs
+// index:     A structure mapping sessionIDs to logs
 //
 type Server struct {
-	logger   *log.Logger
-	nodes    *FSNodes
-	sessions *Sessions
-	logs     *Logs
-	index    *Index
-	golog    *govec.GoLog
+	logger    *log.Logger
+	nodes     *FSNodes
+	sessions  *Sessions
+	snapshots *Sessions
+	logs      *Logs
+	index     *Index
+	golog     *govec.GoLog
 }
 
 // A map of node IDs to file system nodes.
@@ -104,6 +106,7 @@ func (s *Server) init() {
 	s.logger = log.New(os.Stdout, "[Initializing] ", log.Lshortfile)
 	s.nodes = &FSNodes{all: make(map[string]*FSNode)}
 	s.sessions = &Sessions{all: make(map[string]map[string]*FSNode)}
+	s.snapshots = &Sessions{all: make(map[string]map[string]*FSNode)}
 	s.logs = &Logs{all: make(map[string]map[string]*FSNode)}
 	s.index = &Index{logs: make(map[string]map[string]bool)}
 	s.golog = govec.InitGoVector("FSServer", "FSServer")
@@ -149,9 +152,9 @@ func (s *Server) listenRPC() {
 // that the session can be retrieved from this node at a later time.
 // If the session cannot be saved, then the node is removed from that
 // map (since, if it was previously known to contain that session, it
-// now has an outdated version).
+// now has an outdated version). Returns whether the node saved it.
 //
-func (s *Server) saveSessionToNode(session *Session, node *FSNode) {
+func (s *Server) saveSessionToNode(session *Session, node *FSNode) bool {
 	logMsg := "Saving session [" + session.ID + "] to node [" + node.nodeID + "]"
 	if VERBOSE_LOG {
 		s.logger.Println(logMsg)
@@ -165,7 +168,8 @@ func (s *Server) saveSessionToNode(session *Session, node *FSNode) {
 	err := node.nodeConn.Call("FSNode.SaveSession", request, response)
 	checkError(err)
 
-	if len(response.Payload) > 0 {
+	saved := len(response.Payload) > 0
+	if saved {
 		s.sessions.addNode(session.ID, node)
 		logMsg = "Session [" + session.ID + "] saved"
 		var recbuf []byte
@@ -179,6 +183,44 @@ func (s *Server) saveSessionToNode(session *Session, node *FSNode) {
 	if VERBOSE_LOG {
 		s.logger.Println(logMsg)
 	}
+
+	return saved
+}
+
+// Merges a delta into the session saved on a specified node. If the
+// node can't merge it, eg. because it missed an earlier save, the node is
+// removed from the map (s.sessions) since its copy is now outdated.
+//
+func (s *Server) mergeSessionToNode(delta *Delta, node *FSNode) bool {
+	logMsg := "Merging delta of session [" + delta.SessionID + "] to node [" + node.nodeID + "]"
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	request := new(FSRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = *delta
+	request.Payload[1] = s.golog.PrepareSend(logMsg, []byte{})
+	response := new(FSResponse)
+	err := node.nodeConn.Call("FSNode.MergeSession", request, response)
+	checkError(err)
+
+	merged := len(response.Payload) > 0
+	if merged {
+		logMsg = "Delta of session [" + delta.SessionID + "] merged"
+		var recbuf []byte
+		s.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
+	} else {
+		s.sessions.removeNode(delta.SessionID, node.nodeID)
+		logMsg = "Delta of session [" + delta.SessionID + "] could not be merged"
+		s.golog.LogLocalEvent(logMsg)
+	}
+
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	return merged
 }
 
 // Attempts to retrieve a session from a specified node.
@@ -216,6 +258,79 @@ func (s *Server) getSessionFromNode(sessionID string, node *FSNode) (sess *Sessi
 	return
 }
 
+// Saves a named snapshot of a session to a specified node. Like
+// saveSessionToNode, the node is added to or removed from the map
+// (s.snapshots) depending on whether the snapshot was saved.
+//
+func (s *Server) saveSnapshotToNode(session *Session, name string, node *FSNode) {
+	key := snapshotKey(session.ID, name)
+	logMsg := "Saving snapshot [" + key + "] to node [" + node.nodeID + "]"
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	request := new(FSRequest)
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = *session
+	request.Payload[1] = name
+	request.Payload[2] = s.golog.PrepareSend(logMsg, []byte{})
+	response := new(FSResponse)
+	err := node.nodeConn.Call("FSNode.SaveSnapshot", request, response)
+	checkError(err)
+
+	if len(response.Payload) > 0 {
+		s.snapshots.addNode(key, node)
+		logMsg = "Snapshot [" + key + "] saved"
+		var recbuf []byte
+		s.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
+	} else {
+		s.snapshots.removeNode(key, node.nodeID)
+		logMsg = "Snapshot [" + key + "] could not be saved"
+		s.golog.LogLocalEvent(logMsg)
+	}
+
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+}
+
+// Attempts to retrieve a named snapshot of a session from a specified node.
+//
+func (s *Server) getSnapshotFromNode(sessionID, name string, node *FSNode) (sess *Session) {
+	key := snapshotKey(sessionID, name)
+	logMsg := "Retrieving snapshot [" + key + "] from node [" + node.nodeID + "]"
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	request := new(FSRequest)
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = sessionID
+	request.Payload[1] = name
+	request.Payload[2] = s.golog.PrepareSend(logMsg, []byte{})
+	response := new(FSResponse)
+	err := node.nodeConn.Call("FSNode.GetSnapshot", request, response)
+	checkError(err)
+
+	if len(response.Payload) == 0 {
+		logMsg = "Snapshot [" + key + "] could not be retrieved"
+		s.golog.LogLocalEvent(logMsg)
+		sess = nil
+	} else {
+		logMsg = "Snapshot [" + key + "] retrieved"
+		session := response.Payload[0].(Session)
+		var recbuf []byte
+		s.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
+		sess = &session
+	}
+
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	return
+}
+
 // A helper function for retrieving a single log specified by the
 // given job ID. An attempt will be made to retrieve the log from any
 // node which is known to have it, and if any retrieval fails, that
@@ -399,7 +514,9 @@ func (s *Server) RegisterNode(request *FSRequest, response *FSResponse) (_ error
 }
 
 // Save a session to the file system. The file server will attempt to
-// save the session to all connected file system nodes.
+// save the session to all connected file system nodes. Like
+// SaveSessionDelta, the save is complete when this returns, and the
+// response is false if no node saved the session.
 //
 func (s *Server) SaveSession(request *FSRequest, response *FSResponse) (_ error) {
 	session := request.Payload[0].(Session)
@@ -409,22 +526,74 @@ func (s *Server) SaveSession(request *FSRequest, response *FSResponse) (_ error)
 	var recbuf []byte
 	s.golog.UnpackReceive(logMsg, request.Payload[1].([]byte), &recbuf)
 
+	var saved int32
+	wg := &sync.WaitGroup{}
 	nodes := s.nodes.getAll()
 	for _, node := range nodes {
 		if isConnected(node) {
-			go s.saveSessionToNode(&session, node)
+			wg.Add(1)
+			go func(node *FSNode) {
+				defer wg.Done()
+				if s.saveSessionToNode(&session, node) {
+					atomic.AddInt32(&saved, 1)
+				}
+			}(node)
 		} else {
 			s.sessions.removeNode(session.ID, node.nodeID)
 		}
 	}
+	wg.Wait()
 
-	logMsg = "Session [" + session.ID + "] save started"
+	logMsg = "Session [" + session.ID + "] saved to " + fmt.Sprint(saved) + " nodes"
 	if VERBOSE_LOG {
 		s.logger.Println(logMsg)
 	}
 
 	response.Payload = make([]interface{}, 2)
-	response.Payload[0] = true
+	response.Payload[0] = saved > 0
+	response.Payload[1] = s.golog.PrepareSend(logMsg, []byte{})
+
+	return
+}
+
+// Save the operations of a session since an earlier save. Unlike
+// SaveSession, the delta is only merged into the nodes known to have the
+// session, and the save is complete when this returns. The response is
+// false if no node merged the delta, in which case the whole session
+// should be saved instead.
+//
+func (s *Server) SaveSessionDelta(request *FSRequest, response *FSResponse) (_ error) {
+	delta := request.Payload[0].(Delta)
+	logMsg := "Saving delta of session [" + delta.SessionID + "] to file system"
+
+	s.logger.Println(logMsg)
+	var recbuf []byte
+	s.golog.UnpackReceive(logMsg, request.Payload[1].([]byte), &recbuf)
+
+	var merged int32
+	wg := &sync.WaitGroup{}
+	for _, node := range s.sessions.get(delta.SessionID) {
+		if isConnected(node) {
+			wg.Add(1)
+			go func(node *FSNode) {
+				defer wg.Done()
+				if s.mergeSessionToNode(&delta, node) {
+					atomic.AddInt32(&merged, 1)
+				}
+			}(node)
+		} else {
+			s.sessions.removeNode(delta.SessionID, node.nodeID)
+		}
+	}
+	wg.Wait()
+
+	logMsg = "Delta of session [" + delta.SessionID + "] saved to " + fmt.Sprint(merged) + " nodes"
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = merged > 0
 	response.Payload[1] = s.golog.PrepareSend(logMsg, []byte{})
 
 	return
@@ -468,6 +637,79 @@ func (s *Server) GetSession(request *FSRequest, response *FSResponse) (_ error)
 	return
 }
 
+// Save a named snapshot of a session to the file system. The file
+// server will attempt to save the snapshot to all connected file system
+// nodes, replacing any snapshot of the session with the same name.
+//
+func (s *Server) SaveSnapshot(request *FSRequest, response *FSResponse) (_ error) {
+	session := request.Payload[0].(Session)
+	name := request.Payload[1].(string)
+	key := snapshotKey(session.ID, name)
+	logMsg := "Saving snapshot [" + key + "] to file system"
+
+	s.logger.Println(logMsg)
+	var recbuf []byte
+	s.golog.UnpackReceive(logMsg, request.Payload[2].([]byte), &recbuf)
+
+	nodes := s.nodes.getAll()
+	for _, node := range nodes {
+		if isConnected(node) {
+			go s.saveSnapshotToNode(&session, name, node)
+		} else {
+			s.snapshots.removeNode(key, node.nodeID)
+		}
+	}
+
+	logMsg = "Snapshot [" + key + "] save started"
+	if VERBOSE_LOG {
+		s.logger.Println(logMsg)
+	}
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = true
+	response.Payload[1] = s.golog.PrepareSend(logMsg, []byte{})
+
+	return
+}
+
+// Get a named snapshot of a session from the file system, given a
+// session ID and the snapshot's name.
+//
+func (s *Server) GetSnapshot(request *FSRequest, response *FSResponse) (_ error) {
+	sessionID := request.Payload[0].(string)
+	name := request.Payload[1].(string)
+	key := snapshotKey(sessionID, name)
+	logMsg := "Retrieving snapshot [" + key + "] from file system"
+
+	s.logger.Println(logMsg)
+	var recbuf []byte
+	s.golog.UnpackReceive(logMsg, request.Payload[2].([]byte), &recbuf)
+
+	nodes := s.snapshots.get(key)
+
+	for _, node := range nodes {
+		if isConnected(node) {
+			session := s.getSnapshotFromNode(sessionID, name, node)
+			if session != nil {
+				logMsg = "Sending snapshot [" + key + "] to worker"
+				if VERBOSE_LOG {
+					s.logger.Println(logMsg)
+				}
+
+				response.Payload = make([]interface{}, 2)
+				response.Payload[0] = *session
+				response.Payload[1] = s.golog.PrepareSend(logMsg, []byte{})
+
+				break
+			} else {
+				s.snapshots.removeNode(key, node.nodeID)
+			}
+		}
+	}
+
+	return
+}
+
 // Save a log to the file system. The file server will attempt to save
 // the log to all connected file system nodes.
 //
@@ -540,6 +782,10 @@ func isConnected(node *FSNode) bool {
 	return since <= int64(HEARTBEAT_INTERVAL * time.Millisecond)
 }
 
+func snapshotKey(sessionID, name string) string {
+	return sessionID + "/" + name
+}
+
 var ALPHABET = []rune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
 
 func generateNodeID(length int) string {
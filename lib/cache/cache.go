@@ -1,55 +1,164 @@
 package cache
 
 import (
+	"sync"
 	"time"
 
 	. "../session"
 )
 
+/*
+The cache keeps the elements a worker received from other workers for a short
+while, so a session that is still being loaded can catch up on them, and a
+recovering browser can be sent the elements it may have missed.
+
+A cache is used concurrently by RPC handlers and by Maintain, so every method
+takes its lock. Elements expire ExpiryThreshold after they were added, except
+in sessions that are pending (being loaded). Memory is bounded per session and
+overall by the estimated size of the cached elements: when a limit is exceeded
+the oldest elements are evicted, preferring sessions that aren't pending. A
+limit of 0 or less means no limit.
+*/
+
+// Default seconds between maintenance runs
 const MAINTENANCE_INTERVAL int = 2
+
+// Default seconds after which cached elements expire
 const EXPIRY_THRESHOLD int = 5 * MAINTENANCE_INTERVAL
 
+// Default limits, in bytes, of the elements cached for one session and for
+// all sessions
+const MAX_SESSION_BYTES int = 1 << 20
+const MAX_BYTES int = 64 << 20
+
+// Estimated bytes an element takes besides its strings
+const ELEMENT_OVERHEAD int = 128
+
+type CacheSettings struct {
+	MaintenanceInterval time.Duration
+	ExpiryThreshold     time.Duration
+	MaxSessionBytes     int
+	MaxBytes            int
+}
+
+// Counters of how the cache has been used. Hits and Misses count calls to
+// Get that did and didn't find cached elements. Evictions counts elements
+// dropped to stay within the memory limits, and Expirations elements dropped
+// for being too old.
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Elements    int
+	Bytes       int
+}
+
 type Cache struct {
-	elements        map[string][]Element
+	elements        map[string][]entry
+	keys            map[string]map[entryKey]bool
+	sessionBytes    map[string]int
 	pendingSessions map[string]bool
+	settings        CacheSettings
+	stats           CacheStats
+	seq             uint64
+	mux             sync.Mutex
+}
+
+// A cached element, with when it was added and the order it was added in
+type entry struct {
+	element Element
+	added   time.Time
+	seq     uint64
+	size    int
+}
+
+// Deletes of runs with the same first ID and different lengths are different
+// operations, so the text is part of the key
+type entryKey struct {
+	id      ElementID
+	deleted bool
+	text    string
+}
+
+func DefaultSettings() CacheSettings {
+	return CacheSettings{
+		MaintenanceInterval: time.Second * time.Duration(MAINTENANCE_INTERVAL),
+		ExpiryThreshold:     time.Second * time.Duration(EXPIRY_THRESHOLD),
+		MaxSessionBytes:     MAX_SESSION_BYTES,
+		MaxBytes:            MAX_BYTES}
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <PRIVATE METHODS>
 
-func (c *Cache) remove(sessionID string, index int) {
-	session := c.elements[sessionID]
-	c.elements[sessionID] = append(session[:index], session[index+1:]...)
+// Removes the oldest element of a session.
+func (c *Cache) removeOldest(sessionID string) {
+	oldest := c.elements[sessionID][0]
+	c.elements[sessionID] = c.elements[sessionID][1:]
+	delete(c.keys[sessionID], keyOf(oldest.element))
+	c.sessionBytes[sessionID] -= oldest.size
+	c.stats.Bytes -= oldest.size
+	c.stats.Elements--
+
+	if len(c.elements[sessionID]) == 0 {
+		delete(c.elements, sessionID)
+		delete(c.keys, sessionID)
+		delete(c.sessionBytes, sessionID)
+	}
 }
 
+// Removes the expired elements of a session. Elements are kept in the order
+// they were added, so only the oldest ones need to be checked.
 func (c *Cache) clean(sessionID string) {
-	var numDeleted int = 0
+	now := time.Now()
+	for len(c.elements[sessionID]) > 0 && now.Sub(c.elements[sessionID][0].added) >= c.settings.ExpiryThreshold {
+		c.removeOldest(sessionID)
+		c.stats.Expirations++
+	}
+}
 
-	cachedElements := c.elements[sessionID]
-	for i, element := range cachedElements {
-		if int(time.Now().Unix()-element.Timestamp) < EXPIRY_THRESHOLD {
-			break
-		} else {
-			i = i - numDeleted
-			numDeleted++
+// Evicts the oldest elements until the session and the cache are within
+// their limits.
+func (c *Cache) evict(sessionID string) {
+	for c.settings.MaxSessionBytes > 0 && c.sessionBytes[sessionID] > c.settings.MaxSessionBytes {
+		c.removeOldest(sessionID)
+		c.stats.Evictions++
+	}
 
-			c.remove(sessionID, i)
-		}
+	for c.settings.MaxBytes > 0 && c.stats.Bytes > c.settings.MaxBytes {
+		c.removeOldest(c.oldestSession())
+		c.stats.Evictions++
 	}
 }
 
-func (c *Cache) exists(element Element) bool {
-	sessionID := element.SessionID
+// Returns the session with the oldest element, preferring sessions that
+// aren't pending.
+func (c *Cache) oldestSession() string {
+	var oldest string
+	var oldestSeq uint64
+	var oldestPending bool
+	found := false
 
-	var exists bool = false
-	for _, _element := range c.elements[sessionID] {
-		if _element.ID == element.ID && _element.Deleted == element.Deleted {
-			exists = true
-			break
+	for sessionID, entries := range c.elements {
+		pending := c.pendingSessions[sessionID]
+		seq := entries[0].seq
+		if !found || (oldestPending && !pending) || (oldestPending == pending && seq < oldestSeq) {
+			oldest, oldestSeq, oldestPending = sessionID, seq, pending
+			found = true
 		}
 	}
 
-	return exists
+	return oldest
+}
+
+func keyOf(element Element) entryKey {
+	return entryKey{element.ID, element.Deleted, element.Text}
+}
+
+func size(element Element) int {
+	return ELEMENT_OVERHEAD + len(element.SessionID) + len(element.ClientID) + len(element.Text) +
+		len(element.ID.Replica) + len(element.PrevID.Replica) + len(element.NextID.Replica) + len(element.Document)
 }
 
 // </PRIVATE METHODS>
@@ -61,41 +170,110 @@ func (c *Cache) exists(element Element) bool {
 // <PUBLIC METHODS>
 
 func (c *Cache) Init() {
-	c.elements = make(map[string][]Element)
+	c.InitWithSettings(DefaultSettings())
+}
+
+func (c *Cache) InitWithSettings(settings CacheSettings) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.elements = make(map[string][]entry)
+	c.keys = make(map[string]map[entryKey]bool)
+	c.sessionBytes = make(map[string]int)
 	c.pendingSessions = make(map[string]bool)
+	c.settings = settings
 }
 
 func (c *Cache) Maintain() {
+	c.mux.Lock()
+	interval := c.settings.MaintenanceInterval
+	c.mux.Unlock()
+
+	if interval <= 0 {
+		interval = DefaultSettings().MaintenanceInterval
+	}
+
 	for {
-		time.Sleep(time.Second * time.Duration(MAINTENANCE_INTERVAL))
+		time.Sleep(interval)
 
+		c.mux.Lock()
 		for sessionID := range c.elements {
-			if pending, ok := c.pendingSessions[sessionID]; !ok || pending == false {
+			if !c.pendingSessions[sessionID] {
 				c.clean(sessionID)
 			}
 		}
+		c.mux.Unlock()
 	}
 }
 
-func (c *Cache) Add(element Element) {
+// Caches an element. Returns false if it was already cached.
+func (c *Cache) Add(element Element) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
 	sessionID := element.SessionID
+	key := keyOf(element)
+	if c.keys[sessionID][key] {
+		return false
+	}
+
+	element.Timestamp = time.Now().Unix()
+	c.seq++
+	_entry := entry{element: element, added: time.Now(), seq: c.seq, size: size(element)}
 
-	if !c.exists(element) {
-		element.Timestamp = time.Now().Unix()
-		c.elements[sessionID] = append(c.elements[sessionID], element)
+	if c.keys[sessionID] == nil {
+		c.keys[sessionID] = make(map[entryKey]bool)
 	}
+	c.elements[sessionID] = append(c.elements[sessionID], _entry)
+	c.keys[sessionID][key] = true
+	c.sessionBytes[sessionID] += _entry.size
+	c.stats.Bytes += _entry.size
+	c.stats.Elements++
+
+	c.evict(sessionID)
+
+	return true
 }
 
+// Returns a copy of the elements cached for a session, oldest first.
 func (c *Cache) Get(sessionID string) []Element {
-	return c.elements[sessionID]
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	entries := c.elements[sessionID]
+	if len(entries) == 0 {
+		c.stats.Misses++
+		return nil
+	}
+
+	c.stats.Hits++
+	elements := make([]Element, len(entries))
+	for i, _entry := range entries {
+		elements[i] = _entry.element
+	}
+
+	return elements
 }
 
 func (c *Cache) AddPending(sessionID string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
 	c.pendingSessions[sessionID] = true
 }
 
 func (c *Cache) RemovePending(sessionID string) {
-	c.pendingSessions[sessionID] = false
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.pendingSessions, sessionID)
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.stats
 }
 
 // </PUBLIC METHODS>
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	. "../session"
+)
+
+// Size of every element made by testElement
+var elementSize = size(testElement("s", 1))
+
+func TestCacheAdd(t *testing.T) {
+	c := new(Cache)
+	c.Init()
+
+	insert := testElement("s", 1)
+	deleted := insert
+	deleted.Deleted = true
+	longer := deleted
+	longer.Text = "xy"
+
+	tests := []struct {
+		name    string
+		element Element
+		added   bool
+	}{
+		{"insert", insert, true},
+		{"same insert", insert, false},
+		{"delete of the insert", deleted, true},
+		{"same delete", deleted, false},
+		{"longer delete", longer, true},
+		{"insert in another session", testElement("t", 1), true},
+	}
+
+	for _, test := range tests {
+		if added := c.Add(test.element); added != test.added {
+			t.Errorf("%s: Add() = %v, want %v", test.name, added, test.added)
+		}
+	}
+
+	if elements := c.Get("s"); len(elements) != 3 {
+		t.Errorf("Get() = %v, want 3 elements", elements)
+	}
+	if stats := c.Stats(); stats.Elements != 4 || stats.Hits != 1 {
+		t.Errorf("Stats() = %+v, want 4 elements and a hit", stats)
+	}
+	if elements := c.Get("unknown"); elements != nil {
+		t.Errorf("Get() of an unknown session = %v", elements)
+	}
+	if stats := c.Stats(); stats.Misses != 1 {
+		t.Errorf("Stats() = %+v, want a miss", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	type added struct {
+		sessionID string
+		counter   int
+	}
+
+	tests := []struct {
+		name            string
+		maxSessionBytes int
+		maxBytes        int
+		pending         []string
+		adds            []added
+		left            map[string][]int // Counters of the elements left, oldest first
+		evictions       uint64
+	}{
+		{"no limits", 0, 0, nil,
+			[]added{{"s", 1}, {"s", 2}, {"t", 1}},
+			map[string][]int{"s": {1, 2}, "t": {1}}, 0},
+		{"session limit", 2 * elementSize, 0, nil,
+			[]added{{"s", 1}, {"t", 1}, {"s", 2}, {"s", 3}, {"t", 2}},
+			map[string][]int{"s": {2, 3}, "t": {1, 2}}, 1},
+		{"session limit of a pending session", 2 * elementSize, 0, []string{"s"},
+			[]added{{"s", 1}, {"s", 2}, {"s", 3}},
+			map[string][]int{"s": {2, 3}}, 1},
+		{"total limit", 0, 3 * elementSize, nil,
+			[]added{{"s", 1}, {"t", 1}, {"s", 2}, {"t", 2}},
+			map[string][]int{"s": {2}, "t": {1, 2}}, 1},
+		{"total limit empties a session", 0, 2 * elementSize, nil,
+			[]added{{"s", 1}, {"t", 1}, {"t", 2}},
+			map[string][]int{"t": {1, 2}}, 1},
+		{"pending session kept", 0, 3 * elementSize, []string{"t"},
+			[]added{{"t", 1}, {"t", 2}, {"s", 1}, {"s", 2}},
+			map[string][]int{"s": {2}, "t": {1, 2}}, 1},
+		{"pending session evicted last", 0, elementSize, []string{"t"},
+			[]added{{"t", 1}, {"t", 2}, {"s", 1}},
+			map[string][]int{"t": {2}}, 2},
+		{"every session pending", 0, 3 * elementSize, []string{"s", "t"},
+			[]added{{"t", 1}, {"s", 1}, {"t", 2}, {"s", 2}},
+			map[string][]int{"s": {1, 2}, "t": {2}}, 1},
+	}
+
+	for _, test := range tests {
+		c := new(Cache)
+		c.InitWithSettings(CacheSettings{MaxSessionBytes: test.maxSessionBytes, MaxBytes: test.maxBytes})
+		for _, sessionID := range test.pending {
+			c.AddPending(sessionID)
+		}
+		for _, _added := range test.adds {
+			c.Add(testElement(_added.sessionID, _added.counter))
+		}
+
+		checkCached(t, test.name, c, test.left)
+		stats := c.Stats()
+		if stats.Evictions != test.evictions {
+			t.Errorf("%s: %d evictions, want %d", test.name, stats.Evictions, test.evictions)
+		}
+		if stats.Bytes != stats.Elements*elementSize {
+			t.Errorf("%s: %d bytes for %d elements", test.name, stats.Bytes, stats.Elements)
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := new(Cache)
+	c.InitWithSettings(CacheSettings{MaintenanceInterval: 5 * time.Millisecond, ExpiryThreshold: 100 * time.Millisecond})
+	go c.Maintain()
+
+	c.AddPending("t")
+	c.Add(testElement("s", 1))
+	c.Add(testElement("t", 1))
+	c.Add(testElement("u", 1))
+	time.Sleep(60 * time.Millisecond)
+	c.Add(testElement("s", 2))
+	c.Add(testElement("u", 2))
+
+	// Elements expire in the order they were added, except in pending
+	// sessions
+	waitForExpirations(t, c, 2)
+	checkCached(t, "first expired", c, map[string][]int{"s": {2}, "t": {1}, "u": {2}})
+
+	waitForExpirations(t, c, 4)
+	checkCached(t, "all expired", c, map[string][]int{"t": {1}})
+
+	// Once the session is loaded its elements expire too
+	c.RemovePending("t")
+	waitForExpirations(t, c, 5)
+	checkCached(t, "no longer pending", c, map[string][]int{})
+
+	// An expired element can be cached again
+	if !c.Add(testElement("s", 1)) {
+		t.Errorf("Add() of an expired element = false")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+func testElement(sessionID string, counter int) Element {
+	return Element{SessionID: sessionID, ID: ElementID{Counter: counter, Replica: "a"}, Text: "x"}
+}
+
+// Checks the counters of the elements cached for each session, oldest first,
+// and that no other session has elements cached.
+func checkCached(t *testing.T, name string, c *Cache, left map[string][]int) {
+	total := 0
+	for sessionID, counters := range left {
+		elements := c.Get(sessionID)
+		total += len(elements)
+		if len(elements) != len(counters) {
+			t.Errorf("%s: session %s has %v cached, want %v", name, sessionID, elements, counters)
+			continue
+		}
+		for i, element := range elements {
+			if element.ID.Counter != counters[i] {
+				t.Errorf("%s: session %s has %v cached, want %v", name, sessionID, elements, counters)
+				break
+			}
+		}
+	}
+
+	if elements := c.Stats().Elements; elements != total {
+		t.Errorf("%s: %d elements cached, want %d", name, elements, total)
+	}
+}
+
+func waitForExpirations(t *testing.T, c *Cache, expirations uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Expirations < expirations {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d elements expired, want %d", c.Stats().Expirations, expirations)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
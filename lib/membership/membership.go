@@ -0,0 +1,376 @@
+package membership
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+A membership is a worker's view of which workers are in the system, kept up
+to date by gossip between the workers rather than by the load balancer, in the
+style of SWIM.
+
+A worker probes one member every ProbeInterval, going round the members in a
+random order. A member that doesn't answer within ProbeTimeout is probed
+indirectly through IndirectProbes other members, and if none of them reaches
+it either it is suspected. A suspect that doesn't refute the suspicion within
+SuspicionTimeout is declared dead. The worker does the probing; the membership
+picks who to probe and records what the probes found.
+
+Changes are disseminated as updates piggybacked on the messages workers send
+each other anyway, at most GossipSize per message, least sent first. Each
+update is sent Retransmit times the log of the number of workers, and then
+dropped. Dead members are forgotten after DEAD_RETENTION, by when no update
+still being sent can bring them back.
+
+Only a member increments its incarnation number. A member that hears it is
+suspected or dead refutes it by announcing it is alive with a greater
+incarnation. Updates about a member are ordered by incarnation, and for the
+same incarnation dead overrides suspect, which overrides alive.
+*/
+
+// Default time between probes
+const PROBE_INTERVAL time.Duration = time.Second
+
+// Default time to wait for a member to answer a probe
+const PROBE_TIMEOUT time.Duration = 300 * time.Millisecond
+
+// Default number of members asked to probe a member that didn't answer
+const INDIRECT_PROBES int = 3
+
+// Default time a suspect has to refute the suspicion
+const SUSPICION_TIMEOUT time.Duration = 5 * PROBE_INTERVAL
+
+// Default largest number of updates piggybacked on a message
+const GOSSIP_SIZE int = 8
+
+// Default multiplier of the number of times each update is sent
+const RETRANSMIT int = 3
+
+// Time dead members are remembered for
+const DEAD_RETENTION time.Duration = time.Minute
+
+type State int
+
+const (
+	ALIVE State = iota
+	SUSPECT
+	DEAD
+)
+
+var stateNames = []string{"alive", "suspect", "dead"}
+
+type MembershipSettings struct {
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	IndirectProbes   int
+	SuspicionTimeout time.Duration
+	GossipSize       int
+	Retransmit       int
+}
+
+type Update struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// A member and since when it has been in its state
+type Member struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+	Since       time.Time
+}
+
+type Membership struct {
+	self        string
+	incarnation uint64
+	members     map[string]*Member
+	updates     map[string]*gossip
+	order       []string // Members in the order they are probed
+	next        int
+	settings    MembershipSettings
+	mux         sync.Mutex
+}
+
+// An update waiting to be disseminated, and how many more times it is sent
+type gossip struct {
+	update        Update
+	transmissions int
+}
+
+func DefaultMembershipSettings() MembershipSettings {
+	return MembershipSettings{
+		ProbeInterval:    PROBE_INTERVAL,
+		ProbeTimeout:     PROBE_TIMEOUT,
+		IndirectProbes:   INDIRECT_PROBES,
+		SuspicionTimeout: SUSPICION_TIMEOUT,
+		GossipSize:       GOSSIP_SIZE,
+		Retransmit:       RETRANSMIT}
+}
+
+func (s State) String() string {
+	return stateNames[s]
+}
+
+// States are shown by name, eg. in JSON
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Applies an update unless it is older than what is known of the member, and
+// queues it to be disseminated. Returns whether it was applied.
+func (m *Membership) apply(update Update) bool {
+	if update.Addr == m.self {
+		if update.State != ALIVE && update.Incarnation >= m.incarnation {
+			m.incarnation = update.Incarnation + 1
+			m.queue(Update{Addr: m.self, State: ALIVE, Incarnation: m.incarnation})
+		}
+		return false
+	}
+
+	member := m.members[update.Addr]
+	if member == nil {
+		member = &Member{Addr: update.Addr}
+		m.members[update.Addr] = member
+	} else if !overrides(update, member) {
+		return false
+	}
+
+	member.State = update.State
+	member.Incarnation = update.Incarnation
+	member.Since = time.Now()
+	m.queue(update)
+
+	return true
+}
+
+// Queues an update to be disseminated, replacing any queued update about the
+// same member.
+func (m *Membership) queue(update Update) {
+	transmissions := m.settings.Retransmit * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	m.updates[update.Addr] = &gossip{update: update, transmissions: transmissions}
+}
+
+// Returns whether an update is newer than what is known of a member
+func overrides(update Update, member *Member) bool {
+	if update.Incarnation != member.Incarnation {
+		return update.Incarnation > member.Incarnation
+	}
+
+	return update.State > member.State
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Starts a membership of the worker at self, with no other members yet. The
+// worker's own update is queued, so it is announced to the first members it
+// gossips with.
+func NewMembership(self string, settings MembershipSettings) *Membership {
+	defaults := DefaultMembershipSettings()
+	if settings.ProbeInterval <= 0 {
+		settings.ProbeInterval = defaults.ProbeInterval
+	}
+	if settings.ProbeTimeout <= 0 {
+		settings.ProbeTimeout = defaults.ProbeTimeout
+	}
+	if settings.IndirectProbes <= 0 {
+		settings.IndirectProbes = defaults.IndirectProbes
+	}
+	if settings.SuspicionTimeout <= 0 {
+		settings.SuspicionTimeout = defaults.SuspicionTimeout
+	}
+	if settings.GossipSize <= 0 {
+		settings.GossipSize = defaults.GossipSize
+	}
+	if settings.Retransmit <= 0 {
+		settings.Retransmit = defaults.Retransmit
+	}
+
+	m := &Membership{
+		self:     self,
+		members:  make(map[string]*Member),
+		updates:  make(map[string]*gossip),
+		settings: settings}
+	m.queue(Update{Addr: self, State: ALIVE})
+
+	return m
+}
+
+func (m *Membership) Settings() MembershipSettings {
+	return m.settings
+}
+
+// Applies updates gossiped by another worker. Returns the ones that changed
+// what is known of a member.
+func (m *Membership) Apply(updates ...Update) []Update {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	applied := make([]Update, 0)
+	for _, update := range updates {
+		if m.apply(update) {
+			applied = append(applied, update)
+		}
+	}
+
+	return applied
+}
+
+// Returns the updates to piggyback on a message, counting them as sent.
+func (m *Membership) Gossip() []Update {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	queued := make([]*gossip, 0, len(m.updates))
+	for _, _gossip := range m.updates {
+		queued = append(queued, _gossip)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].transmissions > queued[j].transmissions
+	})
+
+	updates := make([]Update, 0, m.settings.GossipSize)
+	for _, _gossip := range queued {
+		if len(updates) == m.settings.GossipSize {
+			break
+		}
+
+		updates = append(updates, _gossip.update)
+		_gossip.transmissions--
+		if _gossip.transmissions <= 0 {
+			delete(m.updates, _gossip.update.Addr)
+		}
+	}
+
+	return updates
+}
+
+// Returns the next member to probe. Returns false if there are no members
+// that aren't dead.
+func (m *Membership) NextProbe() (string, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for round := 0; round < 2; round++ {
+		for m.next < len(m.order) {
+			addr := m.order[m.next]
+			m.next++
+			if member := m.members[addr]; member != nil && member.State != DEAD {
+				return addr, true
+			}
+		}
+
+		// Every member has been probed, so start a new round in a new order
+		m.order = m.order[:0]
+		for addr, member := range m.members {
+			if member.State != DEAD {
+				m.order = append(m.order, addr)
+			}
+		}
+		for i, j := range rand.Perm(len(m.order)) {
+			m.order[i], m.order[j] = m.order[j], m.order[i]
+		}
+		m.next = 0
+	}
+
+	return "", false
+}
+
+// Returns up to IndirectProbes members picked at random, other than target,
+// to probe target on the worker's behalf.
+func (m *Membership) Helpers(target string) []string {
+	alive := m.Alive()
+	helpers := make([]string, 0, m.settings.IndirectProbes)
+	for _, i := range rand.Perm(len(alive)) {
+		if len(helpers) == m.settings.IndirectProbes {
+			break
+		}
+		if alive[i] != target {
+			helpers = append(helpers, alive[i])
+		}
+	}
+
+	return helpers
+}
+
+// Suspects a member that couldn't be reached. Returns whether it was alive.
+func (m *Membership) Suspect(addr string) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	member := m.members[addr]
+	if member == nil || member.State != ALIVE {
+		return false
+	}
+
+	return m.apply(Update{Addr: addr, State: SUSPECT, Incarnation: member.Incarnation})
+}
+
+// Declares dead the suspects that didn't refute in time, and forgets members
+// that have been dead for DEAD_RETENTION. Returns the members declared dead.
+func (m *Membership) Expire() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	dead := make([]string, 0)
+	for addr, member := range m.members {
+		switch {
+		case member.State == SUSPECT && time.Since(member.Since) >= m.settings.SuspicionTimeout:
+			m.apply(Update{Addr: addr, State: DEAD, Incarnation: member.Incarnation})
+			dead = append(dead, addr)
+		case member.State == DEAD && time.Since(member.Since) >= DEAD_RETENTION:
+			delete(m.members, addr)
+		}
+	}
+
+	return dead
+}
+
+// Returns the members that are alive, in order of address.
+func (m *Membership) Alive() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	alive := make([]string, 0, len(m.members))
+	for addr, member := range m.members {
+		if member.State == ALIVE {
+			alive = append(alive, addr)
+		}
+	}
+	sort.Strings(alive)
+
+	return alive
+}
+
+// Returns every member, in order of address.
+func (m *Membership) Members() []Member {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Addr < members[j].Addr
+	})
+
+	return members
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
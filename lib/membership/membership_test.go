@@ -0,0 +1,202 @@
+package membership
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		updates     []Update
+		applied     []bool
+		state       State
+		incarnation uint64
+	}{
+		{"joins", []Update{{"b", ALIVE, 0}}, []bool{true}, ALIVE, 0},
+		{"suspected", []Update{{"b", ALIVE, 0}, {"b", SUSPECT, 0}}, []bool{true, true}, SUSPECT, 0},
+		{"alive doesn't override suspect", []Update{{"b", SUSPECT, 0}, {"b", ALIVE, 0}}, []bool{true, false}, SUSPECT, 0},
+		{"refuted", []Update{{"b", SUSPECT, 0}, {"b", ALIVE, 1}}, []bool{true, true}, ALIVE, 1},
+		{"old suspicion ignored", []Update{{"b", ALIVE, 2}, {"b", SUSPECT, 1}}, []bool{true, false}, ALIVE, 2},
+		{"suspect dies", []Update{{"b", SUSPECT, 0}, {"b", DEAD, 0}}, []bool{true, true}, DEAD, 0},
+		{"suspect doesn't override dead", []Update{{"b", DEAD, 0}, {"b", SUSPECT, 0}}, []bool{true, false}, DEAD, 0},
+		{"dead stays dead", []Update{{"b", DEAD, 1}, {"b", ALIVE, 1}}, []bool{true, false}, DEAD, 1},
+		{"rejoins", []Update{{"b", DEAD, 1}, {"b", ALIVE, 2}}, []bool{true, true}, ALIVE, 2},
+		{"same update twice", []Update{{"b", SUSPECT, 3}, {"b", SUSPECT, 3}}, []bool{true, false}, SUSPECT, 3},
+	}
+
+	for _, test := range tests {
+		m := NewMembership("a", MembershipSettings{})
+		for i, update := range test.updates {
+			if applied := len(m.Apply(update)) > 0; applied != test.applied[i] {
+				t.Errorf("%s: update %d applied = %v, want %v", test.name, i, applied, test.applied[i])
+			}
+		}
+
+		member := findMember(m, "b")
+		if member == nil {
+			t.Fatalf("%s: member not known", test.name)
+		}
+		if member.State != test.state || member.Incarnation != test.incarnation {
+			t.Errorf("%s: member is %s at %d, want %s at %d", test.name, member.State, member.Incarnation, test.state, test.incarnation)
+		}
+	}
+}
+
+func TestRefute(t *testing.T) {
+	tests := []struct {
+		name        string
+		updates     []Update
+		incarnation uint64 // Of self after the updates
+	}{
+		{"alive", []Update{{"a", ALIVE, 0}}, 0},
+		{"suspected", []Update{{"a", SUSPECT, 0}}, 1},
+		{"declared dead", []Update{{"a", DEAD, 0}}, 1},
+		{"suspected at a later incarnation", []Update{{"a", SUSPECT, 4}}, 5},
+		{"old suspicion", []Update{{"a", SUSPECT, 0}, {"a", SUSPECT, 0}}, 1},
+		{"suspected again", []Update{{"a", SUSPECT, 0}, {"a", SUSPECT, 1}}, 2},
+	}
+
+	for _, test := range tests {
+		m := NewMembership("a", MembershipSettings{})
+		for _, update := range test.updates {
+			if applied := m.Apply(update); len(applied) > 0 {
+				t.Errorf("%s: update about self applied: %v", test.name, applied)
+			}
+		}
+
+		if findMember(m, "a") != nil {
+			t.Errorf("%s: self is a member", test.name)
+		}
+
+		// The refutation replaces the announcement queued at the start
+		announced := false
+		for _, update := range m.Gossip() {
+			if update.Addr == "a" {
+				announced = true
+				if update.State != ALIVE || update.Incarnation != test.incarnation {
+					t.Errorf("%s: announced %s at %d, want alive at %d", test.name, update.State, update.Incarnation, test.incarnation)
+				}
+			}
+		}
+		if !announced {
+			t.Errorf("%s: self not announced", test.name)
+		}
+	}
+}
+
+func TestSuspectAndExpire(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	tests := []struct {
+		name    string
+		suspect bool          // Whether b is suspected
+		refute  bool          // Whether b refutes the suspicion
+		wait    time.Duration // Before expiring
+		state   State
+	}{
+		{"alive", false, false, 2 * timeout, ALIVE},
+		{"suspect in time", true, false, 0, SUSPECT},
+		{"suspect timed out", true, false, 2 * timeout, DEAD},
+		{"refuted", true, true, 2 * timeout, ALIVE},
+	}
+
+	for _, test := range tests {
+		m := NewMembership("a", MembershipSettings{SuspicionTimeout: timeout})
+		m.Apply(Update{"b", ALIVE, 0}, Update{"c", ALIVE, 0})
+
+		if test.suspect {
+			if !m.Suspect("b") {
+				t.Errorf("%s: Suspect of an alive member = false", test.name)
+			}
+			if m.Suspect("b") {
+				t.Errorf("%s: Suspect of a suspect = true", test.name)
+			}
+		}
+		if test.refute {
+			m.Apply(Update{"b", ALIVE, 1})
+		}
+
+		time.Sleep(test.wait)
+		dead := m.Expire()
+		if (test.state == DEAD) != (len(dead) == 1 && dead[0] == "b") {
+			t.Errorf("%s: Expire() = %v", test.name, dead)
+		}
+
+		if member := findMember(m, "b"); member == nil || member.State != test.state {
+			t.Errorf("%s: member is %v, want %s", test.name, member, test.state)
+		}
+		alive := m.Alive()
+		if (test.state == ALIVE) != (len(alive) == 2) {
+			t.Errorf("%s: Alive() = %v", test.name, alive)
+		}
+		if m.Suspect("unknown") {
+			t.Errorf("%s: Suspect of an unknown member = true", test.name)
+		}
+	}
+}
+
+func TestGossip(t *testing.T) {
+	m := NewMembership("a", MembershipSettings{GossipSize: 2, Retransmit: 1})
+	m.Apply(Update{"b", ALIVE, 0}, Update{"c", ALIVE, 0}, Update{"d", ALIVE, 0})
+
+	// Each update is sent Retransmit times the log of the number of members
+	// when it was queued, least sent first, GossipSize at a time
+	sent := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		updates := m.Gossip()
+		if len(updates) > 2 {
+			t.Fatalf("Gossip() = %v, want at most 2 updates", updates)
+		}
+		for _, update := range updates {
+			sent[update.Addr]++
+		}
+	}
+
+	want := map[string]int{"a": 1, "b": 2, "c": 2, "d": 3}
+	for addr, n := range want {
+		if sent[addr] != n {
+			t.Errorf("update about %s sent %d times, want %d", addr, sent[addr], n)
+		}
+	}
+	if updates := m.Gossip(); len(updates) > 0 {
+		t.Errorf("Gossip() = %v after every update was sent", updates)
+	}
+}
+
+func TestNextProbe(t *testing.T) {
+	m := NewMembership("a", MembershipSettings{})
+	if addr, ok := m.NextProbe(); ok {
+		t.Errorf("NextProbe() = %s with no members", addr)
+	}
+
+	m.Apply(Update{"b", ALIVE, 0}, Update{"c", SUSPECT, 0}, Update{"d", DEAD, 0})
+	for round := 0; round < 3; round++ {
+		probed := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			addr, ok := m.NextProbe()
+			if !ok {
+				t.Fatalf("round %d: NextProbe() found no member", round)
+			}
+			probed[addr] = true
+		}
+		if !probed["b"] || !probed["c"] {
+			t.Errorf("round %d: probed %v, want b and c", round, probed)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+func findMember(m *Membership, addr string) *Member {
+	for _, member := range m.Members() {
+		if member.Addr == addr {
+			return &member
+		}
+	}
+
+	return nil
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
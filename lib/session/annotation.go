@@ -0,0 +1,236 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+Annotations are comments on a range of a document, eg. for code review. An
+annotation is anchored to the IDs of the first and last characters it covers
+rather than to their positions, so it keeps covering the same text while the
+document is edited around it, and grows or shrinks with edits made inside it.
+
+Annotations are replicated as annotation elements: an element with Annotation
+set carries the whole annotation as its client last saw it, or removes it if
+the element is deleted. Like file elements (see CreateFile), the element with
+the greatest ID wins, so concurrent edits to an annotation converge and an
+edit always wins over the edits it was made after.
+
+Annotations are kept by the session rather than by their document, and an
+annotation can arrive before the characters it covers. It is only given a
+position once they do (see DocumentAnnotations).
+*/
+
+// A comment on the characters From through To of a document. ID is the ID of
+// the element that created the annotation, and Edit the ID of the element that
+// last changed it.
+type Annotation struct {
+	ID       ElementID
+	Document string
+	From     ElementID
+	To       ElementID
+	Author   string
+	Text     string
+	Resolved bool
+	Deleted  bool
+	Edit     ElementID
+}
+
+// An annotation and the positions of the characters it covers, [Start, End),
+// among the visible characters of its document. Start and End are -1 if the
+// characters haven't arrived yet or have been collected.
+type AnnotationRange struct {
+	Annotation
+	Start int
+	End   int
+}
+
+type InvalidRangeError string
+
+func (e InvalidRangeError) Error() string {
+	return fmt.Sprintf("Invalid range [%s]", string(e))
+}
+
+type NoAnnotationError string
+
+func (e NoAnnotationError) Error() string {
+	return fmt.Sprintf("No annotation with ID [%s]", string(e))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Applies an annotation element if it is newer than the one that last changed
+// its annotation. Returns the element if it was applied.
+func (s *Session) applyAnnotation(element Element) []Element {
+	current := s.Annotations[element.Annotation.ID]
+	if current != nil && current.Edit == element.ID {
+		s.logOnce(element)
+		return nil
+	}
+
+	s.stamp(&element)
+	s.logOnce(element)
+	if current != nil && element.ID.Less(current.Edit) {
+		return nil
+	}
+
+	if s.Annotations == nil {
+		s.Annotations = make(map[ElementID]*Annotation)
+	}
+
+	annotation := *element.Annotation
+	annotation.Document = element.Document
+	annotation.Deleted = element.Deleted
+	annotation.Edit = element.ID
+	s.Annotations[annotation.ID] = &annotation
+
+	return []Element{element}
+}
+
+// Applies an annotation element with the given ID and annotation on behalf of
+// clientID, removing the annotation if isDelete.
+func (s *Session) annotate(annotation Annotation, id ElementID, clientID string, isDelete bool) Element {
+	element := Element{
+		SessionID:  s.ID,
+		ClientID:   clientID,
+		ID:         id,
+		Document:   annotation.Document,
+		Deleted:    isDelete,
+		Annotation: &annotation}
+
+	s.applyAnnotation(element)
+	return element
+}
+
+// Changes an annotation that hasn't been removed on behalf of clientID.
+func (s *Session) changeAnnotation(id ElementID, clientID string, isDelete bool, change func(annotation *Annotation)) (Element, error) {
+	current := s.Annotations[id]
+	if current == nil || current.Deleted {
+		return Element{}, NoAnnotationError(id.String())
+	}
+
+	annotation := *current
+	change(&annotation)
+
+	return s.annotate(annotation, s.newID(clientID), clientID, isDelete), nil
+}
+
+// Returns the position of a character among the visible characters of the
+// document, counting it if it is visible and inclusive is set, or -1 if the
+// document doesn't have it.
+func (s *Session) positionOf(id ElementID, inclusive bool) int {
+	run, k := s.find(id)
+	if run == nil {
+		return -1
+	}
+
+	position := s.ordered().offset(run)
+	if !run.Deleted {
+		position += k
+		if inclusive {
+			position++
+		}
+	}
+
+	return position
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Annotates the visible characters in positions [from, to) of a document with
+// text on behalf of clientID. Returns the annotation element so it can be
+// replicated. The new annotation's ID is the element's ID.
+func (s *Session) Annotate(document string, from, to int, text, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return Element{}, NoFileError(document)
+	}
+
+	doc := s.documentFor(document)
+	fromID, ok := doc.idAt(from)
+	toID, _ok := doc.idAt(to - 1)
+	if from < 0 || from >= to || !ok || !_ok {
+		return Element{}, InvalidRangeError(fmt.Sprintf("%d, %d", from, to))
+	}
+
+	id := s.newID(clientID)
+	annotation := Annotation{ID: id, Document: document, From: fromID, To: toID, Author: clientID, Text: text}
+
+	return s.annotate(annotation, id, clientID, false), nil
+}
+
+// Replaces the text of an annotation on behalf of clientID. Returns the
+// annotation element so it can be replicated.
+func (s *Session) EditAnnotation(id ElementID, text, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.changeAnnotation(id, clientID, false, func(annotation *Annotation) {
+		annotation.Text = text
+	})
+}
+
+// Marks an annotation resolved, or unresolved, on behalf of clientID. Returns
+// the annotation element so it can be replicated.
+func (s *Session) ResolveAnnotation(id ElementID, resolved bool, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.changeAnnotation(id, clientID, false, func(annotation *Annotation) {
+		annotation.Resolved = resolved
+	})
+}
+
+// Removes an annotation on behalf of clientID. Returns the annotation element
+// so it can be replicated.
+func (s *Session) DeleteAnnotation(id ElementID, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.changeAnnotation(id, clientID, true, func(annotation *Annotation) {})
+}
+
+// Returns the annotations of a document that haven't been removed, in order
+// of ID, with the positions of the characters they cover.
+func (s *Session) DocumentAnnotations(document string) ([]AnnotationRange, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	doc := s.documentFor(document)
+	ranges := make([]AnnotationRange, 0)
+	for _, annotation := range s.Annotations {
+		if annotation.Document != document || annotation.Deleted {
+			continue
+		}
+
+		_range := AnnotationRange{Annotation: *annotation, Start: doc.positionOf(annotation.From, false), End: doc.positionOf(annotation.To, true)}
+		if _range.Start < 0 || _range.End < 0 {
+			_range.Start, _range.End = -1, -1
+		}
+
+		ranges = append(ranges, _range)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].ID.Less(ranges[j].ID)
+	})
+
+	return ranges, nil
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,105 @@
+package session
+
+/*
+Blame attributes every character of a session to the client that inserted
+it, line by line. Tombstones that haven't been collected yet are included
+where they were in the message, along with the client that deleted them, so
+deleted text can be attributed too.
+
+Elements only record who inserted them. Who deleted a character is taken
+from the delete operations in the log, and kept in a map from character to
+client as deletes are logged so blame doesn't have to search the log. IDs are
+unique across documents, so one map covers every document.
+*/
+
+// A run of consecutive characters on a line with the same authorship.
+type BlameSpan struct {
+	Author    string // Client that inserted the text
+	Text      string
+	Deleted   bool
+	DeletedBy string `json:",omitempty"` // Client that deleted the text, if known
+}
+
+// The characters of one line of the message, including tombstones. Line is
+// the line number in the visible text, starting at 1.
+type BlameLine struct {
+	Line  int
+	Spans []BlameSpan
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Builds the map of deleted characters from the deletes in the log.
+func (s *Session) trackDeleters() {
+	s.deleters = make(map[ElementID]string)
+	for _, op := range s.Log {
+		if op.Element.Deleted && op.Element.isText() {
+			s.trackDeleter(op.Element)
+		}
+	}
+}
+
+// Records the client that deleted each character of a logged delete. The
+// first delete of a character is the one that counts.
+func (s *Session) trackDeleter(element Element) {
+	for _, char := range element.Chars() {
+		if _, ok := s.deleters[char.ID]; !ok {
+			s.deleters[char.ID] = element.ClientID
+		}
+	}
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Returns the authorship of every line of a document, in order. The main
+// document's ID is the empty string.
+func (s *Session) Blame(document string) ([]BlameLine, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	if s.deleters == nil {
+		s.trackDeleters()
+	}
+
+	lines := []BlameLine{{Line: 1, Spans: make([]BlameSpan, 0)}}
+	for _, element := range s.documentFor(document).chain() {
+		for _, char := range element.Chars() {
+			if char.Text == "" {
+				continue
+			}
+
+			span := BlameSpan{Author: char.ClientID, Text: char.Text, Deleted: char.Deleted}
+			if char.Deleted {
+				span.DeletedBy = s.deleters[char.ID]
+			}
+
+			line := &lines[len(lines)-1]
+			if n := len(line.Spans); n > 0 && line.Spans[n-1].Author == span.Author &&
+				line.Spans[n-1].Deleted == span.Deleted && line.Spans[n-1].DeletedBy == span.DeletedBy {
+				line.Spans[n-1].Text += span.Text
+			} else {
+				line.Spans = append(line.Spans, span)
+			}
+
+			if char.Text == "\n" && !char.Deleted {
+				lines = append(lines, BlameLine{Line: len(lines) + 1, Spans: make([]BlameSpan, 0)})
+			}
+		}
+	}
+
+	return lines, nil
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,272 @@
+package session
+
+/*
+Randomized convergence test.
+
+Every run simulates several clients editing the same session concurrently.
+In each round every client makes random inserts, deletes, undos and redos on
+its own replica, then the round's operations are exchanged between the clients
+in a random order, with some operations delivered twice. Once all rounds are done,
+observer replicas receive every operation of the run in a random order, one of
+them split into single characters the way browsers send them. Another replica
+catches up now and then during the run, and once more at the end, by merging
+deltas from the clients since the version it has reached so far.
+
+At the end every replica must have the same text, the same message (including
+tombstones) and nothing left buffered. The runs are seeded with fixed seeds, so
+a failing run can be reproduced with:
+
+	go test -run TestConvergence -v
+
+Longer runs with random seeds can be asked for with -convergence.runs, eg.
+
+	go test -run TestConvergence -convergence.runs 100000
+
+and print the seeds of the runs that fail.
+*/
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const CONVERGENCE_SESSION_ID string = "session-0"
+
+// Number of runs with fixed seeds for each configuration
+const CONVERGENCE_RUNS int = 100
+
+// Alphabet used for generated text, including multi-byte characters
+var CONVERGENCE_ALPHABET []rune = []rune("abcdefghijklmnopqrstuvwxyz\n\té")
+
+var randomRuns = flag.Int("convergence.runs", 0, "number of runs with random seeds, on top of the fixed ones")
+
+// The size of a simulation: how many clients edit, how many observers only
+// receive, and how many edits each client makes in how many rounds
+type convergenceConfig struct {
+	name      string
+	clients   int
+	observers int
+	rounds    int
+	ops       int
+}
+
+type replica struct {
+	name    string
+	session *Session
+	chars   bool
+}
+
+var convergenceConfigs = []convergenceConfig{
+	{"default", 3, 2, 6, 4},
+	{"two clients", 2, 1, 10, 6},
+	{"many clients", 6, 2, 4, 3},
+	{"long rounds", 3, 2, 3, 20},
+}
+
+func TestConvergence(t *testing.T) {
+	for _, config := range convergenceConfigs {
+		t.Run(config.name, func(t *testing.T) {
+			for seed := int64(1); seed <= int64(CONVERGENCE_RUNS); seed++ {
+				converge(t, config, seed)
+			}
+
+			if *randomRuns > 0 {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for i := 0; i < *randomRuns; i++ {
+					converge(t, config, r.Int63())
+				}
+			}
+		})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Runs a single simulation, failing the test if the replicas don't converge.
+func converge(t *testing.T, config convergenceConfig, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+
+	clients := make([]*replica, config.clients)
+	for i := range clients {
+		clients[i] = newReplica("client-"+strconv.Itoa(i), false)
+	}
+
+	observers := make([]*replica, config.observers)
+	for i := range observers {
+		observers[i] = newReplica("observer-"+strconv.Itoa(i), i == 0)
+	}
+
+	merged := newReplica("delta", false)
+
+	log := make([]Element, 0)
+	for round := 0; round < config.rounds; round++ {
+		ops := make([][]Element, len(clients))
+		for i, client := range clients {
+			for k := 0; k < config.ops; k++ {
+				ops[i] = append(ops[i], randomEdit(r, client)...)
+			}
+			log = append(log, ops[i]...)
+		}
+
+		for i, client := range clients {
+			received := make([]Element, 0)
+			for j := range clients {
+				if i != j {
+					received = append(received, ops[j]...)
+				}
+			}
+			deliver(r, client, received)
+		}
+
+		// Catch up with one client in the middle of the run
+		if i := r.Intn(len(clients) + 1); i < len(clients) {
+			merged.session.Merge(clients[i].session.DeltaSince(merged.session.Version()))
+		}
+	}
+
+	for _, observer := range observers {
+		deliver(r, observer, log)
+	}
+
+	for _, i := range r.Perm(len(clients)) {
+		merged.session.Merge(clients[i].session.DeltaSince(merged.session.Version()))
+	}
+
+	replicas := append(append(clients, observers...), merged)
+	if !converged(t, seed, replicas) {
+		for _, element := range log {
+			t.Logf("  %s", describe(element))
+		}
+	}
+}
+
+func newReplica(name string, chars bool) *replica {
+	return &replica{
+		name:    name,
+		session: &Session{ID: CONVERGENCE_SESSION_ID, CRDT: make(map[ElementID]*Element)},
+		chars:   chars}
+}
+
+// Makes a random insert, delete, undo or redo on the client's replica,
+// returning the elements to send to the other replicas.
+func randomEdit(r *rand.Rand, client *replica) []Element {
+	session := client.session
+	length := session.Len()
+
+	switch r.Intn(10) {
+	case 0:
+		return session.Undo(client.name)
+	case 1:
+		return session.Redo(client.name)
+	}
+
+	if length == 0 || r.Intn(3) > 0 {
+		text := make([]rune, 1+r.Intn(4))
+		for i := range text {
+			text[i] = CONVERGENCE_ALPHABET[r.Intn(len(CONVERGENCE_ALPHABET))]
+		}
+
+		return session.Insert(r.Intn(length+1), string(text), client.name)
+	}
+
+	return session.DeleteRange(r.Intn(length), 1+r.Intn(3), client.name)
+}
+
+// Delivers the elements to the replica in a random order. About one in five
+// elements is delivered a second time.
+func deliver(r *rand.Rand, replica *replica, elements []Element) {
+	queue := make([]Element, 0, len(elements))
+	for _, element := range elements {
+		if replica.chars {
+			queue = append(queue, element.Chars()...)
+		} else {
+			queue = append(queue, element)
+		}
+	}
+
+	numQueued := len(queue)
+	for i := 0; i < numQueued; i++ {
+		if r.Intn(5) == 0 {
+			queue = append(queue, queue[i])
+		}
+	}
+
+	r.Shuffle(len(queue), func(i, j int) {
+		queue[i], queue[j] = queue[j], queue[i]
+	})
+
+	for _, element := range queue {
+		if element.Deleted {
+			replica.session.Delete(element)
+		} else {
+			replica.session.Add(element)
+		}
+	}
+}
+
+// Checks that every replica has the same text and message as the first one,
+// and that none of them is still waiting on an operation.
+func converged(t *testing.T, seed int64, replicas []*replica) bool {
+	ok := true
+
+	expectedText := replicas[0].session.Text()
+	expectedMessage := message(replicas[0].session)
+	for _, replica := range replicas {
+		if pending := replica.session.PendingElements(); len(pending) > 0 {
+			t.Errorf("seed %d: %s has %d pending elements", seed, replica.name, len(pending))
+			ok = false
+		}
+
+		if text := replica.session.Text(); text != expectedText {
+			t.Errorf("seed %d: %s has text %q, %s has %q", seed, replica.name, text, replicas[0].name, expectedText)
+			ok = false
+		} else if _message := message(replica.session); _message != expectedMessage {
+			t.Errorf("seed %d: %s has message\n  %s\n%s has\n  %s", seed, replica.name, _message, replicas[0].name, expectedMessage)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// Lists every character in the message, including tombstones, in order. Runs
+// are split into characters since replicas may store them differently.
+func message(session *Session) string {
+	str := ""
+
+	steps := 0
+	element := session.CRDT[session.Head]
+	for element != nil && steps <= len(session.CRDT) {
+		for _, char := range element.Chars() {
+			str += char.ID.String()
+			if char.Deleted {
+				str += "(deleted)"
+			}
+			str += " "
+		}
+
+		element = session.CRDT[element.NextID]
+		steps++
+	}
+
+	if steps > len(session.CRDT) {
+		str += "... (cycle)"
+	}
+
+	return str
+}
+
+func describe(element Element) string {
+	if element.Deleted {
+		return "delete " + element.ID.String() + " x" + strconv.Itoa(len(element.Chars()))
+	}
+
+	return "insert " + element.ID.String() + " after " + element.PrevID.String() + " " + strconv.Quote(element.Text)
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,133 @@
+package session
+
+/*
+Replicas that already share most of a session only need to exchange the
+operations the other side is missing. A replica sends its version vector,
+the other replica answers with the operations in its log that aren't included
+in it (see DeltaSince), and the first replica merges them (see Merge).
+
+Consecutive inserts share a log entry, so a delta can include an insert whose
+first characters the receiver already has. Merge only inserts the rest, which
+keeps the clock of the insert's last character and so the clocks of the rest.
+
+Operations compacted out of the log (see compactLog) can't be sent, so a delta
+is only since a version that includes them, and a replica missing them has to
+load the whole session instead.
+*/
+
+// The operations of a session that aren't included in the version Since.
+// Version is the version of the session the delta was taken from, which the
+// receiver has once the delta is merged, as long as it has every operation
+// included in Since.
+type Delta struct {
+	SessionID  string
+	Since      VersionVector
+	Version    VersionVector
+	Operations []Operation
+}
+
+// Whether the vector includes every operation included in other.
+func (v VersionVector) Covers(other VersionVector) bool {
+	for replica, ranges := range other {
+		for _, clocks := range ranges {
+			if !v.covers(replica, clocks) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the part of an insert made of the characters the session doesn't
+// have yet, and whether there is any. Characters it collected don't count.
+func (s *Session) missing(element Element) (Element, bool) {
+	k := 0
+	for k < element.span() {
+		id := ElementID{Counter: element.ID.Counter + k, Replica: element.ID.Replica}
+		if !s.exists(id) && s.collectedFrom(id) == 0 {
+			break
+		}
+		k++
+	}
+
+	if k == element.span() {
+		return element, false
+	} else if k > 0 {
+		rest := element.charAt(k)
+		rest.Text = string([]rune(element.Text)[k:])
+		rest.NextID = ElementID{}
+		element = rest
+	}
+
+	return element, true
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Returns the operations the session has applied that aren't wholly included
+// in the given version, in the order they were applied. The delta is since
+// the given version and the operations compacted out of the log.
+func (s *Session) DeltaSince(since VersionVector) Delta {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	delta := Delta{
+		SessionID:  s.ID,
+		Since:      since.union(s.Compacted),
+		Version:    s.version(),
+		Operations: make([]Operation, 0)}
+
+	for _, op := range s.Log {
+		if !since.includes(op.Element) {
+			delta.Operations = append(delta.Operations, op)
+		}
+	}
+
+	return delta
+}
+
+// Applies the operations of a delta the session doesn't have yet. Operations
+// whose dependencies are missing are buffered, like any other. The delta can
+// come from another session with the same history, eg. a fork (see Fork), so
+// its elements are moved to this session. Nothing is applied unless the
+// session has every operation included in the delta's Since, since the
+// delta doesn't hold them. Returns every element that was applied, in causal
+// order.
+func (s *Session) Merge(delta Delta) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	applied := make([]Element, 0)
+	if !s.version().Covers(delta.Since) {
+		return applied
+	}
+
+	for _, op := range delta.Operations {
+		element := op.Element
+		element.SessionID = s.ID
+		if !element.Deleted && element.isText() {
+			var ok bool
+			if element, ok = s.documentFor(element.Document).missing(element); !ok {
+				s.logOnce(element)
+				continue
+			}
+		}
+
+		applied = append(applied, s.apply(element, element.Deleted)...)
+	}
+
+	return applied
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,322 @@
+package session
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+A session holds a set of files, each its own document with its own CRDT. The
+session's own CRDT is the main document, which every session has, and other
+documents are kept in Documents by document ID. Elements name the document
+they belong to, and an element without one belongs to the main document, so
+sessions and browsers that only know about a single document keep working.
+
+Files are named by file elements: an element with File set names the document
+in its Document field with its Text, or removes the file if it is deleted.
+Creating, renaming and deleting a file each apply a new file element, and the
+one with the greatest ID wins. Since IDs are Lamport timestamps, a rename
+always wins over the create or rename it was made after.
+
+Document IDs are the ID of the file element that created the document, so
+they never change when a file is renamed. Elements of a document can arrive
+before the file element that created it, in which case the document exists
+without a name until it does.
+
+Every document shares the session's clock and log, so versions, deltas and
+snapshots of a session cover all of its files.
+*/
+
+// Name of the main document, unless it has been renamed
+const MAIN_FILE string = "main.go"
+
+// The name of a document, as last set by the file element with ID
+type File struct {
+	Name    string
+	Deleted bool
+	ID      ElementID
+}
+
+type InvalidFileNameError string
+
+func (e InvalidFileNameError) Error() string {
+	return fmt.Sprintf("Invalid file name [%s]", string(e))
+}
+
+type FileExistsError string
+
+func (e FileExistsError) Error() string {
+	return fmt.Sprintf("File [%s] already exists", string(e))
+}
+
+type NoFileError string
+
+func (e NoFileError) Error() string {
+	return fmt.Sprintf("No file with document ID [%s]", string(e))
+}
+
+type MainFileError string
+
+func (e MainFileError) Error() string {
+	return fmt.Sprintf("Main file [%s] can't be deleted", string(e))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the session that holds the clock and log of this document.
+func (s *Session) root() *Session {
+	if s.parent != nil {
+		return s.parent
+	}
+
+	return s
+}
+
+// Returns the document with the given ID, creating it if it doesn't exist.
+// The empty ID is the main document, ie. the session itself.
+func (s *Session) documentFor(id string) *Session {
+	if id == "" {
+		return s
+	}
+
+	if s.Documents == nil {
+		s.Documents = make(map[string]*Session)
+	}
+
+	document := s.Documents[id]
+	if document == nil {
+		document = &Session{ID: s.ID, CRDT: make(map[ElementID]*Element)}
+		s.Documents[id] = document
+	}
+
+	// Links aren't persisted, so they are set again on every lookup
+	document.parent = s
+	document.document = id
+
+	return document
+}
+
+// Applies a file element if it is newer than the one that last named its
+// document. Returns the element if it was applied.
+func (s *Session) applyFile(element Element) []Element {
+	file := s.Files[element.Document]
+	if file != nil && file.ID == element.ID {
+		s.logOnce(element)
+		return nil
+	}
+
+	s.stamp(&element)
+	s.logOnce(element)
+	if file != nil && element.ID.Less(file.ID) {
+		return nil
+	}
+
+	if s.Files == nil {
+		s.Files = make(map[string]*File)
+	}
+	s.Files[element.Document] = &File{Name: element.Text, Deleted: element.Deleted, ID: element.ID}
+
+	return []Element{element}
+}
+
+// Returns the name of every file that hasn't been deleted, by document ID.
+func (s *Session) fileNames() map[string]string {
+	names := map[string]string{"": MAIN_FILE}
+	for id, file := range s.Files {
+		if file.Deleted && id != "" {
+			delete(names, id)
+		} else {
+			names[id] = file.Name
+		}
+	}
+
+	return names
+}
+
+// Whether a file can be given the name: a clean, relative path inside the
+// session's tree. Named snapshots of a session follow the same rule.
+func ValidFileName(name string) bool {
+	return name == path.Clean(name) && !path.IsAbs(name) && name != "." && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// Applies a file element with the given ID for a document on behalf of
+// clientID, naming the document or deleting its file if isDelete.
+func (s *Session) nameFile(document string, id ElementID, name, clientID string, isDelete bool) (Element, error) {
+	if isDelete && document == "" {
+		return Element{}, MainFileError(name)
+	} else if !isDelete {
+		if !ValidFileName(name) {
+			return Element{}, InvalidFileNameError(name)
+		}
+
+		for _id, _name := range s.fileNames() {
+			if _name == name && _id != document {
+				return Element{}, FileExistsError(name)
+			}
+		}
+	}
+
+	element := Element{
+		SessionID: s.ID,
+		ClientID:  clientID,
+		ID:        id,
+		Document:  document,
+		Text:      name,
+		Deleted:   isDelete,
+		File:      true}
+
+	s.applyFile(element)
+	return element, nil
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Creates a file with the given name on behalf of clientID. Returns the file
+// element so it can be replicated. Its Document is the new document's ID.
+func (s *Session) CreateFile(name, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	id := s.newID(clientID)
+	return s.nameFile(id.String(), id, name, clientID, false)
+}
+
+// Renames the file of a document on behalf of clientID. Returns the file
+// element so it can be replicated.
+func (s *Session) RenameFile(document, name, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return Element{}, NoFileError(document)
+	}
+
+	return s.nameFile(document, s.newID(clientID), name, clientID, false)
+}
+
+// Deletes the file of a document on behalf of clientID. The document's
+// elements are kept, so a concurrent rename can bring the file back. Returns
+// the file element so it can be replicated.
+func (s *Session) DeleteFile(document, clientID string) (Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	name, ok := s.fileNames()[document]
+	if !ok {
+		return Element{}, NoFileError(document)
+	}
+
+	return s.nameFile(document, s.newID(clientID), name, clientID, true)
+}
+
+// Returns the name of every file in the session, by document ID. The main
+// document's ID is the empty string.
+func (s *Session) FileNames() map[string]string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.fileNames()
+}
+
+// Returns the contents of a document, skipping deleted elements.
+func (s *Session) DocumentText(document string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return "", NoFileError(document)
+	}
+
+	return s.documentFor(document).text(), nil
+}
+
+// Inserts text at the given offset of a document on behalf of clientID, see
+// Insert. Returns the elements that were applied so they can be replicated.
+func (s *Session) DocumentInsert(document string, offset int, text, clientID string) ([]Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	return s.documentFor(document).insertAt(offset, text, clientID), nil
+}
+
+// Deletes length visible characters starting at the given offset of a
+// document on behalf of clientID, see DeleteRange. Returns the elements that
+// were applied so they can be replicated.
+func (s *Session) DocumentDeleteRange(document string, offset, length int, clientID string) ([]Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	return s.documentFor(document).deleteRange(offset, length, clientID), nil
+}
+
+// Undoes the most recent edit of clientID in a document, see Undo. Each
+// document keeps its own history.
+func (s *Session) DocumentUndo(document, clientID string) ([]Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	return s.documentFor(document).undo(clientID), nil
+}
+
+// Redoes the most recently undone edit of clientID in a document, see Redo.
+func (s *Session) DocumentRedo(document, clientID string) ([]Element, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.fileNames()[document]; !ok {
+		return nil, NoFileError(document)
+	}
+
+	return s.documentFor(document).redo(clientID), nil
+}
+
+// Returns the contents of every file in the session, by file name. Files
+// given the same name concurrently are told apart by prefixing all but the
+// first of them, in order of document ID, with their document ID.
+func (s *Session) Tree() map[string]string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	names := s.fileNames()
+	ids := make([]string, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tree := make(map[string]string, len(names))
+	for _, id := range ids {
+		name := names[id]
+		if _, exists := tree[name]; exists {
+			name = path.Join(path.Dir(name), id+"_"+path.Base(name))
+		}
+
+		tree[name] = s.documentFor(id).text()
+	}
+
+	return tree
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
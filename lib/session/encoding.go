@@ -0,0 +1,139 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Sessions saved before structured element IDs were introduced used plain
+// strings for every ID. These types mirror that layout so old gob files can
+// still be decoded.
+type legacySession struct {
+	ID   string
+	CRDT map[string]*legacyElement
+	Head string
+	Next int
+}
+
+type legacyElement struct {
+	SessionID string
+	ClientID  string
+	ID        string
+	PrevID    string
+	NextID    string
+	Text      string
+	Deleted   bool
+
+	Timestamp int64
+}
+
+// Gob encodes a session for persistence.
+func EncodeSession(session *Session) ([]byte, error) {
+	session.mux.RLock()
+	defer session.mux.RUnlock()
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(session)
+
+	return buffer.Bytes(), err
+}
+
+// Decodes a gob encoded session. Sessions persisted with string IDs are
+// migrated to structured IDs, preserving the order of the message. Sessions
+// persisted without a log get one that rebuilds their current state.
+func DecodeSession(data []byte) (*Session, error) {
+	session := new(Session)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(session)
+	if err != nil {
+		legacy := new(legacySession)
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(legacy) != nil {
+			return nil, err
+		}
+
+		session = legacy.migrate()
+	}
+
+	session.trackTombstones()
+	session.startLog()
+
+	return session, nil
+}
+
+// Browsers keep one element per character, so runs are split into their
+// characters when a session is sent as JSON. The session's version is sent
+// along, so browsers can ask for just what they missed when they reconnect.
+// Documents other than the main one are sent the same way, along with the
+// file of every document, so browsers can tell which file elements are newer.
+func (s *Session) MarshalJSON() ([]byte, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	type document struct {
+		CRDT map[ElementID]*Element
+		Head ElementID
+	}
+
+	documents := make(map[string]document, len(s.Documents))
+	for id, _document := range s.Documents {
+		documents[id] = document{_document.charCRDT(), _document.Head}
+	}
+
+	files := map[string]*File{"": {Name: MAIN_FILE}}
+	for id, file := range s.Files {
+		files[id] = file
+	}
+
+	return json.Marshal(struct {
+		ID        string
+		CRDT      map[ElementID]*Element
+		Head      ElementID
+		Next      int
+		Version   VersionVector
+		Documents map[string]document
+		Files     map[string]*File
+	}{s.ID, s.charCRDT(), s.Head, s.Next, s.version(), documents, files})
+}
+
+// Returns the CRDT with every run split into its characters.
+func (s *Session) charCRDT() map[ElementID]*Element {
+	crdt := make(map[ElementID]*Element, len(s.CRDT))
+	for _, element := range s.CRDT {
+		for _, char := range element.Chars() {
+			_char := char
+			crdt[char.ID] = &_char
+		}
+	}
+
+	return crdt
+}
+
+func (l *legacySession) migrate() *Session {
+	session := &Session{
+		ID:   l.ID,
+		CRDT: make(map[ElementID]*Element),
+		Head: ParseElementID(l.Head)}
+
+	for _, _element := range l.CRDT {
+		element := &Element{
+			SessionID: _element.SessionID,
+			ClientID:  _element.ClientID,
+			ID:        ParseElementID(_element.ID),
+			PrevID:    ParseElementID(_element.PrevID),
+			NextID:    ParseElementID(_element.NextID),
+			Text:      _element.Text,
+			Deleted:   _element.Deleted,
+			Timestamp: _element.Timestamp}
+
+		session.CRDT[element.ID] = element
+		if element.ID.Counter >= session.Next {
+			session.Next = element.ID.Counter + 1
+		}
+	}
+
+	if l.Next > session.Next {
+		session.Next = l.Next
+	}
+
+	return session
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestDecodeLegacySession(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		next     int
+		elements []legacyElement // In the order of the message
+		text     string
+		wantNext int
+	}{
+		{"empty", "", 0, nil, "", 0},
+		{"counter IDs", "1_a", 4, []legacyElement{
+			{ID: "1_a", Text: "x"},
+			{ID: "2_b", Text: "y"},
+			{ID: "3_a", Text: "z"},
+		}, "xyz", 4},
+		{"next below the counters", "1_a", 0, []legacyElement{
+			{ID: "1_a", Text: "x"},
+			{ID: "7_b", Text: "y"},
+		}, "xy", 8},
+		{"next above the counters", "1_a", 20, []legacyElement{
+			{ID: "1_a", Text: "x"},
+		}, "x", 20},
+		{"plain string IDs", "first", 0, []legacyElement{
+			{ID: "first", Text: "a"},
+			{ID: "second", Text: "b"},
+			{ID: "3_c", Text: "c"},
+		}, "abc", 4},
+		{"deleted", "1_a", 4, []legacyElement{
+			{ID: "1_a", Text: "x"},
+			{ID: "2_a", Text: "y", Deleted: true},
+			{ID: "3_a", Text: "z"},
+		}, "xz", 4},
+	}
+
+	for _, test := range tests {
+		data := encodeLegacy(t, test.head, test.next, test.elements)
+
+		session, err := DecodeSession(data)
+		if err != nil {
+			t.Fatalf("%s: DecodeSession: %v", test.name, err)
+		}
+		if session.ID != "s" {
+			t.Errorf("%s: ID = %q, want %q", test.name, session.ID, "s")
+		}
+		if text := session.Text(); text != test.text {
+			t.Errorf("%s: text = %q, want %q", test.name, text, test.text)
+		}
+		if session.Next != test.wantNext {
+			t.Errorf("%s: Next = %d, want %d", test.name, session.Next, test.wantNext)
+		}
+		for _, _element := range test.elements {
+			id := ParseElementID(_element.ID)
+			if element := session.CRDT[id]; element == nil || element.ID.String() != _element.ID {
+				t.Errorf("%s: element %q not migrated", test.name, _element.ID)
+			}
+		}
+
+		// The migrated session is edited and saved like any other, in the
+		// current format
+		session.Insert(session.Len(), "!", "client")
+		data, err = EncodeSession(session)
+		if err != nil {
+			t.Fatalf("%s: EncodeSession: %v", test.name, err)
+		}
+		decoded, err := DecodeSession(data)
+		if err != nil {
+			t.Fatalf("%s: DecodeSession of the migrated session: %v", test.name, err)
+		}
+		if text := decoded.Text(); text != test.text+"!" {
+			t.Errorf("%s: text after editing = %q, want %q", test.name, text, test.text+"!")
+		}
+		if !decoded.Version().Covers(session.Version()) {
+			t.Errorf("%s: version %v after decoding, want %v", test.name, decoded.Version(), session.Version())
+		}
+	}
+}
+
+func TestDecodeSessionInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"garbage", []byte("not a session")},
+	}
+
+	for _, test := range tests {
+		if session, err := DecodeSession(test.data); err == nil {
+			t.Errorf("%s: DecodeSession = %v, want an error", test.name, session)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Gob encodes a session with string IDs, as sessions were saved before
+// structured IDs. The elements are linked in the order given.
+func encodeLegacy(t *testing.T, head string, next int, elements []legacyElement) []byte {
+	legacy := legacySession{ID: "s", CRDT: make(map[string]*legacyElement), Head: head, Next: next}
+	for i := range elements {
+		element := elements[i]
+		element.SessionID = "s"
+		if i > 0 {
+			element.PrevID = elements[i-1].ID
+		}
+		if i < len(elements)-1 {
+			element.NextID = elements[i+1].ID
+		}
+		legacy.CRDT[element.ID] = &element
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,89 @@
+package session
+
+/*
+A fork is a copy of a session under a new session ID that keeps the IDs of
+every element and the log of every operation. Edits made to the fork after
+that are logged like edits to any other session, so they can be folded back
+into the original, or into any other session sharing its history, by merging
+the fork's delta since the target's version:
+
+	target.Merge(fork.DeltaSince(target.Version()))
+*/
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns a copy of the message under a new session ID.
+func (s *Session) copyAs(id string) *Session {
+	copied := &Session{
+		ID:   id,
+		CRDT: make(map[ElementID]*Element, len(s.CRDT)),
+		Head: s.Head,
+		Next: s.Next}
+
+	for elementID, element := range s.CRDT {
+		_element := *element
+		_element.SessionID = id
+		copied.CRDT[elementID] = &_element
+	}
+
+	copied.trackTombstones()
+
+	return copied
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Returns a copy of the session, and every one of its files and annotations,
+// under a new session ID. Buffered operations and undo histories aren't copied.
+func (s *Session) Fork(id string) *Session {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	fork := s.copyAs(id)
+	fork.Compacted = s.Compacted.Copy()
+	fork.Log = make([]Operation, len(s.Log))
+	for i, op := range s.Log {
+		op.Element.SessionID = id
+		fork.Log[i] = op
+	}
+
+	for documentID, file := range s.Files {
+		if fork.Files == nil {
+			fork.Files = make(map[string]*File)
+		}
+
+		copied := *file
+		fork.Files[documentID] = &copied
+	}
+
+	for annotationID, annotation := range s.Annotations {
+		if fork.Annotations == nil {
+			fork.Annotations = make(map[ElementID]*Annotation)
+		}
+
+		copied := *annotation
+		fork.Annotations[annotationID] = &copied
+	}
+
+	for documentID, document := range s.Documents {
+		if fork.Documents == nil {
+			fork.Documents = make(map[string]*Session)
+		}
+
+		document.mux.RLock()
+		fork.Documents[documentID] = document.copyAs(id)
+		document.mux.RUnlock()
+	}
+
+	return fork
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
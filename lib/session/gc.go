@@ -0,0 +1,294 @@
+package session
+
+// Replica ID used to acknowledge deletes on behalf of the file system copy
+// of a session.
+const FS_REPLICA string = "fs"
+
+// A run of characters collected from a session, and the character before it
+// when it was collected, where inserts after the run go (see anchor).
+type collectedRun struct {
+	span   int
+	prevID ElementID
+}
+
+// Returns the IDs of all tombstones that have not been collected yet, in
+// every document of the session. IDs are unique across documents.
+func (s *Session) TombstoneIDs() []ElementID {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	ids := make([]ElementID, 0, len(s.Acks))
+	for id := range s.Acks {
+		ids = append(ids, id)
+	}
+
+	for _, document := range s.Documents {
+		ids = append(ids, document.TombstoneIDs()...)
+	}
+
+	return ids
+}
+
+// Records that replicaID has applied the deletes of the given characters.
+// IDs that aren't part of a tombstone in this session are ignored.
+func (s *Session) AckDeletes(replicaID string, ids []ElementID) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, id := range ids {
+		s.ack(replicaID, id)
+	}
+
+	for _, document := range s.Documents {
+		document.AckDeletes(replicaID, ids)
+	}
+}
+
+// Records that replicaID has applied every operation included in version, the
+// version of the session it reported, and so every delete among them.
+func (s *Session) AckVersion(replicaID string, version VersionVector) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.acked == nil {
+		s.acked = make(map[string]VersionVector)
+	}
+	s.acked[replicaID] = version.Copy()
+
+	if s.deletes == nil {
+		s.trackDeletes()
+	}
+	for _, element := range s.deletes {
+		if !version.includes(element) {
+			continue
+		}
+
+		document := s.documentFor(element.Document)
+		for _, char := range element.Chars() {
+			document.ack(replicaID, char.ID)
+		}
+	}
+}
+
+// Returns the operations the session has applied that every given replica
+// has acknowledged applying too, see AckVersion. A replica that hasn't
+// acknowledged a version isn't known to have applied any.
+func (s *Session) StableVersion(replicas []string) VersionVector {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.stableVersion(replicas)
+}
+
+func (s *Session) stableVersion(replicas []string) VersionVector {
+	stable := s.version()
+	for _, replica := range replicas {
+		stable = stable.intersect(s.acked[replica])
+	}
+
+	return stable
+}
+
+/*
+Removes every tombstone whose delete has been acknowledged by all of the given
+replicas. The removed element is unlinked from the message and its neighbours
+are joined together, so the text is unchanged. Returns the collected IDs.
+
+A tombstone is only safe to collect once no replica can still send an insert
+that refers to it, so replicas should include every replica hosting the
+session, browsers included. A replica doesn't refer to characters it has seen
+deleted, but it can have referred to them before, so nothing is collected
+until the session has applied every operation the replicas acknowledged with
+their version (see AckVersion) as well.
+
+An insert that still refers to a collected character, eg. from a replica that
+wasn't known when it was collected, goes after the character that was before
+the character's run when it was collected. An insert or delete of a collected
+character is one the session already applied. The session remembers the
+characters it collected until it is loaded again.
+
+Once every replica has applied the operations on the collected characters,
+they are dropped from the log too, see compactLog.
+*/
+func (s *Session) Collect(replicas []string) []ElementID {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	collected := make([]ElementID, 0)
+	version := s.version()
+	for _, replica := range replicas {
+		if acked, ok := s.acked[replica]; ok && !version.Covers(acked) {
+			return collected
+		}
+	}
+
+	for id, acks := range s.Acks {
+		stable := true
+		for _, replica := range replicas {
+			if !acks[replica] {
+				stable = false
+				break
+			}
+		}
+
+		if stable {
+			s.unlink(id)
+			collected = append(collected, id)
+		}
+	}
+
+	for _, document := range s.Documents {
+		collected = append(collected, document.Collect(replicas)...)
+	}
+
+	if s.parent == nil {
+		s.compactLog(s.stableVersion(replicas))
+		s.untrackDeletes()
+	}
+
+	return collected
+}
+
+// Removes an element from the CRDT, joining its previous and next elements.
+func (s *Session) unlink(id ElementID) {
+	element := s.CRDT[id]
+	delete(s.Acks, id)
+	if element == nil {
+		return
+	}
+
+	if s.collected == nil {
+		s.collected = make(map[ElementID]collectedRun)
+	}
+	s.collected[id] = collectedRun{element.span(), element.PrevID}
+
+	if prevElement, _ := s.find(element.PrevID); prevElement != nil {
+		prevElement.NextID = element.NextID
+	} else if s.Head == id {
+		s.Head = element.NextID
+	}
+
+	if nextElement := s.CRDT[element.NextID]; nextElement != nil {
+		nextElement.PrevID = element.PrevID
+	}
+
+	s.ordered().remove(element)
+	delete(s.CRDT, id)
+}
+
+// Records that replicaID has applied the delete of a character, if it is part
+// of a tombstone.
+func (s *Session) ack(replicaID string, id ElementID) {
+	element, _ := s.find(id)
+	if element == nil {
+		return
+	}
+
+	if acks, ok := s.Acks[element.ID]; ok {
+		acks[replicaID] = true
+	}
+}
+
+// Returns the collected run holding a character and the character's offset
+// in it, if the character was collected.
+func (s *Session) collectedRun(id ElementID) (collectedRun, int, bool) {
+	if len(s.collected) == 0 {
+		return collectedRun{}, 0, false
+	}
+
+	for counter := id.Counter; counter >= 0 && id.Counter-counter < MAX_RUN; counter-- {
+		if run, ok := s.collected[ElementID{Counter: counter, Replica: id.Replica}]; ok {
+			// Runs from the same replica never overlap, so the closest
+			// collected run before the ID is the only one that could hold it
+			offset := id.Counter - counter
+			return run, offset, offset < run.span
+		}
+	}
+
+	return collectedRun{}, 0, false
+}
+
+// Returns how many characters from id to the end of its run have been
+// collected, or 0 if the character wasn't collected.
+func (s *Session) collectedFrom(id ElementID) int {
+	if run, offset, ok := s.collectedRun(id); ok {
+		return run.span - offset
+	}
+
+	return 0
+}
+
+// Returns the character an insert after id goes after: id itself, or if it
+// was collected, the character that was before its run then, or failing that
+// the zero ID for the start of the message.
+func (s *Session) anchor(id ElementID) ElementID {
+	for !id.IsZero() && !s.exists(id) {
+		run, _, ok := s.collectedRun(id)
+		if !ok {
+			break
+		}
+		id = run.prevID
+	}
+
+	return id
+}
+
+// Builds the list of deletes of characters that haven't all been collected
+// from the deletes in the log.
+func (s *Session) trackDeletes() {
+	s.deletes = make([]Element, 0)
+	for _, op := range s.Log {
+		if op.Element.Deleted && op.Element.isText() && !s.collectedDelete(op.Element) {
+			s.deletes = append(s.deletes, op.Element)
+		}
+	}
+}
+
+// Drops the deletes whose characters have all been collected from the list,
+// as there is nothing left for replicas to acknowledge.
+func (s *Session) untrackDeletes() {
+	deletes := s.deletes[:0]
+	for _, element := range s.deletes {
+		if !s.collectedDelete(element) {
+			deletes = append(deletes, element)
+		}
+	}
+
+	for i := len(deletes); i < len(s.deletes); i++ {
+		s.deletes[i] = Element{}
+	}
+	s.deletes = deletes
+}
+
+// Whether every character of a logged delete has been collected.
+func (s *Session) collectedDelete(element Element) bool {
+	document := s.documentFor(element.Document)
+	for _, char := range element.Chars() {
+		if document.collectedFrom(char.ID) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Starts tracking acknowledgements for deleted elements that have none, eg.
+// sessions persisted before tombstones were collected.
+func (s *Session) trackTombstones() {
+	for _, document := range s.Documents {
+		document.trackTombstones()
+	}
+
+	for id, element := range s.CRDT {
+		if !element.Deleted {
+			continue
+		}
+
+		if s.Acks == nil {
+			s.Acks = make(map[ElementID]map[string]bool)
+		}
+		if s.Acks[id] == nil {
+			s.Acks[id] = make(map[string]bool)
+		}
+	}
+}
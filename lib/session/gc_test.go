@@ -0,0 +1,63 @@
+package session
+
+import (
+	"testing"
+)
+
+func TestAckVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		ackFirst  []string // Replicas that ack the version after the first delete
+		ackSecond []string // Replicas that ack the version after the second delete
+		collected int      // Characters collected
+		deletes   int      // Deletes still tracked after collecting
+	}{
+		{"another replica", nil, []string{"c"}, 0, 2},
+		{"one replica", nil, []string{"a"}, 0, 2},
+		{"first delete", []string{"a", "b"}, nil, 2, 1},
+		{"first delete, then one replica", []string{"a", "b"}, []string{"b"}, 2, 1},
+		{"both deletes", nil, []string{"a", "b"}, 3, 0},
+		{"both deletes in turn", []string{"a", "b"}, []string{"a", "b"}, 3, 0},
+	}
+
+	for _, test := range tests {
+		s := &Session{ID: "s", CRDT: make(map[ElementID]*Element)}
+		s.SetReplica("r")
+		s.Insert(0, "abcdef", "client")
+
+		s.DeleteRange(1, 2, "client")
+		for _, replica := range test.ackFirst {
+			s.AckVersion(replica, s.Version())
+		}
+		s.DeleteRange(2, 1, "client")
+		for _, replica := range test.ackSecond {
+			s.AckVersion(replica, s.Version())
+		}
+
+		collected := 0
+		for _, id := range s.Collect([]string{"a", "b"}) {
+			collected += s.collectedFrom(id)
+		}
+		if collected != test.collected {
+			t.Errorf("%s: %d characters collected, want %d", test.name, collected, test.collected)
+		}
+		if text := s.Text(); text != "adf" {
+			t.Errorf("%s: text = %q after collecting, want %q", test.name, text, "adf")
+		}
+		if len(s.deletes) != test.deletes {
+			t.Errorf("%s: %d deletes tracked, want %d", test.name, len(s.deletes), test.deletes)
+		}
+
+		// A delete after collecting is tracked, and collected once acked
+		s.DeleteRange(0, 1, "client")
+		s.AckVersion("a", s.Version())
+		s.AckVersion("b", s.Version())
+		s.Collect([]string{"a", "b"})
+		if text := s.Text(); text != "df" {
+			t.Errorf("%s: text = %q after collecting again, want %q", test.name, text, "df")
+		}
+		if len(s.deletes) != 0 || len(s.TombstoneIDs()) != 0 {
+			t.Errorf("%s: deletes %v and tombstones %v left after every replica acked", test.name, s.deletes, s.TombstoneIDs())
+		}
+	}
+}
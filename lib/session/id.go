@@ -0,0 +1,80 @@
+package session
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Counter used for IDs that were created before structured IDs existed and
+// don't follow the "<counter>_<replica>" format. Legacy IDs sort before every
+// structured ID and keep their original string as the replica.
+const LEGACY_COUNTER int = -1
+
+// An ElementID identifies an element by the Lamport counter it was created
+// at and the replica that created it: the client, or the worker that made it
+// on the client's behalf (see SetReplica). No two replicas share a replica ID
+// and a replica never reuses a counter, so IDs never collide.
+//
+// IDs are totally ordered by counter, then by replica. On the wire (JSON) an
+// ID is the string "<counter>_<replica>", the format the browser generates,
+// and the zero ID is the empty string.
+type ElementID struct {
+	Counter int
+	Replica string
+}
+
+// Parses an ID in the "<counter>_<replica>" format. Strings that don't match
+// the format are kept as legacy IDs rather than rejected.
+func ParseElementID(s string) ElementID {
+	if s == "" {
+		return ElementID{}
+	}
+
+	if i := strings.Index(s, "_"); i > 0 {
+		if counter, err := strconv.Atoi(s[:i]); err == nil && counter >= 0 {
+			return ElementID{Counter: counter, Replica: s[i+1:]}
+		}
+	}
+
+	return ElementID{Counter: LEGACY_COUNTER, Replica: s}
+}
+
+func (id ElementID) IsZero() bool {
+	return id == ElementID{}
+}
+
+func (id ElementID) String() string {
+	if id.IsZero() {
+		return ""
+	} else if id.Counter == LEGACY_COUNTER {
+		return id.Replica
+	}
+
+	return strconv.Itoa(id.Counter) + "_" + id.Replica
+}
+
+// Returns -1, 0 or 1 if id is less than, equal to or greater than other.
+func (id ElementID) Compare(other ElementID) int {
+	if id.Counter < other.Counter {
+		return -1
+	} else if id.Counter > other.Counter {
+		return 1
+	}
+
+	return strings.Compare(id.Replica, other.Replica)
+}
+
+func (id ElementID) Less(other ElementID) bool {
+	return id.Compare(other) < 0
+}
+
+// MarshalText and UnmarshalText keep the JSON representation (including map
+// keys) identical to the string IDs the browser sends.
+func (id ElementID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ElementID) UnmarshalText(text []byte) error {
+	*id = ParseElementID(string(text))
+	return nil
+}
@@ -0,0 +1,340 @@
+package session
+
+/*
+The index is a balanced binary tree (a treap) over the elements of a session
+in message order, tombstones included. Every node keeps the number of elements
+and visible characters in its subtree and the smallest ID in it, which gives
+O(log n) lookups of:
+
+	- the element at a visible offset, and the offset of an element
+	- the first element after a given one with an ID less than some ID, which
+	  is where getPrev stops skipping an insert's siblings
+
+The tree is ordered by position only, so it is kept in sync by telling it where
+elements are inserted and removed and which elements changed. It is rebuilt from
+the message whenever it is missing, eg. for a session that was just decoded, or
+if the CRDT was modified without going through the session.
+*/
+
+type indexNode struct {
+	element             *Element
+	left, right, parent *indexNode
+	priority            uint32
+
+	count int       // Number of elements in the subtree
+	chars int       // Number of visible characters in the subtree
+	minID ElementID // Smallest element ID in the subtree
+}
+
+type index struct {
+	root  *indexNode
+	nodes map[*Element]*indexNode
+	seed  uint32
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the session's index, building it first if it is missing or out of
+// sync with the CRDT. Index changes are only made while holding the session's
+// write lock, but readers may need to build it, so building is serialized.
+func (s *Session) ordered() *index {
+	s.indexMux.Lock()
+	defer s.indexMux.Unlock()
+
+	if s.index == nil || len(s.index.nodes) != len(s.CRDT) {
+		s.index = newIndex(s.chain())
+	}
+
+	return s.index
+}
+
+func newIndex(elements []*Element) *index {
+	index := &index{
+		nodes: make(map[*Element]*indexNode, len(elements)),
+		seed:  2463534242}
+
+	for _, element := range elements {
+		index.root = index.merge(index.root, index.newNode(element))
+	}
+
+	return index
+}
+
+func (t *index) newNode(element *Element) *indexNode {
+	// xorshift, so priorities are the same on every replica and every run
+	t.seed ^= t.seed << 13
+	t.seed ^= t.seed >> 17
+	t.seed ^= t.seed << 5
+
+	node := &indexNode{element: element, priority: t.seed}
+	node.update()
+	t.nodes[element] = node
+
+	return node
+}
+
+// Inserts element right after prev in the message, or at the start if prev
+// is nil.
+func (t *index) insertAfter(prev *Element, element *Element) {
+	k := 0
+	if prev != nil {
+		k = t.rank(t.nodes[prev]) + 1
+	}
+
+	left, right := t.split(t.root, k)
+	t.root = t.merge(t.merge(left, t.newNode(element)), right)
+}
+
+func (t *index) remove(element *Element) {
+	node := t.nodes[element]
+	if node == nil {
+		return
+	}
+
+	left, right := t.split(t.root, t.rank(node))
+	_, right = t.split(right, 1)
+	t.root = t.merge(left, right)
+
+	delete(t.nodes, element)
+}
+
+// Updates the index after the element's text or deleted flag changed.
+func (t *index) update(element *Element) {
+	for node := t.nodes[element]; node != nil; node = node.parent {
+		node.update()
+	}
+}
+
+// Number of visible characters in the message.
+func (t *index) len() int {
+	return t.root.visibleSize()
+}
+
+// Returns the element holding the visible character at pos and the offset of
+// the character within it, or nil if pos is out of range.
+func (t *index) at(pos int) (*Element, int) {
+	node := t.root
+	for node != nil && pos >= 0 {
+		leftSize := node.left.visibleSize()
+		if pos < leftSize {
+			node = node.left
+			continue
+		}
+
+		pos -= leftSize
+		if pos < visible(node.element) {
+			return node.element, pos
+		}
+
+		pos -= visible(node.element)
+		node = node.right
+	}
+
+	return nil, 0
+}
+
+// Number of visible characters before the element.
+func (t *index) offset(element *Element) int {
+	node := t.nodes[element]
+	offset := node.left.visibleSize()
+	for ; node.parent != nil; node = node.parent {
+		if node == node.parent.right {
+			offset += node.parent.left.visibleSize() + visible(node.parent.element)
+		}
+	}
+
+	return offset
+}
+
+/*
+Starting right after prev (or at the start of the message if prev is nil),
+skips every element with an ID greater than id and returns the last element
+skipped. Returns prev if nothing was skipped.
+*/
+func (t *index) skip(prev *Element, id ElementID) *Element {
+	var stop *indexNode
+	if prev == nil {
+		stop = t.root.firstNotAfter(id)
+	} else {
+		node := t.nodes[prev]
+		stop = node.right.firstNotAfter(id)
+		for ; stop == nil && node.parent != nil; node = node.parent {
+			if node != node.parent.left {
+				continue
+			}
+
+			if parent := node.parent; !id.Less(parent.element.ID) {
+				stop = parent
+			} else {
+				stop = parent.right.firstNotAfter(id)
+			}
+		}
+	}
+
+	var last *indexNode
+	if stop == nil {
+		last = t.root.rightmost()
+	} else {
+		last = stop.predecessor()
+	}
+
+	if last == nil {
+		return nil
+	}
+
+	return last.element
+}
+
+// Number of elements before the node.
+func (t *index) rank(node *indexNode) int {
+	rank := node.left.size()
+	for ; node.parent != nil; node = node.parent {
+		if node == node.parent.right {
+			rank += node.parent.left.size() + 1
+		}
+	}
+
+	return rank
+}
+
+// Splits the tree into its first k elements and the rest.
+func (t *index) split(node *indexNode, k int) (*indexNode, *indexNode) {
+	if node == nil {
+		return nil, nil
+	}
+
+	var left, right *indexNode
+	if k <= node.left.size() {
+		left, node.left = t.split(node.left, k)
+		node.left.setParent(node)
+		right = node
+	} else {
+		node.right, right = t.split(node.right, k-node.left.size()-1)
+		node.right.setParent(node)
+		left = node
+	}
+
+	node.update()
+	left.setParent(nil)
+	right.setParent(nil)
+
+	return left, right
+}
+
+// Joins two trees, all of left's elements coming before right's.
+func (t *index) merge(left *indexNode, right *indexNode) *indexNode {
+	if left == nil {
+		right.setParent(nil)
+		return right
+	} else if right == nil {
+		left.setParent(nil)
+		return left
+	}
+
+	if left.priority > right.priority {
+		left.right = t.merge(left.right, right)
+		left.right.setParent(left)
+		left.update()
+		left.setParent(nil)
+		return left
+	}
+
+	right.left = t.merge(left, right.left)
+	right.left.setParent(right)
+	right.update()
+	right.setParent(nil)
+	return right
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Number of visible characters in an element.
+func visible(element *Element) int {
+	if element.Deleted {
+		return 0
+	}
+
+	return element.span()
+}
+
+func (n *indexNode) update() {
+	n.count = 1 + n.left.size() + n.right.size()
+	n.chars = visible(n.element) + n.left.visibleSize() + n.right.visibleSize()
+
+	n.minID = n.element.ID
+	if n.left != nil && n.left.minID.Less(n.minID) {
+		n.minID = n.left.minID
+	}
+	if n.right != nil && n.right.minID.Less(n.minID) {
+		n.minID = n.right.minID
+	}
+}
+
+func (n *indexNode) setParent(parent *indexNode) {
+	if n != nil {
+		n.parent = parent
+	}
+}
+
+func (n *indexNode) size() int {
+	if n == nil {
+		return 0
+	}
+
+	return n.count
+}
+
+func (n *indexNode) visibleSize() int {
+	if n == nil {
+		return 0
+	}
+
+	return n.chars
+}
+
+// Returns the first node in the subtree whose ID is not greater than id.
+func (n *indexNode) firstNotAfter(id ElementID) *indexNode {
+	if n == nil || id.Less(n.minID) {
+		return nil
+	}
+
+	for {
+		if n.left != nil && !id.Less(n.left.minID) {
+			n = n.left
+		} else if !id.Less(n.element.ID) {
+			return n
+		} else {
+			n = n.right
+		}
+	}
+}
+
+func (n *indexNode) rightmost() *indexNode {
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+
+	return n
+}
+
+func (n *indexNode) predecessor() *indexNode {
+	if n.left != nil {
+		return n.left.rightmost()
+	}
+
+	for n.parent != nil && n == n.parent.left {
+		n = n.parent
+	}
+
+	return n.parent
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
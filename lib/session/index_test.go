@@ -0,0 +1,132 @@
+package session
+
+/*
+Measures position lookups and inserts on sessions of increasing size. With the
+index every operation should grow logarithmically with the size of the
+session rather than linearly:
+
+	go test -run NONE -bench 'ElementAt|PositionOf|Insert|Add'
+
+Sessions are built from single character inserts at random offsets, made by
+several clients in turn so that they can't be merged into runs.
+*/
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Number of clients the inserts of a benchmarked session are made by
+const INDEX_CLIENTS int = 4
+
+// Sizes of the benchmarked sessions, in elements
+var indexSizes = []int{1000, 10000, 100000}
+
+// Built sessions by size, shared by the benchmarks that don't modify them
+var indexSessions = make(map[int]*Session)
+
+func BenchmarkElementAt(b *testing.B) {
+	for _, numElements := range indexSizes {
+		b.Run(strconv.Itoa(numElements), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			session := builtSession(numElements)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				session.ElementAt(r.Intn(numElements))
+			}
+		})
+	}
+}
+
+func BenchmarkPositionOf(b *testing.B) {
+	for _, numElements := range indexSizes {
+		b.Run(strconv.Itoa(numElements), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			session := builtSession(numElements)
+			ids := elementIDs(session)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				session.PositionOf(ids[r.Intn(len(ids))])
+			}
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, numElements := range indexSizes {
+		b.Run(strconv.Itoa(numElements), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			session := buildSession(r, numElements)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				session.Insert(r.Intn(session.Len()+1), "x", "client-"+strconv.Itoa(i%INDEX_CLIENTS))
+			}
+		})
+	}
+}
+
+// Remote inserts arrive with an ID below the local clock, so they are
+// ordered against the elements inserted after the same character
+func BenchmarkAdd(b *testing.B) {
+	for _, numElements := range indexSizes {
+		b.Run(strconv.Itoa(numElements), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			session := buildSession(r, numElements)
+			ids := elementIDs(session)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				prevID := ids[r.Intn(len(ids))]
+				session.Add(Element{
+					SessionID: session.ID,
+					ClientID:  "remote",
+					ID:        ElementID{Counter: prevID.Counter + 1 + r.Intn(numElements), Replica: "remote-" + strconv.Itoa(i)},
+					PrevID:    prevID,
+					Text:      "y"})
+			}
+		})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Returns the session of the given size shared by the benchmarks, building
+// it the first time.
+func builtSession(numElements int) *Session {
+	if session := indexSessions[numElements]; session != nil {
+		return session
+	}
+
+	session := buildSession(rand.New(rand.NewSource(1)), numElements)
+	indexSessions[numElements] = session
+	return session
+}
+
+func buildSession(r *rand.Rand, numElements int) *Session {
+	session := &Session{
+		ID:   "session-0",
+		CRDT: make(map[ElementID]*Element)}
+
+	for i := 0; i < numElements; i++ {
+		session.Insert(r.Intn(i+1), "x", "client-"+strconv.Itoa(i%INDEX_CLIENTS))
+	}
+
+	return session
+}
+
+func elementIDs(session *Session) []ElementID {
+	ids := make([]ElementID, 0, len(session.CRDT))
+	for id := range session.CRDT {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
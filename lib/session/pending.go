@@ -0,0 +1,298 @@
+package session
+
+// Maximum number of operations buffered while waiting for their dependencies.
+// When the buffer is full the oldest operation is dropped, and kept for the
+// caller to take (see TakeDropped), so it can fetch what the session is
+// missing from another replica and apply the operation again. At most
+// MAX_PENDING dropped operations are kept as well.
+const MAX_PENDING int = 1000
+
+// An operation that can't be applied until its dependency arrives: an insert
+// waits for the element it follows, a delete waits for the element itself.
+// Buffered operations are indexed by the character they wait for, so that
+// applying an element only looks at the operations waiting for it.
+type pendingOp struct {
+	element   Element
+	isDelete  bool
+	waitingOn ElementID // Character the operation waits for, see dependency
+	released  bool      // Whether it left the buffer, see release
+}
+
+// Deletes from different replicas can start at the same character but cover
+// different runs, so buffered operations are told apart by text as well as ID
+type pendingKey struct {
+	id       ElementID
+	text     string
+	isDelete bool
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the element as it was received, which is what should be relayed to
+// other replicas. The copy in the CRDT may have been relinked by insert.
+func (op pendingOp) applied() Element {
+	element := op.element
+	element.Deleted = op.isDelete
+
+	return element
+}
+
+func (op pendingOp) key() pendingKey {
+	return pendingKey{op.element.ID, op.element.Text, op.isDelete}
+}
+
+// Returns the character an operation is waiting for, or false if it is ready
+// to apply. A delete of a run waits for the first of its characters missing.
+func (s *Session) dependency(op pendingOp) (ElementID, bool) {
+	if op.isDelete {
+		return s.missingFrom(op.element.ID, op.element.span())
+	}
+
+	prevID := s.anchor(op.element.PrevID)
+	if prevElement, _ := s.find(prevID); prevID.IsZero() || prevElement != nil {
+		return ElementID{}, false
+	}
+
+	return prevID, true
+}
+
+// Applies an operation if it is ready, then applies any buffered operations
+// it unblocked. Operations that aren't ready are buffered. Operations on
+// files, annotations and other documents are passed on to them. Returns the
+// elements that were applied.
+func (s *Session) apply(element Element, isDelete bool) []Element {
+	if element.File {
+		return s.root().applyFile(element)
+	} else if element.Annotation != nil {
+		return s.root().applyAnnotation(element)
+	} else if element.Document != s.document {
+		return s.root().documentFor(element.Document).apply(element, isDelete)
+	}
+
+	if !isDelete && (s.exists(element.ID) || s.collectedFrom(element.ID) > 0) {
+		s.logOnce(element)
+		return nil
+	}
+
+	s.stamp(&element)
+	op := pendingOp{element: element, isDelete: isDelete}
+
+	if dependency, waiting := s.dependency(op); waiting {
+		op.waitingOn = dependency
+		s.buffer(&op)
+		return nil
+	}
+
+	if !s.applyOp(op) {
+		return nil
+	}
+
+	applied := []Element{op.applied()}
+	if isDelete {
+		return applied
+	}
+	return append(applied, s.release(element)...)
+}
+
+func (s *Session) applyOp(op pendingOp) bool {
+	if op.isDelete {
+		if !s.delete(op.element) {
+			s.logOnce(op.applied())
+			return false
+		}
+	} else if s.exists(op.element.ID) {
+		s.logOnce(op.applied())
+		return false
+	} else {
+		s.insert(op.element)
+	}
+
+	s.record(op.element, op.isDelete)
+	s.appendLog(op.applied())
+	return true
+}
+
+// Buffers an operation unless it is already buffered. If the buffer is full,
+// the oldest operation is dropped to make room.
+func (s *Session) buffer(op *pendingOp) {
+	if s.pendingKeys == nil {
+		s.pendingKeys = make(map[pendingKey]bool)
+	}
+	if s.pendingKeys[op.key()] {
+		return
+	}
+
+	if len(s.pendingKeys) >= MAX_PENDING {
+		for s.pending[0].released {
+			s.pending = s.pending[1:]
+		}
+		dropped := s.pending[0]
+		s.pending = s.pending[1:]
+		delete(s.pendingKeys, dropped.key())
+		s.unwait(dropped)
+
+		if len(s.dropped) >= MAX_PENDING {
+			s.dropped = s.dropped[1:]
+		}
+		s.dropped = append(s.dropped, dropped.applied())
+	}
+
+	s.pending = append(s.pending, op)
+	s.pendingKeys[op.key()] = true
+	s.wait(op)
+}
+
+// Indexes a buffered operation by the character it waits for.
+func (s *Session) wait(op *pendingOp) {
+	if s.waiting == nil {
+		s.waiting = make(map[ElementID][]*pendingOp)
+	}
+
+	s.waiting[op.waitingOn] = append(s.waiting[op.waitingOn], op)
+}
+
+// Removes a buffered operation from the index.
+func (s *Session) unwait(op *pendingOp) {
+	ops := s.waiting[op.waitingOn]
+	for i, _op := range ops {
+		if _op == op {
+			ops = append(ops[:i], ops[i+1:]...)
+			break
+		}
+	}
+
+	if len(ops) == 0 {
+		delete(s.waiting, op.waitingOn)
+	} else {
+		s.waiting[op.waitingOn] = ops
+	}
+}
+
+// Applies the buffered operations that were waiting for the characters of an
+// insert that was just applied, then the ones the inserts among them
+// unblocked, and so on. An operation that is still missing another character
+// waits for that one instead. An operation is only applied after its
+// dependency, so the result is in causal order.
+func (s *Session) release(inserted Element) []Element {
+	applied := make([]Element, 0)
+
+	queue := []Element{inserted}
+	for len(queue) > 0 && len(s.waiting) > 0 {
+		element := queue[0]
+		queue = queue[1:]
+
+		for k := 0; k < element.span(); k++ {
+			id := element.ID
+			id.Counter += k
+
+			ops := s.waiting[id]
+			delete(s.waiting, id)
+			for _, op := range ops {
+				if dependency, waiting := s.dependency(*op); waiting {
+					op.waitingOn = dependency
+					s.wait(op)
+					continue
+				}
+
+				op.released = true
+				delete(s.pendingKeys, op.key())
+				if s.applyOp(*op) {
+					applied = append(applied, op.applied())
+					if !op.isDelete {
+						queue = append(queue, op.element)
+					}
+				}
+			}
+		}
+	}
+
+	s.compactPending()
+	return applied
+}
+
+// Drops released operations from the buffer once they make up more than half
+// of it, so that releasing an operation doesn't take a pass over the buffer.
+func (s *Session) compactPending() {
+	if len(s.pending) <= 2*len(s.pendingKeys) {
+		return
+	}
+
+	pending := s.pending[:0]
+	for _, op := range s.pending {
+		if !op.released {
+			pending = append(pending, op)
+		}
+	}
+
+	for i := len(pending); i < len(s.pending); i++ {
+		s.pending[i] = nil
+	}
+	s.pending = pending
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Returns copies of the operations that are waiting for their dependencies,
+// oldest first. Buffered deletes are marked deleted.
+func (s *Session) PendingElements() []Element {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	elements := make([]Element, 0, len(s.pendingKeys))
+	for _, op := range s.pending {
+		if !op.released {
+			elements = append(elements, op.applied())
+		}
+	}
+
+	for _, document := range s.Documents {
+		elements = append(elements, document.PendingElements()...)
+	}
+
+	return elements
+}
+
+// Drops every buffered operation, returning how many were dropped.
+func (s *Session) ClearPending() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	numPending := len(s.pendingKeys)
+	s.pending = nil
+	s.pendingKeys = nil
+	s.waiting = nil
+
+	for _, document := range s.Documents {
+		numPending += document.ClearPending()
+	}
+
+	return numPending
+}
+
+// Returns copies of the operations dropped from the buffer because it was full
+// since the last call, oldest first, and forgets them. The session is missing
+// their dependencies and may be missing more, so it should be synced with
+// another replica and the operations applied again.
+func (s *Session) TakeDropped() []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	dropped := s.dropped
+	s.dropped = nil
+
+	for _, document := range s.Documents {
+		dropped = append(dropped, document.TakeDropped()...)
+	}
+
+	return dropped
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
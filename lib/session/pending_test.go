@@ -0,0 +1,99 @@
+package session
+
+import (
+	"testing"
+)
+
+func TestRelease(t *testing.T) {
+	// Operations of the source session, in the order they were made: a run,
+	// a character after it, a delete across the two, and a character at the
+	// start
+	source := &Session{ID: "s", CRDT: make(map[ElementID]*Element)}
+	source.SetReplica("a")
+	ops := source.Insert(0, "abc", "client")
+	ops = append(ops, source.Insert(3, "d", "client")...)
+	ops = append(ops, source.DeleteRange(2, 2, "client")...)
+	ops = append(ops, source.Insert(0, "x", "client")...)
+
+	tests := []struct {
+		name    string
+		order   []int // Indexes of ops in the order they are delivered
+		pending []int // Number of operations buffered after each one
+	}{
+		{"in order", []int{0, 1, 2, 3}, []int{0, 0, 0, 0}},
+		{"reversed", []int{3, 2, 1, 0}, []int{0, 1, 2, 0}},
+		{"delete first", []int{2, 1, 0, 3}, []int{1, 2, 0, 0}},
+		{"delete waits for the last of its characters", []int{0, 2, 1, 3}, []int{0, 1, 0, 0}},
+		{"duplicates", []int{2, 2, 1, 1, 0, 3}, []int{1, 1, 2, 2, 0, 0}},
+	}
+
+	for _, test := range tests {
+		s := &Session{ID: "s", CRDT: make(map[ElementID]*Element)}
+		seen := make(map[ElementID]bool)
+
+		for i, index := range test.order {
+			for _, element := range s.Apply(ops[index]) {
+				// Every insert is applied after the element it follows, and
+				// every delete after the characters it deletes
+				if !element.Deleted && !element.PrevID.IsZero() && !seen[element.PrevID] {
+					t.Errorf("%s: %v applied before the element it follows", test.name, element)
+				}
+				for _, char := range element.Chars() {
+					if element.Deleted && !seen[char.ID] {
+						t.Errorf("%s: %v applied before the character it deletes", test.name, element)
+					}
+					seen[char.ID] = true
+				}
+			}
+
+			if pending := len(s.PendingElements()); pending != test.pending[i] {
+				t.Errorf("%s: %d operations pending after delivering %d, want %d", test.name, pending, index, test.pending[i])
+			}
+		}
+
+		if text := s.Text(); text != source.Text() {
+			t.Errorf("%s: text = %q, want %q", test.name, text, source.Text())
+		}
+		if len(s.waiting) != 0 || len(s.pending) != 0 {
+			t.Errorf("%s: %v still waiting and %d pending", test.name, s.waiting, len(s.pending))
+		}
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	source := &Session{ID: "s", CRDT: make(map[ElementID]*Element)}
+	source.SetReplica("a")
+	first := source.Insert(0, "a", "client")
+	ops := make([]Element, 0, MAX_PENDING+1)
+	for i := 0; i <= MAX_PENDING; i++ {
+		ops = append(ops, source.Insert(i+1, "b", "client")...)
+	}
+
+	// Each insert waits for the one before, so the oldest is dropped when
+	// the last one is buffered
+	s := &Session{ID: "s", CRDT: make(map[ElementID]*Element)}
+	for _, op := range ops {
+		s.Apply(op)
+	}
+	if pending := len(s.PendingElements()); pending != MAX_PENDING {
+		t.Fatalf("%d operations pending, want %d", pending, MAX_PENDING)
+	}
+	dropped := s.TakeDropped()
+	if len(dropped) != 1 || dropped[0].ID != ops[0].ID {
+		t.Fatalf("TakeDropped() = %v, want %v", dropped, ops[0])
+	}
+
+	// Nothing is released until the dropped insert is applied again
+	if applied := s.Apply(first[0]); len(applied) != 1 {
+		t.Errorf("Apply() = %d elements, want 1", len(applied))
+	}
+	if applied := s.Apply(dropped[0]); len(applied) != MAX_PENDING+1 {
+		t.Errorf("Apply() of the dropped insert = %d elements, want %d", len(applied), MAX_PENDING+1)
+	}
+	if text := s.Text(); text != source.Text() {
+		t.Errorf("text = %q, want %q", text, source.Text())
+	}
+	if pending := len(s.PendingElements()); pending != 0 {
+		t.Errorf("%d operations pending after releasing", pending)
+	}
+}
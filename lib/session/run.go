@@ -0,0 +1,244 @@
+package session
+
+import "unicode/utf8"
+
+/*
+An element can hold a run of characters instead of a single one. The i-th
+character of a run has the ID {ID.Counter + i, ID.Replica}, and the characters
+of a run are always adjacent in the message. A run is therefore just a compact
+way of storing the elements its characters would have been on their own: it
+is split whenever an insert or delete lands inside it, and consecutive inserts
+from the same replica are merged back into it.
+
+PrevID always refers to the character before an element (the last character
+of the previous run) and NextID to the first character of the next run, which
+is also the key of that run in the CRDT.
+*/
+
+// Maximum number of characters in a single run. This also bounds the number of
+// lookups needed to find the run holding a character.
+const MAX_RUN int = 256
+
+// A range of n characters with consecutive IDs, starting at id.
+type charRange struct {
+	id ElementID
+	n  int
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the run holding the character with the given ID and the offset of
+// the character within the run, or nil if the character doesn't exist.
+func (s *Session) find(id ElementID) (*Element, int) {
+	if element := s.CRDT[id]; element != nil {
+		return element, 0
+	}
+
+	for counter := id.Counter - 1; counter >= 0 && id.Counter-counter < MAX_RUN; counter-- {
+		element := s.CRDT[ElementID{Counter: counter, Replica: id.Replica}]
+		if element == nil {
+			continue
+		}
+
+		if offset := id.Counter - counter; offset < element.span() {
+			return element, offset
+		}
+
+		// Runs from the same replica never overlap, so the closest run
+		// before the ID is the only one that could hold it
+		break
+	}
+
+	return nil, 0
+}
+
+// Splits a run so that it keeps its first k characters, and returns the new
+// run holding the rest. Requires 0 < k < span.
+func (s *Session) split(element *Element, k int) *Element {
+	index := s.ordered()
+
+	runes := []rune(element.Text)
+	tail := &Element{
+		SessionID: element.SessionID,
+		ClientID:  element.ClientID,
+		ID:        ElementID{Counter: element.ID.Counter + k, Replica: element.ID.Replica},
+		PrevID:    ElementID{Counter: element.ID.Counter + k - 1, Replica: element.ID.Replica},
+		NextID:    element.NextID,
+		Text:      string(runes[k:]),
+		Deleted:   element.Deleted,
+		Timestamp: element.Timestamp,
+		Document:  element.Document}
+
+	element.Text = string(runes[:k])
+	element.NextID = tail.ID
+	s.CRDT[tail.ID] = tail
+
+	index.update(element)
+	index.insertAfter(element, tail)
+
+	if acks, ok := s.Acks[element.ID]; ok {
+		tailAcks := make(map[string]bool)
+		for replica := range acks {
+			tailAcks[replica] = true
+		}
+		s.Acks[tail.ID] = tailAcks
+	}
+
+	return tail
+}
+
+// Whether element can be appended to the run prev. It can if its characters
+// directly follow prev's in both the message and the replica's counter.
+func (s *Session) canMerge(prev *Element, element *Element) bool {
+	return !prev.Deleted && !element.Deleted &&
+		prev.Text != "" && element.Text != "" &&
+		prev.ID.Counter >= 0 && prev.ID.Replica == element.ID.Replica &&
+		prev.ID.Counter+prev.span() == element.ID.Counter &&
+		prev.ClientID == element.ClientID && prev.SessionID == element.SessionID &&
+		prev.span()+element.span() <= MAX_RUN
+}
+
+// Marks n characters starting at id as deleted, splitting runs at the edges
+// of the range. Characters that have been collected were deleted already, so
+// they are skipped. Returns whether any character was deleted.
+func (s *Session) deleteRun(id ElementID, n int) bool {
+	deleted := false
+	for n > 0 {
+		element, k := s.find(id)
+		if element == nil {
+			if collected := s.collectedFrom(id); collected > 0 {
+				id.Counter += collected
+				n -= collected
+				continue
+			}
+			break
+		}
+
+		if k > 0 {
+			element = s.split(element, k)
+		}
+		if element.span() > n {
+			s.split(element, n)
+		}
+
+		if !element.Deleted {
+			element.Deleted = true
+			deleted = true
+			s.ordered().update(element)
+
+			if s.Acks == nil {
+				s.Acks = make(map[ElementID]map[string]bool)
+			}
+			s.Acks[element.ID] = make(map[string]bool)
+
+			logElement(element)
+		}
+
+		id.Counter += element.span()
+		n -= element.span()
+	}
+
+	return deleted
+}
+
+// Returns the first of the n characters starting at id that neither exists
+// nor has been collected, or false if every one of them does or has.
+func (s *Session) missingFrom(id ElementID, n int) (ElementID, bool) {
+	for n > 0 {
+		element, k := s.find(id)
+		if element == nil {
+			collected := s.collectedFrom(id)
+			if collected == 0 {
+				return id, true
+			}
+
+			id.Counter += collected
+			n -= collected
+			continue
+		}
+
+		id.Counter += element.span() - k
+		n -= element.span() - k
+	}
+
+	return ElementID{}, false
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ELEMENT METHODS>
+
+// Number of characters (and so IDs) the element covers. An element with no
+// text still takes up one ID, and legacy IDs can't hold runs.
+func (e *Element) span() int {
+	if e.ID.Counter < 0 {
+		return 1
+	}
+
+	if n := utf8.RuneCountInString(e.Text); n > 1 {
+		return n
+	}
+
+	return 1
+}
+
+// ID of the last character in the element.
+func (e *Element) lastID() ElementID {
+	if e.span() == 1 {
+		return e.ID
+	}
+
+	return ElementID{Counter: e.ID.Counter + e.span() - 1, Replica: e.ID.Replica}
+}
+
+// Whether the element holds text, rather than naming a file or changing an
+// annotation.
+func (e *Element) isText() bool {
+	return !e.File && e.Annotation == nil
+}
+
+// Returns the character at offset k of the element as an element of its own.
+func (e *Element) charAt(k int) Element {
+	if e.span() == 1 {
+		return *e
+	}
+
+	char := *e
+	char.ID = ElementID{Counter: e.ID.Counter + k, Replica: e.ID.Replica}
+	char.Text = string([]rune(e.Text)[k])
+	if k > 0 {
+		char.PrevID = ElementID{Counter: char.ID.Counter - 1, Replica: e.ID.Replica}
+	}
+	if k < e.span()-1 {
+		char.NextID = ElementID{Counter: char.ID.Counter + 1, Replica: e.ID.Replica}
+	}
+
+	return char
+}
+
+// Splits a run into one element per character, the form browsers expect.
+// Each character of a stamped text operation gets its own clock (see width).
+func (e Element) Chars() []Element {
+	n := e.span()
+	if n == 1 {
+		return []Element{e}
+	}
+
+	chars := make([]Element, n)
+	for k := range chars {
+		chars[k] = e.charAt(k)
+		if e.Stamper != "" && e.isText() {
+			chars[k].Clock = e.Clock - n + 1 + k
+		}
+	}
+
+	return chars
+}
+
+// </ELEMENT METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
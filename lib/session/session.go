@@ -1,9 +1,11 @@
 package session
 
 import (
+	"bytes"
 	"fmt"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // Flags whether to log the inputs and deletes
@@ -11,34 +13,86 @@ const LOG_ELEMENTS = false
 
 // Since we are adding a character to the right of another character, we need
 // a fake INITIAL_ID to use to place the first character in an empty message
-const INITIAL_ID string = "12345"
+var INITIAL_ID ElementID = ParseElementID("12345")
 
+// Number of stampers handed out by SetReplica, which tells apart the copies
+// of a session a replica loads
+var numStampers uint64
+
+// Next is the session's Lamport clock: it is always greater than the counter
+// of every element the session has seen, and is used to allocate new IDs.
+//
+// Log holds every operation the session has applied, see Version, apart
+// from the operations on characters that have been collected, which are
+// compacted into Compacted, see Collect.
+//
+// Documents and Files hold the session's files other than the main document,
+// by document ID. See CreateFile.
+//
+// Annotations holds the annotations of every document, by annotation ID. See
+// Annotate.
+//
+// Acks maps every tombstone (deleted element still in the CRDT) to the set
+// of replicas that have acknowledged its delete. See Collect.
 type Session struct {
 	ID   string
-	CRDT map[string]*Element
-	Head string
+	CRDT map[ElementID]*Element
+	Head ElementID
 	Next int
-
-	mux sync.RWMutex
+	Acks map[ElementID]map[string]bool `json:"-"`
+	Log  []Operation                   `json:"-"`
+
+	Compacted VersionVector `json:"-"`
+
+	Documents map[string]*Session `json:"-"`
+	Files     map[string]*File    `json:"-"`
+
+	Annotations map[ElementID]*Annotation `json:"-"`
+
+	pending     []*pendingOp               // Oldest first, released ones included until compacted, see release
+	pendingKeys map[pendingKey]bool        // Keys of the pending operations
+	waiting     map[ElementID][]*pendingOp // Pending operations by the character they wait for
+	dropped     []Element                  // Operations dropped from pending, see TakeDropped
+	histories   map[string]*history
+	clocks      map[string]int             // Latest clock of every stamper, see stamp
+	applied     VersionVector              // Version of the log, see logOnce
+	acked       map[string]VersionVector   // Latest version each replica acknowledged, see AckVersion
+	collected   map[ElementID]collectedRun // Every run collected since the session was loaded, see Collect
+	deleters    map[ElementID]string       // Client that deleted each character, see Blame
+	deletes     []Element                  // Logged deletes of characters not all collected yet, see AckVersion
+	parent      *Session                   // Session a document belongs to, see documentFor
+	document    string                     // ID of the document, if this is one
+	replica     string                     // Replica of the IDs the session allocates, see SetReplica
+	stamper     string                     // Replica the session stamps operations as, see SetReplica
+	index       *index
+	mux         sync.RWMutex
+	indexMux    sync.Mutex
 }
 
 type Element struct {
 	SessionID string
 	ClientID  string
-	ID        string
-	PrevID    string
-	NextID    string
+	ID        ElementID
+	PrevID    ElementID
+	NextID    ElementID
 	Text      string
 	Deleted   bool
 
 	Timestamp int64
+	Stamper   string `json:",omitempty"` // Replica that stamped the operation, see stamp
+	Clock     int    // Clock of the operation, see stamp
+
+	Document string // Document the element belongs to, empty for the main one
+	File     bool   // Whether the element names its document, see CreateFile
+
+	Annotation *Annotation `json:",omitempty"` // Annotation the element changes, see Annotate
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <PRIVATE METHODS>
 
-func (s *Session) exists(id string) bool {
-	if s.CRDT[id] != nil || id == INITIAL_ID {
+func (s *Session) exists(id ElementID) bool {
+	if element, _ := s.find(id); element != nil || id == INITIAL_ID {
 		return true
 	} else {
 		return false
@@ -47,69 +101,259 @@ func (s *Session) exists(id string) bool {
 
 /*Checks if any other clients have made inserts to the same prevID. The algorithm
 compares the prevElement's nextID to the incomingOp ID - if nextID is greater, incomingOp
-will move further down the message until it is greater than the nextID
+will move further down the message until it is greater than the nextID. IDs are
+compared by Lamport counter first, then by replica. Skipping a whole run at once is
+the same as skipping its characters one by one, since their IDs only increase. The
+index finds where to stop without walking the elements being skipped.
+
+A nil prevElement stands for the start of the message, so elements inserted at the
+start are ordered the same way as elements inserted after any other element. Returns
+nil if the element should become the new head.
 */
-func (s *Session) getPrev(element Element) *Element {
+func (s *Session) getPrev(element Element, prevElement *Element) *Element {
+	return s.ordered().skip(prevElement, element.ID)
+}
+
+func (s *Session) insert(element Element) {
+	// Runs longer than MAX_RUN are inserted one chunk at a time, each chunk
+	// following the last character of the one before
+	if element.span() > MAX_RUN {
+		runes := []rune(element.Text)
+		rest := element
+		rest.ID.Counter += MAX_RUN
+		rest.PrevID = ElementID{Counter: rest.ID.Counter - 1, Replica: rest.ID.Replica}
+		rest.Text = string(runes[MAX_RUN:])
+		element.Text = string(runes[:MAX_RUN])
+
+		s.insert(element)
+		s.insert(rest)
+		return
+	}
+
 	id := element.ID
-	prevID := element.PrevID
-	prevElement := s.CRDT[prevID]
-
-	if prevElement.NextID != "" && prevElement.NextID != id {
-		nextID := prevElement.NextID
-		for strings.Compare(nextID, id) == 1 && element.ClientID != s.CRDT[nextID].ClientID {
-			prevElement = s.CRDT[nextID]
-			nextID = prevElement.NextID
+	prevID := s.anchor(element.PrevID)
+
+	var prevElement *Element
+	if !prevID.IsZero() {
+		// If the previous character is inside a run, split the run
+		// so the element can go right after it
+		anchor, k := s.find(prevID)
+		if k < anchor.span()-1 {
+			s.split(anchor, k+1)
 		}
 
-		return s.CRDT[prevElement.ID]
-	} else {
-		return s.CRDT[prevID]
+		prevElement = anchor
 	}
-}
 
-func (s *Session) insert(element Element) {
-	id := element.ID
-	prevID := element.PrevID
+	prevElement = s.getPrev(element, prevElement)
+
+	// The element's NextID is where the sender had it, which may not be
+	// where it goes here
+	element.NextID = ElementID{}
 
-	// Handle the case where the element does not
-	// have a previous ID (ie. replacing head)
-	if prevID == "" {
+	// Handle the case where the element goes at the
+	// start of the message (ie. replacing head)
+	if prevElement == nil {
 		if nextElem, ok := s.CRDT[s.Head]; ok {
 			element.NextID = nextElem.ID
-			nextElem.PrevID = id
+			nextElem.PrevID = element.lastID()
 		}
 
+		element.PrevID = ElementID{}
 		s.Head = id
 	} else {
-		prevElement := s.getPrev(element)
 		nextElement := s.CRDT[prevElement.NextID]
 
 		if nextElement != nil {
-			nextElement.PrevID = id
+			nextElement.PrevID = element.lastID()
 			element.NextID = nextElement.ID
 		}
 
 		prevElement.NextID = id
-		element.PrevID = prevElement.ID
+		element.PrevID = prevElement.lastID()
 	}
 
 	logElement(&element)
 
-	s.CRDT[id] = &element
-	s.Next++
+	if prevElement != nil && s.canMerge(prevElement, &element) {
+		prevElement.Text += element.Text
+		prevElement.NextID = element.NextID
+		s.ordered().update(prevElement)
+	} else {
+		s.ordered().insertAfter(prevElement, &element)
+		s.CRDT[id] = &element
+	}
+
+	if last := element.lastID(); last.Counter >= s.Next {
+		s.Next = last.Counter + 1
+	}
 }
 
 func (s *Session) delete(element Element) bool {
-	_element := s.CRDT[element.ID]
-	if _element != nil && _element.Deleted == false {
-		_element.Deleted = true
+	return s.deleteRun(element.ID, element.span())
+}
+
+// Allocates an unused element ID for an element made on behalf of the given
+// client, using the session's Lamport clock as the counter. Documents use the
+// clock of their session, so IDs are unique across all of a session's
+// documents. The ID belongs to the session's replica if it has one (see
+// SetReplica), and to the client otherwise.
+func (s *Session) newID(clientID string) ElementID {
+	replica := s.root().replica
+	if replica == "" {
+		replica = clientID
+	}
+
+	id := ElementID{Counter: s.root().Next, Replica: replica}
+	for s.exists(id) {
+		id.Counter++
+	}
+
+	return id
+}
+
+// Returns the ID of the visible element at position pos, or the zero ID if
+// pos is before the start of the message.
+func (s *Session) idAt(pos int) (id ElementID, ok bool) {
+	if pos < 0 {
+		return ElementID{}, true
+	}
+
+	if element, k := s.ordered().at(pos); element != nil {
+		return element.charAt(k).ID, true
+	}
 
-		logElement(_element)
+	return
+}
+
+// Walks the message from Head to tail, calling fn on every element that has
+// not been deleted. The walk stops early if fn returns false. The number of
+// steps is bounded by the size of the CRDT so a corrupted chain can't loop.
+func (s *Session) walk(fn func(element *Element) bool) {
+	steps := 0
+	element := s.CRDT[s.Head]
+	for element != nil && steps <= len(s.CRDT) {
+		if !element.Deleted && !fn(element) {
+			return
+		}
 
+		element = s.CRDT[element.NextID]
+		steps++
+	}
+}
+
+// Returns the visible text of the message.
+func (s *Session) text() string {
+	var buffer bytes.Buffer
+	s.walk(func(element *Element) bool {
+		buffer.WriteString(element.Text)
 		return true
-	} else {
-		return false
+	})
+
+	return buffer.String()
+}
+
+// Inserts text after the character prevID on behalf of clientID, in runs of up
+// to MAX_RUN characters. Returns the elements that were inserted.
+func (s *Session) insertText(prevID ElementID, text string, clientID string) []Element {
+	runes := []rune(text)
+	elements := make([]Element, 0, len(runes)/MAX_RUN+1)
+	for from := 0; from < len(runes); from += MAX_RUN {
+		to := from + MAX_RUN
+		if to > len(runes) {
+			to = len(runes)
+		}
+
+		element := Element{
+			SessionID: s.ID,
+			ClientID:  clientID,
+			ID:        s.newID(clientID),
+			PrevID:    prevID,
+			Text:      string(runes[from:to]),
+			Document:  s.document}
+
+		s.stamp(&element)
+		s.insert(element)
+		s.appendLog(element)
+		elements = append(elements, element)
+		prevID = element.lastID()
+	}
+
+	return elements
+}
+
+// Inserts text at the given offset on behalf of clientID, see Insert.
+func (s *Session) insertAt(offset int, text string, clientID string) []Element {
+	prevID, ok := s.idAt(offset - 1)
+	if !ok || offset < 0 {
+		return nil
 	}
+
+	elements := s.insertText(prevID, text, clientID)
+	for _, element := range elements {
+		s.record(element, false)
+	}
+
+	return elements
+}
+
+// Deletes length visible characters starting at the given offset on behalf
+// of clientID, see DeleteRange.
+func (s *Session) deleteRange(offset, length int, clientID string) []Element {
+	if offset < 0 {
+		return nil
+	}
+
+	// Find the parts of each run that fall inside the range first, since
+	// deleting splits runs and changes the message being walked
+	parts := make([]charRange, 0)
+	i := 0
+	s.walk(func(element *Element) bool {
+		if i >= offset+length {
+			return false
+		}
+
+		from, to := 0, element.span()
+		if offset > i {
+			from = offset - i
+		}
+		if offset+length < i+to {
+			to = offset + length - i
+		}
+		if from < to {
+			parts = append(parts, charRange{element.charAt(from).ID, to - from})
+		}
+
+		i += element.span()
+		return true
+	})
+
+	elements := s.deleteParts(parts, clientID)
+	for _, element := range elements {
+		s.record(element, true)
+	}
+
+	return elements
+}
+
+// Deletes the given characters on behalf of clientID. Returns the deleted
+// elements, one per part that wasn't already deleted.
+func (s *Session) deleteParts(parts []charRange, clientID string) []Element {
+	elements := make([]Element, 0, len(parts))
+	for _, part := range parts {
+		if s.deleteRun(part.id, part.n) {
+			element, _ := s.find(part.id)
+
+			deleted := *element
+			deleted.ClientID = clientID
+			deleted.Clock = 0
+			s.stamp(&deleted)
+			s.appendLog(deleted)
+			elements = append(elements, deleted)
+		}
+	}
+
+	return elements
 }
 
 // </PRIVATE METHODS>
@@ -120,26 +364,166 @@ func (s *Session) delete(element Element) bool {
 ////////////////////////////////////////////////////////////////////////////////////////////
 // <PUBLIC METHODS>
 
-func (s *Session) Add(element Element) bool {
+// Sets the replica that the IDs of elements the session makes on behalf of
+// clients belong to, eg. inverse edits of Undo, file and annotation elements
+// and text inserted with Insert. A client allocates IDs of its own with its
+// own clock, so a server applying edits for it must use a replica ID no
+// client uses, or the IDs could collide. The elements keep the client as
+// their ClientID. The replica isn't persisted.
+//
+// The session also stamps operations (see stamp) as a stamper of its own
+// under the replica. A copy of the session loaded later, eg. after this one
+// is evicted, doesn't know every clock this one used, so it gets another.
+func (s *Session) SetReplica(replica string) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	id := element.ID
+	s.replica = replica
+	s.stamper = replica + "#" + strconv.FormatUint(atomic.AddUint64(&numStampers, 1), 10)
+}
 
-	// If the element already exists don't insert
-	if s.exists(id) {
-		return false
+// Stamps an operation a client sent, unless it is already stamped or is an
+// insert the session already has, so that every replica it is relayed to
+// logs it with the same stamp.
+func (s *Session) Stamp(element *Element) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if element.Clock != 0 {
+		return
+	} else if !element.Deleted && element.isText() && s.documentFor(element.Document).exists(element.ID) {
+		return
 	}
 
-	s.insert(element)
-	return true
+	s.stamp(element)
+}
+
+// Inserts an element. If the element it should follow hasn't arrived yet, the
+// insert is buffered until it does. Returns whether the element was inserted
+// right away.
+func (s *Session) Add(element Element) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.apply(element, false)) > 0
 }
 
+// Deletes an element. If the element hasn't arrived yet, the delete is
+// buffered until it does. Returns whether the element was deleted right away.
 func (s *Session) Delete(element Element) bool {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	return s.delete(element)
+	return len(s.apply(element, true)) > 0
+}
+
+// Applies an insert, or a delete if the element is marked deleted, buffering
+// it if its dependencies haven't arrived yet. Returns every element that was
+// applied as a result, in causal order: the element itself followed by any
+// buffered elements it unblocked.
+func (s *Session) Apply(element Element) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.apply(element, element.Deleted)
+}
+
+// Inserts text at the given offset on behalf of clientID. The text is stored
+// as runs of up to MAX_RUN characters, each following the last character of
+// the one before. Returns the elements that were applied so they can be
+// replicated, or nil if the offset is out of range.
+func (s *Session) Insert(offset int, text string, clientID string) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.insertAt(offset, text, clientID)
+}
+
+// Deletes length visible characters starting at the given offset on behalf
+// of clientID. Returns the deleted elements so they can be replicated.
+func (s *Session) DeleteRange(offset, length int, clientID string) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.deleteRange(offset, length, clientID)
+}
+
+// Returns the current contents of the session, skipping deleted elements.
+func (s *Session) Text() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.text()
+}
+
+// Returns the number of visible (non-deleted) characters in the session.
+func (s *Session) Len() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.ordered().len()
+}
+
+// Returns the visible character at position pos (zero-based) as an element of
+// its own. If pos is out of range, ok is false.
+func (s *Session) ElementAt(pos int) (element Element, ok bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if pos < 0 {
+		return
+	}
+
+	if _element, k := s.ordered().at(pos); _element != nil {
+		return _element.charAt(k), true
+	}
+
+	return
+}
+
+// Returns the position of the character with the given ID among the visible
+// characters, or -1 if it doesn't exist or has been deleted.
+func (s *Session) PositionOf(id ElementID) int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	run, k := s.find(id)
+	if run == nil || run.Deleted {
+		return -1
+	}
+
+	return s.ordered().offset(run) + k
+}
+
+// Returns the visible characters in positions [from, to), one element per
+// character. The range is clamped to the bounds of the message.
+func (s *Session) Range(from, to int) []Element {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if from < 0 {
+		from = 0
+	}
+
+	elements := make([]Element, 0)
+	if to <= from {
+		return elements
+	}
+
+	element, k := s.ordered().at(from)
+	for i := from; element != nil && i < to; element = s.CRDT[element.NextID] {
+		if element.Deleted {
+			continue
+		}
+
+		for ; k < element.span() && i < to; k++ {
+			elements = append(elements, element.charAt(k))
+			i++
+		}
+		k = 0
+	}
+
+	return elements
 }
 
 // </PUBLIC METHODS>
@@ -159,18 +543,18 @@ func logElement(element *Element) {
 		fmt.Println(
 			"============INSERT===========\n",
 			"SESSION: "+element.SessionID+"\n",
-			"ID: "+element.ID+"\n",
-			"PREV ID: "+element.PrevID+"\n",
-			"NEXT ID: "+element.NextID+"\n",
+			"ID: "+element.ID.String()+"\n",
+			"PREV ID: "+element.PrevID.String()+"\n",
+			"NEXT ID: "+element.NextID.String()+"\n",
 			"TEXT: "+element.Text+"\n",
 			"=============================")
 	} else {
 		fmt.Println(
 			"============DELETE===========\n",
 			"SESSION: "+element.SessionID+"\n",
-			"ID: "+element.ID+"\n",
-			"PREV ID: "+element.PrevID+"\n",
-			"NEXT ID: "+element.NextID+"\n",
+			"ID: "+element.ID.String()+"\n",
+			"PREV ID: "+element.PrevID.String()+"\n",
+			"NEXT ID: "+element.NextID.String()+"\n",
 			"TEXT: "+element.Text+"\n",
 			"=============================")
 	}
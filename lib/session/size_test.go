@@ -0,0 +1,147 @@
+package session
+
+/*
+Compares the memory and gob size of a session holding one element per
+character against the same document stored as runs. The document is typed
+one character at a time, the way the browser sends it, so the run version
+shows the effect of merging consecutive inserts. Besides the time to build
+each session, the benchmarks report its elements, heap and gob bytes:
+
+	go test -run NONE -bench SessionSize -benchtime 1x
+*/
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const SIZE_CLIENT_ID string = "client-0"
+const SIZE_SESSION_ID string = "session-0"
+
+// Lines of the generated document
+const SIZE_LINES int = 2000
+
+func BenchmarkSessionSize(b *testing.B) {
+	text := document(SIZE_LINES)
+
+	b.Run("per-character", func(b *testing.B) {
+		benchmarkSize(b, func() *Session { return perCharacter(text) })
+	})
+	b.Run("runs", func(b *testing.B) {
+		benchmarkSize(b, func() *Session { return typed(text) })
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Builds the session b.N times, reporting the size of the last one.
+func benchmarkSize(b *testing.B, build func() *Session) {
+	var session *Session
+	var heap int64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		before := heapInUse()
+		b.StartTimer()
+
+		session = build()
+
+		b.StopTimer()
+		heap = int64(heapInUse()) - int64(before)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	data, err := EncodeSession(session)
+	if err != nil {
+		b.Fatal("failed to encode:", err)
+	}
+
+	b.ReportMetric(float64(len(session.CRDT)), "elements")
+	b.ReportMetric(float64(heap), "heap-bytes")
+	b.ReportMetric(float64(len(data)), "gob-bytes")
+
+	// Keep the session alive until its heap usage has been measured
+	runtime.KeepAlive(session)
+}
+
+// Builds a session the way it was stored before runs existed: a chain of
+// single character elements.
+func perCharacter(text string) *Session {
+	session := &Session{
+		ID:   SIZE_SESSION_ID,
+		CRDT: make(map[ElementID]*Element)}
+
+	var prevID ElementID
+	for i, char := range []rune(text) {
+		id := ElementID{Counter: i, Replica: SIZE_CLIENT_ID}
+		session.CRDT[id] = &Element{
+			SessionID: SIZE_SESSION_ID,
+			ClientID:  SIZE_CLIENT_ID,
+			ID:        id,
+			PrevID:    prevID,
+			Text:      string(char)}
+
+		if prevID.IsZero() {
+			session.Head = id
+		} else {
+			session.CRDT[prevID].NextID = id
+		}
+
+		prevID = id
+		session.Next = i + 1
+	}
+
+	return session
+}
+
+// Types the text into a session one character at a time.
+func typed(text string) *Session {
+	session := &Session{
+		ID:   SIZE_SESSION_ID,
+		CRDT: make(map[ElementID]*Element)}
+
+	for i, char := range []rune(text) {
+		session.Insert(i, string(char), SIZE_CLIENT_ID)
+	}
+
+	return session
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapInuse
+}
+
+// Generates a Go-like document with the given number of lines.
+func document(lines int) string {
+	var builder strings.Builder
+	depth := 0
+	for i := 0; i < lines; i++ {
+		switch {
+		case i%25 == 0:
+			depth = 0
+			builder.WriteString("func handler" + strconv.Itoa(i) + "(w http.ResponseWriter, r *http.Request) {\n")
+			depth++
+		case i%25 == 24:
+			builder.WriteString("}\n")
+		case i%5 == 0:
+			builder.WriteString(strings.Repeat("\t", depth) + "if err := check(r, \"value\"); err != nil {\n")
+			builder.WriteString(strings.Repeat("\t", depth+1) + "return\n")
+			builder.WriteString(strings.Repeat("\t", depth) + "}\n")
+			i += 2
+		default:
+			builder.WriteString(strings.Repeat("\t", depth) + "value := compute(" + strconv.Itoa(i) + ", r.URL.Query())\n")
+		}
+	}
+
+	return builder.String()
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
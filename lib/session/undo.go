@@ -0,0 +1,345 @@
+package session
+
+import "strings"
+
+/*
+Every replica keeps the recent edits of each client so that a client can undo
+its own edits without undoing anyone else's. Undoing an edit applies its
+inverse as a new edit, which is replicated like any other:
+
+	- undoing an insert deletes the inserted characters that are still visible
+	- undoing a delete inserts the deleted text again, right after the
+	  tombstones it left behind
+
+Deleted text is inserted again with new IDs rather than by clearing the
+deleted flag of its tombstones, since a tombstone can be collected (see
+Collect) and clearing the flag couldn't be ordered against other deletes of
+the same characters. Edits in the history that refer to the deleted
+characters are updated to refer to the new ones.
+
+Characters typed or deleted one after another on the same line are undone
+together. History is kept in memory only, so it is lost when a session is
+saved and reloaded.
+*/
+
+// Maximum number of edits kept per client for undo and redo
+const MAX_UNDO int = 100
+
+type edit struct {
+	isDelete bool
+	parts    []charRange // In message order
+	text     string
+
+	// Character the deleted text followed, used to place the text if the
+	// tombstones are gone when the delete is undone
+	after ElementID
+}
+
+type history struct {
+	done   []edit
+	undone []edit
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Records an applied insert, or delete if isDelete, in the history of the
+// element's client. Recording a new edit discards the client's undone edits.
+func (s *Session) record(element Element, isDelete bool) {
+	h := s.history(element.ClientID)
+	h.undone = nil
+
+	part := charRange{element.ID, element.span()}
+	text := s.textOf(part)
+
+	if n := len(h.done); n > 0 && !strings.Contains(text, "\n") {
+		last := &h.done[n-1]
+		if last.extend(s, part, text, isDelete) {
+			return
+		}
+	}
+
+	_edit := edit{isDelete: isDelete, parts: []charRange{part}, text: text}
+	if isDelete {
+		_edit.after = s.prevCharID(part.id)
+	}
+
+	h.push(_edit)
+}
+
+// Adds a part to an edit if it continues it: a character typed right after
+// the edit's last one, or a character deleted right before or after the
+// edit's deleted characters. Returns whether the part was added.
+func (e *edit) extend(s *Session, part charRange, text string, isDelete bool) bool {
+	if e.isDelete != isDelete || strings.HasSuffix(e.text, "\n") {
+		return false
+	}
+
+	first := e.parts[0]
+	last := e.parts[len(e.parts)-1]
+	lastID := ElementID{Counter: last.id.Counter + last.n - 1, Replica: last.id.Replica}
+	partLastID := ElementID{Counter: part.id.Counter + part.n - 1, Replica: part.id.Replica}
+
+	if s.prevCharID(part.id) == lastID {
+		e.parts = append(e.parts, part)
+		e.text += text
+		return true
+	} else if isDelete && s.nextCharID(partLastID) == first.id {
+		e.parts = append([]charRange{part}, e.parts...)
+		e.text = text + e.text
+		e.after = s.prevCharID(part.id)
+		return true
+	}
+
+	return false
+}
+
+// Applies the inverse of an edit on behalf of clientID. Returns the elements
+// that were applied and the edit that would reverse them.
+func (s *Session) invert(_edit edit, clientID string) ([]Element, edit) {
+	if _edit.isDelete {
+		// Place the text after the last tombstone, or where the text
+		// was if the tombstones were collected
+		last := _edit.parts[len(_edit.parts)-1]
+		prevID := ElementID{Counter: last.id.Counter + last.n - 1, Replica: last.id.Replica}
+		if !s.exists(prevID) {
+			prevID = _edit.after
+			if !s.exists(prevID) {
+				prevID = ElementID{}
+			}
+		}
+
+		elements := s.insertText(prevID, _edit.text, clientID)
+
+		inverse := edit{}
+		for _, element := range elements {
+			inverse.parts = append(inverse.parts, charRange{element.ID, element.span()})
+			inverse.text += element.Text
+		}
+		s.remap(_edit.parts, inverse.parts)
+
+		return elements, inverse
+	}
+
+	// Only delete the characters no one else has deleted yet
+	parts := make([]charRange, 0)
+	for _, part := range _edit.parts {
+		parts = append(parts, s.visibleParts(part)...)
+	}
+
+	inverse := edit{isDelete: true}
+	if len(parts) > 0 {
+		inverse.after = s.prevCharID(parts[0].id)
+	}
+	for _, part := range parts {
+		inverse.parts = append(inverse.parts, part)
+		inverse.text += s.textOf(part)
+	}
+
+	return s.deleteParts(parts, clientID), inverse
+}
+
+// Pops edits from one stack until one of them can be inverted, pushing its
+// inverse to the other stack. Returns the elements that were applied.
+func (s *Session) undoFrom(from *[]edit, to *[]edit, clientID string) []Element {
+	for len(*from) > 0 {
+		_edit := (*from)[len(*from)-1]
+		*from = (*from)[:len(*from)-1]
+
+		elements, inverse := s.invert(_edit, clientID)
+		if len(elements) > 0 {
+			*to = append(*to, inverse)
+			return elements
+		}
+	}
+
+	return nil
+}
+
+// Undoes the most recent edit of clientID that can still be undone, see Undo.
+func (s *Session) undo(clientID string) []Element {
+	h := s.history(clientID)
+	return s.undoFrom(&h.done, &h.undone, clientID)
+}
+
+// Redoes the most recently undone edit of clientID, see Redo.
+func (s *Session) redo(clientID string) []Element {
+	h := s.history(clientID)
+	return s.undoFrom(&h.undone, &h.done, clientID)
+}
+
+// Replaces the characters in from with the characters in to, in order, in
+// the edits of every client. Text that is inserted again gets new IDs, and
+// older edits of that text should apply to the new characters.
+func (s *Session) remap(from []charRange, to []charRange) {
+	ids := make(map[ElementID]ElementID)
+	toIDs := chars(to)
+	for i, id := range chars(from) {
+		if i < len(toIDs) {
+			ids[id] = toIDs[i]
+		}
+	}
+
+	remapEdits := func(edits []edit) {
+		for i := range edits {
+			parts := make([]charRange, 0, len(edits[i].parts))
+			for _, id := range chars(edits[i].parts) {
+				if newID, ok := ids[id]; ok {
+					id = newID
+				}
+
+				if n := len(parts); n > 0 && parts[n-1].id.Replica == id.Replica &&
+					parts[n-1].id.Counter+parts[n-1].n == id.Counter {
+					parts[n-1].n++
+				} else {
+					parts = append(parts, charRange{id, 1})
+				}
+			}
+			edits[i].parts = parts
+		}
+	}
+
+	for _, h := range s.histories {
+		remapEdits(h.done)
+		remapEdits(h.undone)
+	}
+}
+
+func (s *Session) history(clientID string) *history {
+	if s.histories == nil {
+		s.histories = make(map[string]*history)
+	}
+
+	h := s.histories[clientID]
+	if h == nil {
+		h = new(history)
+		s.histories[clientID] = h
+	}
+
+	return h
+}
+
+func (h *history) push(_edit edit) {
+	if len(h.done) >= MAX_UNDO {
+		h.done = h.done[1:]
+	}
+
+	h.done = append(h.done, _edit)
+}
+
+// Returns the IDs of every character in the ranges, in order.
+func chars(parts []charRange) []ElementID {
+	ids := make([]ElementID, 0)
+	for _, part := range parts {
+		for k := 0; k < part.n; k++ {
+			ids = append(ids, ElementID{Counter: part.id.Counter + k, Replica: part.id.Replica})
+		}
+	}
+
+	return ids
+}
+
+// Returns the parts of a range that haven't been deleted.
+func (s *Session) visibleParts(part charRange) []charRange {
+	parts := make([]charRange, 0)
+	for part.n > 0 {
+		element, k := s.find(part.id)
+		if element == nil {
+			break
+		}
+
+		n := element.span() - k
+		if n > part.n {
+			n = part.n
+		}
+		if !element.Deleted {
+			parts = append(parts, charRange{part.id, n})
+		}
+
+		part.id.Counter += n
+		part.n -= n
+	}
+
+	return parts
+}
+
+// Returns the text of a range of characters, deleted or not.
+func (s *Session) textOf(part charRange) string {
+	text := ""
+	for part.n > 0 {
+		element, k := s.find(part.id)
+		if element == nil {
+			break
+		}
+
+		runes := []rune(element.Text)
+		n := element.span() - k
+		if n > part.n {
+			n = part.n
+		}
+		if k+n <= len(runes) {
+			text += string(runes[k : k+n])
+		}
+
+		part.id.Counter += n
+		part.n -= n
+	}
+
+	return text
+}
+
+// Returns the ID of the character before the given one in the message,
+// including tombstones, or the zero ID if there is none.
+func (s *Session) prevCharID(id ElementID) ElementID {
+	element, k := s.find(id)
+	if element == nil {
+		return ElementID{}
+	} else if k > 0 {
+		return ElementID{Counter: id.Counter - 1, Replica: id.Replica}
+	}
+
+	return element.PrevID
+}
+
+// Returns the ID of the character after the given one in the message,
+// including tombstones, or the zero ID if there is none.
+func (s *Session) nextCharID(id ElementID) ElementID {
+	element, k := s.find(id)
+	if element == nil {
+		return ElementID{}
+	} else if k < element.span()-1 {
+		return ElementID{Counter: id.Counter + 1, Replica: id.Replica}
+	}
+
+	return element.NextID
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Undoes the most recent edit of clientID that can still be undone. Returns
+// the elements that were applied so they can be replicated, or nil if there
+// is nothing to undo.
+func (s *Session) Undo(clientID string) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.undo(clientID)
+}
+
+// Redoes the most recently undone edit of clientID. Returns the elements that
+// were applied so they can be replicated, or nil if there is nothing to redo.
+func (s *Session) Redo(clientID string) []Element {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.redo(clientID)
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,554 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Errors reported by Validate, one per structural violation.
+
+type MismatchedKeyError struct {
+	Key ElementID
+	ID  ElementID
+}
+
+func (e MismatchedKeyError) Error() string {
+	return fmt.Sprintf("Element [%s] is stored under key [%s]", e.ID, e.Key)
+}
+
+type MissingHeadError ElementID
+
+func (e MissingHeadError) Error() string {
+	return fmt.Sprintf("Head [%s] is not in the CRDT", ElementID(e))
+}
+
+type HeadPrevIDError ElementID
+
+func (e HeadPrevIDError) Error() string {
+	return fmt.Sprintf("Head has PrevID [%s]", ElementID(e))
+}
+
+type BrokenLinkError struct {
+	ID     ElementID
+	NextID ElementID
+}
+
+func (e BrokenLinkError) Error() string {
+	return fmt.Sprintf("Element [%s] has NextID [%s] which is not in the CRDT", e.ID, e.NextID)
+}
+
+type BackLinkError struct {
+	ID     ElementID
+	PrevID ElementID
+	Want   ElementID
+}
+
+func (e BackLinkError) Error() string {
+	return fmt.Sprintf("Element [%s] has PrevID [%s] but follows [%s]", e.ID, e.PrevID, e.Want)
+}
+
+type CycleError struct {
+	ID     ElementID
+	NextID ElementID
+}
+
+func (e CycleError) Error() string {
+	return fmt.Sprintf("Element [%s] has NextID [%s] which is earlier in the message", e.ID, e.NextID)
+}
+
+type OrphanError ElementID
+
+func (e OrphanError) Error() string {
+	return fmt.Sprintf("Element [%s] can't be reached from head", ElementID(e))
+}
+
+type OverlapError struct {
+	ID    ElementID
+	Other ElementID
+}
+
+func (e OverlapError) Error() string {
+	return fmt.Sprintf("Run [%s] overlaps element [%s]", e.ID, e.Other)
+}
+
+type MisplacedElementError struct {
+	ID       ElementID
+	Document string
+}
+
+func (e MisplacedElementError) Error() string {
+	return fmt.Sprintf("Element [%s] of document [%s] is in the wrong document", e.ID, e.Document)
+}
+
+type MismatchedAnnotationError struct {
+	Key ElementID
+	ID  ElementID
+}
+
+func (e MismatchedAnnotationError) Error() string {
+	return fmt.Sprintf("Annotation [%s] is stored under key [%s]", e.ID, e.Key)
+}
+
+type FileNameError struct {
+	Document string
+	Name     string
+}
+
+func (e FileNameError) Error() string {
+	return fmt.Sprintf("File of document [%s] has invalid name [%s]", e.Document, e.Name)
+}
+
+// A violation in a document other than the main one
+type DocumentError struct {
+	Document string
+	Err      error
+}
+
+func (e DocumentError) Error() string {
+	return fmt.Sprintf("Document [%s]: %s", e.Document, e.Err.Error())
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the elements reachable from head in order, stopping at the first
+// missing or repeated element.
+func (s *Session) chain() []*Element {
+	elements := make([]*Element, 0, len(s.CRDT))
+	visited := make(map[*Element]bool)
+
+	element := s.CRDT[s.Head]
+	for element != nil && !visited[element] {
+		visited[element] = true
+		elements = append(elements, element)
+
+		element = s.CRDT[element.NextID]
+	}
+
+	return elements
+}
+
+// Links the elements into a message in the given order.
+func (s *Session) relink(elements []*Element) {
+	s.Head = ElementID{}
+
+	var prevElement *Element
+	for _, element := range elements {
+		if prevElement == nil {
+			s.Head = element.ID
+			element.PrevID = ElementID{}
+		} else {
+			prevElement.NextID = element.ID
+			element.PrevID = prevElement.lastID()
+		}
+
+		element.NextID = ElementID{}
+		prevElement = element
+	}
+}
+
+// Checks the structure of the CRDT of a document, see Validate.
+func (s *Session) validateCRDT() []error {
+	errors := make([]error, 0)
+
+	ids := s.sortedIDs()
+	for _, key := range ids {
+		element := s.CRDT[key]
+		if element.ID != key {
+			errors = append(errors, MismatchedKeyError{key, element.ID})
+			continue
+		}
+
+		for k := 1; k < element.span(); k++ {
+			id := ElementID{Counter: element.ID.Counter + k, Replica: element.ID.Replica}
+			if _, ok := s.CRDT[id]; ok {
+				errors = append(errors, OverlapError{element.ID, id})
+			}
+		}
+	}
+
+	if len(s.CRDT) == 0 {
+		if !s.Head.IsZero() {
+			errors = append(errors, MissingHeadError(s.Head))
+		}
+		return errors
+	}
+
+	head := s.CRDT[s.Head]
+	if head == nil {
+		errors = append(errors, MissingHeadError(s.Head))
+	} else if !head.PrevID.IsZero() {
+		errors = append(errors, HeadPrevIDError(head.PrevID))
+	}
+
+	chain := s.chain()
+	reached := make(map[*Element]bool)
+	for i, element := range chain {
+		reached[element] = true
+
+		if i > 0 && element.PrevID != chain[i-1].lastID() {
+			errors = append(errors, BackLinkError{element.ID, element.PrevID, chain[i-1].lastID()})
+		}
+	}
+
+	if len(chain) > 0 {
+		last := chain[len(chain)-1]
+		if next, ok := s.CRDT[last.NextID]; ok && reached[next] {
+			errors = append(errors, CycleError{last.ID, last.NextID})
+		} else if !last.NextID.IsZero() && !ok {
+			errors = append(errors, BrokenLinkError{last.ID, last.NextID})
+		}
+	}
+
+	for _, key := range ids {
+		if element := s.CRDT[key]; !reached[element] {
+			errors = append(errors, OrphanError(key))
+		}
+	}
+
+	return errors
+}
+
+// Checks the structure of the session and of every document, see Validate.
+// The session must be locked.
+func (s *Session) validate() []error {
+	errors := s.validateCRDT()
+	for _, id := range s.sortedDocuments() {
+		for _, err := range s.documentFor(id).validateCRDT() {
+			errors = append(errors, DocumentError{id, err})
+		}
+	}
+
+	for _, id := range append([]string{""}, s.sortedDocuments()...) {
+		document := s.documentFor(id)
+		for _, key := range document.sortedIDs() {
+			if element := document.CRDT[key]; element.Document != id {
+				errors = append(errors, MisplacedElementError{element.ID, element.Document})
+			}
+		}
+	}
+
+	for _, key := range s.sortedAnnotations() {
+		if annotation := s.Annotations[key]; annotation.ID != key {
+			errors = append(errors, MismatchedAnnotationError{key, annotation.ID})
+		}
+	}
+
+	for _, id := range s.sortedFiles() {
+		if file := s.Files[id]; !file.Deleted && !ValidFileName(file.Name) {
+			errors = append(errors, FileNameError{id, file.Name})
+		}
+	}
+
+	if len(errors) == 0 {
+		return nil
+	}
+
+	return errors
+}
+
+// Rebuilds a consistent message from the CRDT of a document, see Repair.
+func (s *Session) repairCRDT() {
+
+	// Rekey elements, keeping the element stored under its own ID if two
+	// claim the same one
+	ids := s.sortedIDs()
+	crdt := make(map[ElementID]*Element, len(s.CRDT))
+	for _, key := range ids {
+		if element := s.CRDT[key]; element.ID == key {
+			crdt[key] = element
+		}
+	}
+	for _, key := range ids {
+		if element := s.CRDT[key]; element.ID != key && crdt[element.ID] == nil {
+			crdt[element.ID] = element
+		}
+	}
+	s.CRDT = crdt
+
+	ids = s.sortedIDs()
+	for _, id := range ids {
+		element := s.CRDT[id]
+		for k := 1; k < element.span(); k++ {
+			if _, ok := s.CRDT[ElementID{Counter: id.Counter + k, Replica: id.Replica}]; ok {
+				element.Text = string([]rune(element.Text)[:k])
+				break
+			}
+		}
+	}
+
+	order := s.chain()
+	placed := make(map[*Element]bool)
+	for _, element := range order {
+		placed[element] = true
+	}
+
+	// Unreached elements form chains of their own. A chain starts at an
+	// element no other unreached element links to.
+	linked := make(map[*Element]bool)
+	for _, id := range ids {
+		if element := s.CRDT[id]; !placed[element] {
+			if next := s.CRDT[element.NextID]; next != nil && next != element {
+				linked[next] = true
+			}
+		}
+	}
+
+	chains := make([][]*Element, 0)
+	for _, id := range ids {
+		element := s.CRDT[id]
+		if placed[element] || linked[element] {
+			continue
+		}
+
+		chain := make([]*Element, 0)
+		for element != nil && !placed[element] {
+			placed[element] = true
+			chain = append(chain, element)
+			element = s.CRDT[element.NextID]
+		}
+		chains = append(chains, chain)
+	}
+
+	// Whatever is left is made up of cycles
+	for _, id := range ids {
+		if element := s.CRDT[id]; !placed[element] {
+			chain := make([]*Element, 0)
+			for element != nil && !placed[element] {
+				placed[element] = true
+				chain = append(chain, element)
+				element = s.CRDT[element.NextID]
+			}
+			chains = append(chains, chain)
+		}
+	}
+
+	// Place chains after the character they follow once it is in the
+	// message, until no more can be placed
+	progress := true
+	for progress && len(chains) > 0 {
+		progress = false
+
+		remaining := chains[:0]
+		for _, chain := range chains {
+			anchor, _ := s.find(chain[0].PrevID)
+
+			i := -1
+			for j, element := range order {
+				if element == anchor {
+					i = j
+					break
+				}
+			}
+
+			if i < 0 {
+				remaining = append(remaining, chain)
+				continue
+			}
+
+			// Splitting the anchor would break up a run that is in
+			// the right place, so the chain goes after the whole run
+			rest := append(chain, order[i+1:]...)
+			order = append(order[:i+1], rest...)
+			progress = true
+		}
+		chains = remaining
+	}
+
+	for _, chain := range chains {
+		order = append(order, chain...)
+	}
+
+	s.relink(order)
+	s.index = nil
+
+	for id := range s.Acks {
+		if _, ok := s.CRDT[id]; !ok {
+			delete(s.Acks, id)
+		}
+	}
+}
+
+// Moves the elements stored in the wrong document to the document they
+// belong to, where they are placed like any unreached element. An element
+// whose ID the document already has is dropped. The session must be locked.
+func (s *Session) moveMisplaced() {
+	for _, id := range append([]string{""}, s.sortedDocuments()...) {
+		document := s.documentFor(id)
+		for _, key := range document.sortedIDs() {
+			element := document.CRDT[key]
+			if element.Document == id {
+				continue
+			}
+
+			delete(document.CRDT, key)
+			delete(document.Acks, key)
+			if document.Head == key {
+				document.Head = element.NextID
+			}
+
+			target := s.documentFor(element.Document)
+			if _, ok := target.CRDT[element.ID]; !ok {
+				target.CRDT[element.ID] = element
+			}
+		}
+	}
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+/*
+Checks the structure of the session, returning every violation found in the
+main document and in every other document (see DocumentError): elements
+stored under the wrong key, runs overlapping other elements, a head that is
+missing or has a previous element, links to missing elements, PrevIDs that
+don't match the element before, cycles and elements that can't be reached
+from head. Also reports elements stored in the wrong document, annotations
+stored under the wrong key and files with invalid names. Returns nil if the
+session is consistent.
+*/
+func (s *Session) Validate() []error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.validate()
+}
+
+/*
+Rebuilds a consistent session from a corrupted one, returning the violations
+that were repaired (see Validate). The session is locked throughout, so
+nothing can change between finding the violations and repairing them.
+
+Elements stored in the wrong document are moved to theirs. In every document,
+elements are rekeyed by their ID and runs are cut short where they overlap
+another element. The message keeps every element reachable from head in its
+current order. Each chain of elements that can't be reached is then placed
+after the character its first element follows, or at the end of the message
+if that character is missing too, so no element is lost.
+
+Annotations are rekeyed by their ID, keeping the latest edit if two claim the
+same one, and files with invalid names are named after their document ID.
+*/
+func (s *Session) Repair() []error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	errors := s.validate()
+	if errors == nil {
+		return nil
+	}
+
+	s.moveMisplaced()
+	s.repairCRDT()
+	for _, document := range s.documents() {
+		document.repairCRDT()
+	}
+
+	for _, key := range s.sortedAnnotations() {
+		annotation := s.Annotations[key]
+		if annotation.ID == key {
+			continue
+		}
+
+		delete(s.Annotations, key)
+		if current := s.Annotations[annotation.ID]; current == nil || current.Edit.Less(annotation.Edit) {
+			s.Annotations[annotation.ID] = annotation
+		}
+	}
+
+	for _, id := range s.sortedFiles() {
+		if file := s.Files[id]; !file.Deleted && !ValidFileName(file.Name) {
+			file.Name = id
+		}
+	}
+
+	s.trackTombstones()
+
+	for _, document := range append([]*Session{s}, s.documents()...) {
+		for _, element := range document.CRDT {
+			if last := element.lastID(); last.Counter >= s.Next {
+				s.Next = last.Counter + 1
+			}
+		}
+	}
+
+	return errors
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+// Returns the keys of the CRDT in ID order so violations are reported and
+// repaired the same way every time.
+func (s *Session) sortedIDs() []ElementID {
+	ids := make([]ElementID, 0, len(s.CRDT))
+	for id := range s.CRDT {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Less(ids[j])
+	})
+
+	return ids
+}
+
+// Returns the IDs of the documents other than the main one, in order.
+func (s *Session) sortedDocuments() []string {
+	ids := make([]string, 0, len(s.Documents))
+	for id := range s.Documents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Returns the documents other than the main one, in order of ID.
+func (s *Session) documents() []*Session {
+	documents := make([]*Session, 0, len(s.Documents))
+	for _, id := range s.sortedDocuments() {
+		documents = append(documents, s.documentFor(id))
+	}
+
+	return documents
+}
+
+// Returns the keys of the annotations in ID order.
+func (s *Session) sortedAnnotations() []ElementID {
+	ids := make([]ElementID, 0, len(s.Annotations))
+	for id := range s.Annotations {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Less(ids[j])
+	})
+
+	return ids
+}
+
+// Returns the document IDs of the files, in order.
+func (s *Session) sortedFiles() []string {
+	ids := make([]string, 0, len(s.Files))
+	for id := range s.Files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
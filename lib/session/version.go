@@ -0,0 +1,473 @@
+package session
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+Every operation a session applies is appended to its Log, stamped with the
+replica that stamped it, its clock and the time it was applied. This lets a
+session report which operations it has seen as a version vector, and rebuild
+its state as of any earlier version or time by replaying the log.
+
+Operations are stamped by the first replica that applies them and keep their
+stamp as they are replicated, so every replica logs the same stamps. Each
+stamper numbers the operations it stamps consecutively, and a text operation
+takes one clock per character so its characters can still be told apart
+once it is split (see Chars). Replicas can apply operations out of order, eg.
+while one waits for its dependency, so a version vector lists the ranges of
+clocks applied rather than the latest one, and a replica that missed an
+operation never looks like it has it.
+
+Consecutive characters typed by the same client within LOG_MERGE_INTERVAL of
+each other share a log entry, the same way they share a run in the CRDT, as
+long as their clocks are consecutive too.
+
+The operations on characters that have been collected are dropped from the
+log once every replica has them, and only their clocks are kept, in
+Compacted, so the log doesn't grow with the session's history (see
+compactLog). The session's state before them can't be rebuilt any more, so
+snapshots only go back as far as the collected text.
+*/
+
+// Time in nanoseconds within which consecutive inserts share a log entry
+const LOG_MERGE_INTERVAL int64 = int64(time.Second)
+
+// The clocks From to To, inclusive.
+type ClockRange struct {
+	From int
+	To   int
+}
+
+// A VersionVector maps each replica that stamps operations to the clocks of
+// its operations that have been applied, as sorted ranges that don't overlap
+// or touch.
+type VersionVector map[string][]ClockRange
+
+// An operation applied to a session. Deleted is set on the element if the
+// operation is a delete.
+type Operation struct {
+	Element Element
+	Time    int64 // Unix time in nanoseconds when this replica applied it
+}
+
+// Whether the vector includes the operation of replica with the given clock.
+func (v VersionVector) Includes(replica string, clock int) bool {
+	return v.covers(replica, ClockRange{clock, clock})
+}
+
+func (v VersionVector) Copy() VersionVector {
+	copied := make(VersionVector, len(v))
+	for replica, ranges := range v {
+		copied[replica] = append([]ClockRange(nil), ranges...)
+	}
+
+	return copied
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns the index of the first of replica's ranges that ends at or after
+// clock.
+func (v VersionVector) search(replica string, clock int) int {
+	ranges := v[replica]
+	return sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].To >= clock
+	})
+}
+
+// Whether the vector includes every clock of replica in clocks.
+func (v VersionVector) covers(replica string, clocks ClockRange) bool {
+	ranges := v[replica]
+	i := v.search(replica, clocks.From)
+	return i < len(ranges) && ranges[i].From <= clocks.From && clocks.To <= ranges[i].To
+}
+
+// Whether the vector includes every clock of a stamped operation.
+func (v VersionVector) includes(element Element) bool {
+	return v.covers(element.stamper(), element.clockRange())
+}
+
+// Returns the clocks included in either vector.
+func (v VersionVector) union(other VersionVector) VersionVector {
+	either := v.Copy()
+	for replica, ranges := range other {
+		for _, clocks := range ranges {
+			either.add(replica, clocks)
+		}
+	}
+
+	return either
+}
+
+// Adds the clocks of replica in clocks to the vector, merging them with the
+// ranges they overlap or touch.
+func (v VersionVector) add(replica string, clocks ClockRange) {
+	ranges := v[replica]
+	i := v.search(replica, clocks.From-1)
+	if i == len(ranges) {
+		v[replica] = append(ranges, clocks)
+		return
+	}
+
+	j := i
+	for ; j < len(ranges) && ranges[j].From <= clocks.To+1; j++ {
+		if ranges[j].From < clocks.From {
+			clocks.From = ranges[j].From
+		}
+		if ranges[j].To > clocks.To {
+			clocks.To = ranges[j].To
+		}
+	}
+
+	added := make([]ClockRange, 0, len(ranges)-(j-i)+1)
+	added = append(append(append(added, ranges[:i]...), clocks), ranges[j:]...)
+	v[replica] = added
+}
+
+// Returns the clocks included in both vectors.
+func (v VersionVector) intersect(other VersionVector) VersionVector {
+	both := make(VersionVector)
+	for replica, ranges := range v {
+		others := other[replica]
+		for i, j := 0, 0; i < len(ranges) && j < len(others); {
+			from, to := ranges[i].From, ranges[i].To
+			if others[j].From > from {
+				from = others[j].From
+			}
+			if others[j].To < to {
+				to = others[j].To
+			}
+			if from <= to {
+				both[replica] = append(both[replica], ClockRange{from, to})
+			}
+
+			if ranges[i].To < others[j].To {
+				i++
+			} else {
+				j++
+			}
+		}
+	}
+
+	return both
+}
+
+// Returns the replica that stamped an operation. Operations logged before
+// stampers were recorded were stamped with their client's clock.
+func (e *Element) stamper() string {
+	if e.Stamper == "" {
+		return e.ClientID
+	}
+
+	return e.Stamper
+}
+
+// Returns the number of clocks an operation takes: one per character for
+// text, and one for file and annotation elements and operations logged
+// before stampers were recorded.
+func (e *Element) width() int {
+	if e.Stamper == "" || !e.isText() {
+		return 1
+	}
+
+	return e.span()
+}
+
+// Returns the clocks of a stamped operation. Its clock is the last of them.
+func (e *Element) clockRange() ClockRange {
+	return ClockRange{e.Clock - e.width() + 1, e.Clock}
+}
+
+// Stamps an operation with the session's stamper and the stamper's next
+// clocks, unless a replica it came through already stamped it, and advances
+// the stamper's clock past it. A session without a stamper (see SetReplica)
+// stamps operations as their client. Clocks start at 1, so that 0 means
+// unstamped.
+func (s *Session) stamp(element *Element) {
+	if s.parent != nil {
+		s.parent.stamp(element)
+		return
+	}
+
+	if s.clocks == nil {
+		s.clocks = make(map[string]int)
+		for stamper, ranges := range s.Compacted {
+			if n := len(ranges); n > 0 && ranges[n-1].To > s.clocks[stamper] {
+				s.clocks[stamper] = ranges[n-1].To
+			}
+		}
+		for _, op := range s.Log {
+			if stamper := op.Element.stamper(); op.Element.Clock > s.clocks[stamper] {
+				s.clocks[stamper] = op.Element.Clock
+			}
+		}
+	}
+
+	if element.Clock == 0 {
+		element.Stamper = s.stamper
+		if element.Stamper == "" {
+			element.Stamper = element.ClientID
+		}
+		element.Clock = s.clocks[element.Stamper] + element.width()
+	}
+
+	if stamper := element.stamper(); element.Clock > s.clocks[stamper] {
+		s.clocks[stamper] = element.Clock
+	}
+}
+
+// Appends an applied operation to the log of the session, which documents
+// share.
+func (s *Session) appendLog(element Element) {
+	if s.parent != nil {
+		s.parent.appendLog(element)
+		return
+	}
+
+	now := time.Now().UnixNano()
+	element.NextID = ElementID{}
+	if element.Deleted && element.isText() && s.deleters != nil {
+		s.trackDeleter(element)
+	}
+	if element.Deleted && element.isText() && s.deletes != nil {
+		s.deletes = append(s.deletes, element)
+	}
+	if s.applied != nil {
+		s.applied.add(element.stamper(), element.clockRange())
+	}
+
+	if n := len(s.Log); n > 0 && !element.Deleted {
+		last := &s.Log[n-1].Element
+		if !last.Deleted && last.isText() && element.isText() && last.Document == element.Document && last.ClientID == element.ClientID &&
+			last.Stamper != "" && last.Stamper == element.Stamper && last.Clock+element.span() == element.Clock &&
+			last.ID.Counter >= 0 && last.ID.Replica == element.ID.Replica &&
+			last.lastID() == element.PrevID && last.lastID().Counter+1 == element.ID.Counter &&
+			last.span()+element.span() <= MAX_RUN && now-s.Log[n-1].Time < LOG_MERGE_INTERVAL {
+			last.Text += element.Text
+			last.Clock = element.Clock
+			return
+		}
+	}
+
+	s.Log = append(s.Log, Operation{element, now})
+}
+
+// Appends a stamped operation that changed nothing, eg. a delete of
+// characters another delete already removed, to the log unless the log
+// already has it. Every replica logs each operation once, whether or not it
+// changed anything there, so replicas that applied the same operations have
+// the same version.
+func (s *Session) logOnce(element Element) {
+	if s.parent != nil {
+		s.parent.logOnce(element)
+		return
+	}
+
+	if element.Clock == 0 {
+		return
+	}
+
+	// Only kept up to date while the session is locked for writing, so that
+	// readers don't race to build it
+	if s.applied == nil {
+		s.applied = s.versionAt(math.MaxInt64)
+	}
+	if !s.applied.includes(element) {
+		s.appendLog(element)
+	}
+}
+
+// Starts the log of a session that doesn't have one, eg. a session saved
+// before operations were logged, with the operations that would build its
+// current state. Their time is unknown, so it is left at zero.
+func (s *Session) startLog() {
+	if len(s.Log) > 0 || len(s.Compacted) > 0 {
+		return
+	}
+
+	deletes := make([]Operation, 0)
+	var prevID ElementID
+	for _, element := range s.chain() {
+		inserted := *element
+		inserted.PrevID = prevID
+		inserted.NextID = ElementID{}
+		inserted.Deleted = false
+		inserted.Clock = 0
+		s.stamp(&inserted)
+		s.Log = append(s.Log, Operation{Element: inserted})
+
+		if element.Deleted {
+			deleted := inserted
+			deleted.Deleted = true
+			deletes = append(deletes, Operation{Element: deleted})
+		}
+
+		prevID = element.lastID()
+	}
+
+	for i := range deletes {
+		deletes[i].Element.Clock = 0
+		s.stamp(&deletes[i].Element)
+	}
+	s.Log = append(s.Log, deletes...)
+}
+
+/*
+Drops from the log the operations whose characters have all been collected,
+adding their clocks to Compacted so the session's version still includes
+them. Only operations included in stable, the version every replica has
+applied, are dropped or changed, so that no replica can still need them.
+
+Inserts after a collected character are moved after the character it is
+anchored to (see anchor), so the log can still be replayed once the
+operations on the collected character are dropped. An insert that isn't in
+stable yet keeps the collected character it follows in the log until it is.
+*/
+func (s *Session) compactLog(stable VersionVector) {
+	needed := make(map[ElementID]bool)
+	for i := range s.Log {
+		element := &s.Log[i].Element
+		if element.Deleted || !element.isText() || element.PrevID.IsZero() {
+			continue
+		}
+
+		document := s.documentFor(element.Document)
+		if !stable.includes(*element) {
+			needed[element.PrevID] = true
+		} else if document.collectedFrom(element.PrevID) > 0 {
+			element.PrevID = document.anchor(element.PrevID)
+		}
+	}
+
+	log := s.Log[:0]
+	for _, op := range s.Log {
+		if op.Element.isText() && stable.includes(op.Element) && s.compactable(op.Element, needed) {
+			if s.Compacted == nil {
+				s.Compacted = make(VersionVector)
+			}
+			s.Compacted.add(op.Element.stamper(), op.Element.clockRange())
+			continue
+		}
+
+		log = append(log, op)
+	}
+
+	// The dropped operations are cleared so they can be freed
+	for i := len(log); i < len(s.Log); i++ {
+		s.Log[i] = Operation{}
+	}
+	s.Log = log
+}
+
+// Whether every character of a text operation has been collected, and isn't
+// followed by an insert in needed.
+func (s *Session) compactable(element Element, needed map[ElementID]bool) bool {
+	document := s.documentFor(element.Document)
+	for _, char := range element.Chars() {
+		if needed[char.ID] || document.collectedFrom(char.ID) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Builds a new session by replaying the operations in the log that satisfy
+// include, in the order they were applied.
+func (s *Session) replay(include func(op Operation) bool) *Session {
+	session := &Session{
+		ID:   s.ID,
+		CRDT: make(map[ElementID]*Element)}
+
+	log := make([]Operation, 0)
+	for _, op := range s.Log {
+		if include(op) {
+			session.apply(op.Element, op.Element.Deleted)
+			log = append(log, op)
+		}
+	}
+
+	session.Log = log
+	session.Compacted = s.Compacted.Copy()
+	session.histories = nil
+	session.clocks = nil
+	session.applied = nil
+
+	return session
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Returns the version vector of the operations the session has applied.
+func (s *Session) Version() VersionVector {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.version()
+}
+
+// Returns the version vector of the operations the session had applied at
+// the given time.
+func (s *Session) VersionAt(t time.Time) VersionVector {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.versionAt(t.UnixNano())
+}
+
+func (s *Session) version() VersionVector {
+	if s.applied != nil {
+		return s.applied.Copy()
+	}
+
+	return s.versionAt(math.MaxInt64)
+}
+
+// Compacted operations are included whatever their time, which is no longer
+// known.
+func (s *Session) versionAt(t int64) VersionVector {
+	version := s.Compacted.Copy()
+	for _, op := range s.Log {
+		if op.Time > t {
+			continue
+		}
+
+		version.add(op.Element.stamper(), op.Element.clockRange())
+	}
+
+	return version
+}
+
+// Returns a copy of the session with only the operations included in the
+// given version applied.
+func (s *Session) SnapshotAt(version VersionVector) *Session {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.replay(func(op Operation) bool {
+		return version.includes(op.Element)
+	})
+}
+
+// Returns the text of the session as it was at the given time.
+func (s *Session) TextAt(t time.Time) string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.replay(func(op Operation) bool {
+		return op.Time <= t.UnixNano()
+	}).Text()
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
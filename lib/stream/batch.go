@@ -0,0 +1,194 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+
+	. "../session"
+)
+
+/*
+Elements are replicated in batches. A batch holds elements of one session that
+originated on one worker, and is numbered by that worker in the order it
+created the session's batches, starting from 1. A worker relays every batch it
+hasn't seen before to the workers it routes the session to, so the origin and
+number of a batch are enough to tell it has been seen, without looking at its
+elements.
+
+Only the workers that host a session, or lead to one that does, are sent its
+batches, so a worker sees the batches of each origin for each session rather
+than every batch of an origin. Batches are tracked by Source for that reason.
+
+Seen keeps, for every source, the number up to which every batch has been
+seen, and the batches seen out of order above it. A worker that starts hosting
+a session late, or relaying it, never sees the batches before it did, so the
+number starts right below the first batch it sees of the source, unless it
+was synced from the worker it got the session from (see Advance). The session
+it loaded has the edits of the batches before, and any it missed are caught
+up by syncing the session. Only the latest SEEN_WINDOW or so batches are kept
+above the number: forgetting one only means it is applied again, which
+sessions ignore.
+*/
+
+// Number of batches of a source kept above the contiguous ones
+const SEEN_WINDOW int = 4096
+
+type Source struct {
+	Origin    string
+	SessionID string
+}
+
+type Batch struct {
+	Origin    string
+	SessionID string
+	Seq       uint64
+	Elements  []Element
+}
+
+type Seen struct {
+	sources map[Source]*seenSource
+	mux     sync.Mutex
+}
+
+type seenSource struct {
+	contiguous uint64
+	above      map[uint64]bool
+}
+
+func (b Batch) Source() Source {
+	return Source{Origin: b.Origin, SessionID: b.SessionID}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Returns what has been seen of a source, starting it at contiguous if it
+// hasn't been seen before.
+func (s *Seen) source(source Source, contiguous uint64) *seenSource {
+	seen := s.sources[source]
+	if seen == nil {
+		seen = &seenSource{contiguous: contiguous, above: make(map[uint64]bool)}
+		s.sources[source] = seen
+	}
+
+	return seen
+}
+
+// Moves contiguous up past the batches seen right above it.
+func (seen *seenSource) advance() {
+	for seen.above[seen.contiguous+1] {
+		delete(seen.above, seen.contiguous+1)
+		seen.contiguous++
+	}
+}
+
+// Forgets the lowest batches above contiguous once there are a quarter more
+// than SEEN_WINDOW, so they are only sorted every so often.
+func (seen *seenSource) trim() {
+	if len(seen.above) <= SEEN_WINDOW+SEEN_WINDOW/4 {
+		return
+	}
+
+	seqs := make([]uint64, 0, len(seen.above))
+	for seq := range seen.above {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	for _, seq := range seqs[:len(seqs)-SEEN_WINDOW] {
+		delete(seen.above, seq)
+	}
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+func NewSeen() *Seen {
+	return &Seen{sources: make(map[Source]*seenSource)}
+}
+
+// Records that a batch has been seen. Returns false if it had been already.
+// The first batch seen of a source is taken to follow every batch before it.
+func (s *Seen) Add(source Source, seq uint64) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	first := seq
+	if first > 0 {
+		first--
+	}
+	seen := s.source(source, first)
+	if seq <= seen.contiguous || seen.above[seq] {
+		return false
+	}
+
+	seen.above[seq] = true
+	seen.advance()
+	seen.trim()
+
+	return true
+}
+
+// Records that every batch up to the number in vector has been seen, for
+// each source in vector.
+func (s *Seen) Advance(vector map[Source]uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for source, contiguous := range vector {
+		seen := s.source(source, 0)
+		if contiguous <= seen.contiguous {
+			continue
+		}
+
+		for seq := range seen.above {
+			if seq <= contiguous {
+				delete(seen.above, seq)
+			}
+		}
+		seen.contiguous = contiguous
+		seen.advance()
+	}
+}
+
+// Returns the number up to which every batch has been seen, for the given
+// sources.
+func (s *Seen) Vector(sources ...Source) map[Source]uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	vector := make(map[Source]uint64, len(sources))
+	for _, source := range sources {
+		if seen := s.sources[source]; seen != nil {
+			vector[source] = seen.contiguous
+		}
+	}
+
+	return vector
+}
+
+// Returns the number up to which every batch has been seen, for every source
+// of a session.
+func (s *Seen) SessionVector(sessionID string) map[Source]uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	vector := make(map[Source]uint64)
+	for source, seen := range s.sources {
+		if source.SessionID == sessionID {
+			vector[source] = seen.contiguous
+		}
+	}
+
+	return vector
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
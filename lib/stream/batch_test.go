@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"testing"
+)
+
+func TestSeenAdd(t *testing.T) {
+	source := Source{Origin: "a", SessionID: "s"}
+	tests := []struct {
+		name       string
+		synced     uint64 // Advanced to first, unless 0
+		seqs       []uint64
+		added      []bool
+		contiguous uint64
+	}{
+		{"in order", 0, []uint64{1, 2, 3}, []bool{true, true, true}, 3},
+		{"duplicates", 0, []uint64{1, 2, 2, 1}, []bool{true, true, false, false}, 2},
+		{"out of order", 0, []uint64{1, 3, 4, 2}, []bool{true, true, true, true}, 4},
+		{"duplicate above contiguous", 0, []uint64{1, 3, 3}, []bool{true, true, false}, 1},
+		{"late join", 0, []uint64{500, 501, 503}, []bool{true, true, true}, 501},
+		{"late join seen again", 0, []uint64{500, 500, 499}, []bool{true, false, false}, 500},
+		{"synced", 10, []uint64{11, 10, 12}, []bool{true, false, true}, 12},
+		{"synced with gap", 10, []uint64{13, 11}, []bool{true, true}, 11},
+	}
+
+	for _, test := range tests {
+		seen := NewSeen()
+		if test.synced > 0 {
+			seen.Advance(map[Source]uint64{source: test.synced})
+		}
+
+		for i, seq := range test.seqs {
+			if added := seen.Add(source, seq); added != test.added[i] {
+				t.Errorf("%s: Add(%d) = %v, want %v", test.name, seq, added, test.added[i])
+			}
+		}
+		if contiguous := seen.Vector(source)[source]; contiguous != test.contiguous {
+			t.Errorf("%s: contiguous = %d, want %d", test.name, contiguous, test.contiguous)
+		}
+	}
+}
+
+func TestSeenAdvance(t *testing.T) {
+	source := Source{Origin: "a", SessionID: "s"}
+	seen := NewSeen()
+	for _, seq := range []uint64{1, 3, 5, 6} {
+		seen.Add(source, seq)
+	}
+
+	seen.Advance(map[Source]uint64{source: 4})
+	if contiguous := seen.Vector(source)[source]; contiguous != 6 {
+		t.Errorf("contiguous = %d after advancing past the gap, want 6", contiguous)
+	}
+
+	seen.Advance(map[Source]uint64{source: 2})
+	if contiguous := seen.Vector(source)[source]; contiguous != 6 {
+		t.Errorf("contiguous = %d after advancing to a lower number, want 6", contiguous)
+	}
+	if seen.Add(source, 5) {
+		t.Errorf("Add(5) = true after advancing past it")
+	}
+}
+
+func TestSeenTrim(t *testing.T) {
+	source := Source{Origin: "a", SessionID: "s"}
+	seen := NewSeen()
+	seen.Add(source, 1)
+
+	// Every batch above 2 is seen, without 2, so none is contiguous
+	last := uint64(2 + SEEN_WINDOW + SEEN_WINDOW/4 + 1)
+	for seq := uint64(3); seq <= last; seq++ {
+		if !seen.Add(source, seq) {
+			t.Fatalf("Add(%d) = false the first time", seq)
+		}
+	}
+
+	above := len(seen.sources[source].above)
+	if above > SEEN_WINDOW+SEEN_WINDOW/4 {
+		t.Errorf("%d batches kept above contiguous, want at most %d", above, SEEN_WINDOW+SEEN_WINDOW/4)
+	}
+	if seen.Add(source, last) {
+		t.Errorf("Add(%d) = true for the latest batch after trimming", last)
+	}
+	if !seen.Add(source, 3) {
+		t.Errorf("Add(3) = false for a batch trimmed away")
+	}
+	if contiguous := seen.Vector(source)[source]; contiguous != 1 {
+		t.Errorf("contiguous = %d, want 1", contiguous)
+	}
+
+	if !seen.Add(source, 2) {
+		t.Errorf("Add(2) = false for the missing batch")
+	}
+	if contiguous := seen.Vector(source)[source]; contiguous != 3 {
+		t.Errorf("contiguous = %d after the missing batch, want 3", contiguous)
+	}
+}
+
+func TestSeenSessionVector(t *testing.T) {
+	seen := NewSeen()
+	seen.Add(Source{Origin: "a", SessionID: "s"}, 1)
+	seen.Add(Source{Origin: "b", SessionID: "s"}, 7)
+	seen.Add(Source{Origin: "a", SessionID: "t"}, 1)
+
+	vector := seen.SessionVector("s")
+	want := map[Source]uint64{{Origin: "a", SessionID: "s"}: 1, {Origin: "b", SessionID: "s"}: 7}
+	if len(vector) != len(want) {
+		t.Fatalf("SessionVector = %v, want %v", vector, want)
+	}
+	for source, contiguous := range want {
+		if vector[source] != contiguous {
+			t.Errorf("SessionVector = %v, want %v", vector, want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+A stream replicates batches of elements to one peer. Batches pushed to the
+stream are queued and sent by the stream's own goroutine as soon as it is free,
+so a slow peer only delays its own stream. The goroutine micro-batches: once a
+batch arrives it waits up to BatchDelay for more, and sends the batches in one
+call, up to BatchSize elements unless a single batch is larger.
+
+The queue is bounded by QueueSize. Pushing to a full queue doesn't block, the
+push is refused and counted as an overflow, so the caller learns the peer
+isn't keeping up and decides what to do about it. A stream is backpressured
+while its queue is at least HIGH_WATER full.
+
+A call that fails is retried every RetryDelay, along with whatever queued up
+meanwhile, until the stream is closed. Batches are delivered in the order they
+were pushed, so Delivered always counts a prefix of Pushed.
+*/
+
+// Default number of batches a stream queues before refusing pushes
+const QUEUE_SIZE int = 1024
+
+// Default largest number of elements sent in one call
+const BATCH_SIZE int = 30
+
+// Default time to wait for more batches before sending a call
+const BATCH_DELAY time.Duration = 10 * time.Millisecond
+
+// Default time to wait before sending a failed call again
+const RETRY_DELAY time.Duration = 500 * time.Millisecond
+
+// Fraction of the queue above which a stream is backpressured
+const HIGH_WATER float64 = 0.75
+
+type StreamSettings struct {
+	QueueSize  int
+	BatchSize  int
+	BatchDelay time.Duration
+	RetryDelay time.Duration
+}
+
+// Counters of a stream. Pushed and Delivered count batches, Calls and
+// Failures the calls that sent them, and Overflows pushes that were refused.
+// Lag is how long the oldest batch not yet delivered has waited, and Latency
+// how long the last call took.
+type StreamStats struct {
+	Queued        int
+	Pushed        uint64
+	Delivered     uint64
+	Calls         uint64
+	Failures      uint64
+	Overflows     uint64
+	Backpressured bool
+	Lag           time.Duration
+	Latency       time.Duration
+}
+
+type Stream struct {
+	send      func(batches []Batch) error
+	delivered func(batches []Batch)
+	settings  StreamSettings
+	queue     chan entry
+	done      chan struct{}
+	closed    bool
+	stats     StreamStats
+	oldest    time.Time // When the oldest batch being sent was pushed
+	mux       sync.Mutex
+}
+
+// A queued batch and when it was pushed
+type entry struct {
+	batch  Batch
+	pushed time.Time
+}
+
+func DefaultStreamSettings() StreamSettings {
+	return StreamSettings{
+		QueueSize:  QUEUE_SIZE,
+		BatchSize:  BATCH_SIZE,
+		BatchDelay: BATCH_DELAY,
+		RetryDelay: RETRY_DELAY}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Sends batches until the stream is closed.
+func (s *Stream) run() {
+	var call []entry
+	var next *entry // Batch that didn't fit in the last call
+	for {
+		// A closed stream drops what is queued, even when more is ready
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		if len(call) == 0 {
+			if next != nil {
+				call = append(call, *next)
+				next = nil
+			} else {
+				select {
+				case _entry := <-s.queue:
+					call = append(call, _entry)
+				case <-s.done:
+					return
+				}
+			}
+
+			s.mux.Lock()
+			s.oldest = call[0].pushed
+			s.mux.Unlock()
+
+			call, next = s.fill(call, time.After(s.settings.BatchDelay))
+		} else if next == nil {
+			call, next = s.fill(call, nil)
+		}
+
+		batches := make([]Batch, len(call))
+		for i, _entry := range call {
+			batches[i] = _entry.batch
+		}
+
+		start := time.Now()
+		err := s.send(batches)
+
+		s.mux.Lock()
+		if err != nil {
+			s.stats.Failures++
+		} else {
+			s.stats.Delivered += uint64(len(batches))
+			s.stats.Calls++
+			s.stats.Latency = time.Since(start)
+			s.oldest = time.Time{}
+		}
+		s.mux.Unlock()
+
+		if err != nil {
+			select {
+			case <-time.After(s.settings.RetryDelay):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+
+		call = nil
+		if s.delivered != nil {
+			s.delivered(batches)
+		}
+	}
+}
+
+// Adds queued batches to a call until it has BatchSize elements. Waits for
+// more batches until timeout fires, or takes only the queued ones if timeout
+// is nil. Returns the call, and the batch that didn't fit in it if any.
+func (s *Stream) fill(call []entry, timeout <-chan time.Time) ([]entry, *entry) {
+	size := 0
+	for _, _entry := range call {
+		size += len(_entry.batch.Elements)
+	}
+
+	for size < s.settings.BatchSize {
+		var _entry entry
+		if timeout == nil {
+			select {
+			case _entry = <-s.queue:
+			default:
+				return call, nil
+			}
+		} else {
+			select {
+			case _entry = <-s.queue:
+			case <-timeout:
+				return call, nil
+			case <-s.done:
+				return call, nil
+			}
+		}
+
+		if size+len(_entry.batch.Elements) > s.settings.BatchSize {
+			return call, &_entry
+		}
+		call = append(call, _entry)
+		size += len(_entry.batch.Elements)
+	}
+
+	return call, nil
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Starts a stream that sends batches with send. If delivered isn't nil it is
+// called with the batches of every call that succeeded, in order.
+func NewStream(settings StreamSettings, send func(batches []Batch) error, delivered func(batches []Batch)) *Stream {
+	if settings.QueueSize <= 0 {
+		settings.QueueSize = QUEUE_SIZE
+	}
+	if settings.BatchSize <= 0 {
+		settings.BatchSize = BATCH_SIZE
+	}
+
+	s := &Stream{
+		send:      send,
+		delivered: delivered,
+		settings:  settings,
+		queue:     make(chan entry, settings.QueueSize),
+		done:      make(chan struct{})}
+	go s.run()
+
+	return s
+}
+
+// Queues batches to be sent. Returns false if the queue is full or the
+// stream is closed, in which case the batches from the first that didn't fit
+// on weren't queued.
+func (s *Stream) Push(batches ...Batch) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	now := time.Now()
+	for _, batch := range batches {
+		select {
+		case s.queue <- entry{batch: batch, pushed: now}:
+			s.stats.Pushed++
+		default:
+			s.stats.Overflows++
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the number of batches pushed to the stream and how many of them
+// have been delivered.
+func (s *Stream) Progress() (uint64, uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.stats.Pushed, s.stats.Delivered
+}
+
+func (s *Stream) Stats() StreamStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := s.stats
+	stats.Queued = int(stats.Pushed - stats.Delivered)
+	stats.Backpressured = float64(len(s.queue)) >= HIGH_WATER*float64(s.settings.QueueSize)
+	if !s.oldest.IsZero() {
+		stats.Lag = time.Since(s.oldest)
+	}
+
+	return stats
+}
+
+func (s *Stream) Closed() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.closed
+}
+
+// Stops the stream. Batches that weren't delivered are dropped.
+func (s *Stream) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,230 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "../session"
+)
+
+// How long to wait for a stream's goroutine before failing
+const TEST_TIMEOUT time.Duration = 5 * time.Second
+
+func TestStreamBackpressure(t *testing.T) {
+	tests := []struct {
+		name          string
+		pushes        int
+		accepted      int
+		backpressured bool
+	}{
+		{"empty", 0, 0, false},
+		{"below high water", 5, 5, false},
+		{"at high water", 6, 6, true},
+		{"full", 8, 8, true},
+		{"overflowing", 11, 8, true},
+	}
+
+	for _, test := range tests {
+		// The first batch is taken off the queue and its call blocks, so
+		// the batches pushed after stay queued
+		release := make(chan struct{})
+		sending := make(chan struct{}, 1)
+		s := NewStream(testSettings(8, 1), func(batches []Batch) error {
+			select {
+			case sending <- struct{}{}:
+			default:
+			}
+			<-release
+			return nil
+		}, nil)
+
+		s.Push(testBatch(0))
+		waitFor(t, sending)
+
+		accepted := 0
+		for i := 1; i <= test.pushes; i++ {
+			if s.Push(testBatch(uint64(i))) {
+				accepted++
+			}
+		}
+
+		stats := s.Stats()
+		if accepted != test.accepted {
+			t.Errorf("%s: %d pushes accepted, want %d", test.name, accepted, test.accepted)
+		}
+		if stats.Overflows != uint64(test.pushes-test.accepted) {
+			t.Errorf("%s: %d overflows, want %d", test.name, stats.Overflows, test.pushes-test.accepted)
+		}
+		if stats.Backpressured != test.backpressured {
+			t.Errorf("%s: backpressured = %v, want %v", test.name, stats.Backpressured, test.backpressured)
+		}
+		if stats.Queued != test.accepted+1 {
+			t.Errorf("%s: %d batches queued, want %d", test.name, stats.Queued, test.accepted+1)
+		}
+
+		s.Close()
+		close(release)
+	}
+}
+
+func TestStreamDelivery(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		sizes     []int // Elements in each batch pushed
+		failures  int   // Calls that fail before the others succeed
+		maxCall   int   // Most elements expected in a call
+	}{
+		{"one per call", 1, []int{1, 1, 1, 1}, 0, 1},
+		{"micro-batched", 3, []int{1, 1, 1, 1, 1, 1, 1}, 0, 3},
+		{"batch larger than a call", 3, []int{1, 5, 1}, 0, 5},
+		{"retried", 3, []int{1, 1, 1, 1}, 2, 3},
+	}
+
+	for _, test := range tests {
+		var mux sync.Mutex
+		failures := test.failures
+		var delivered []uint64
+		done := make(chan struct{})
+
+		send := func(batches []Batch) error {
+			mux.Lock()
+			defer mux.Unlock()
+
+			size := 0
+			for _, batch := range batches {
+				size += len(batch.Elements)
+			}
+			if size > test.maxCall {
+				t.Errorf("%s: call of %d elements, want at most %d", test.name, size, test.maxCall)
+			}
+
+			if failures > 0 {
+				failures--
+				return errors.New("unreachable")
+			}
+			return nil
+		}
+		s := NewStream(testSettings(16, test.batchSize), send, func(batches []Batch) {
+			mux.Lock()
+			defer mux.Unlock()
+
+			for _, batch := range batches {
+				delivered = append(delivered, batch.Seq)
+			}
+			if len(delivered) == len(test.sizes) {
+				close(done)
+			}
+		})
+
+		for i, size := range test.sizes {
+			batch := testBatch(uint64(i + 1))
+			batch.Elements = make([]Element, size)
+			s.Push(batch)
+		}
+		waitFor(t, done)
+
+		for i, seq := range delivered {
+			if seq != uint64(i+1) {
+				t.Errorf("%s: delivered %v, want batches in the order pushed", test.name, delivered)
+				break
+			}
+		}
+
+		stats := s.Stats()
+		if pushed, _delivered := s.Progress(); pushed != uint64(len(test.sizes)) || _delivered != pushed {
+			t.Errorf("%s: progress %d of %d, want all delivered", test.name, _delivered, pushed)
+		}
+		if stats.Failures != uint64(test.failures) {
+			t.Errorf("%s: %d failures, want %d", test.name, stats.Failures, test.failures)
+		}
+		if stats.Queued != 0 {
+			t.Errorf("%s: %d batches still queued", test.name, stats.Queued)
+		}
+		s.Close()
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  int  // Batches pushed while the first call is in flight
+		succeed bool // Whether the call in flight succeeds
+	}{
+		{"call in flight", 0, true},
+		{"queued batches dropped", 5, true},
+		{"failed call not retried", 5, false},
+	}
+
+	for _, test := range tests {
+		release := make(chan struct{})
+		sending := make(chan struct{}, 1)
+		var calls int
+		var mux sync.Mutex
+		s := NewStream(testSettings(8, 1), func(batches []Batch) error {
+			mux.Lock()
+			calls++
+			mux.Unlock()
+
+			sending <- struct{}{}
+			<-release
+			if !test.succeed {
+				return errors.New("unreachable")
+			}
+			return nil
+		}, nil)
+
+		s.Push(testBatch(0))
+		waitFor(t, sending)
+		for i := 1; i <= test.queued; i++ {
+			s.Push(testBatch(uint64(i)))
+		}
+
+		s.Close()
+		close(release)
+
+		if !s.Closed() {
+			t.Errorf("%s: not closed after Close", test.name)
+		}
+		if s.Push(testBatch(100)) {
+			t.Errorf("%s: push accepted after Close", test.name)
+		}
+		s.Close()
+
+		// Give the goroutine time to send again if it were going to
+		time.Sleep(50 * time.Millisecond)
+		mux.Lock()
+		if calls != 1 {
+			t.Errorf("%s: %d calls, want only the one in flight", test.name, calls)
+		}
+		mux.Unlock()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+func testSettings(queueSize, batchSize int) StreamSettings {
+	return StreamSettings{
+		QueueSize:  queueSize,
+		BatchSize:  batchSize,
+		BatchDelay: time.Millisecond,
+		RetryDelay: time.Millisecond}
+}
+
+func testBatch(seq uint64) Batch {
+	return Batch{Origin: "a", SessionID: "s", Seq: seq, Elements: make([]Element, 1)}
+}
+
+func waitFor(t *testing.T, ch chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("timed out waiting for the stream")
+	}
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
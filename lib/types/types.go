@@ -28,10 +28,14 @@ type Log struct {
 	Output string
 }
 
+// Files holds the contents of every file of the session by file name, if
+// the session was known when the job was created. Older jobs only have the
+// Snippet, which is the main file.
 type Job struct {
 	SessionID string
 	JobID     string
 	Snippet   string
+	Files     map[string]string
 	Done      bool
 }
 
@@ -43,6 +47,8 @@ type WorkerNetSettings struct {
 
 func RegisterGob() {
 	gob.Register(Session{})
+	gob.Register(Delta{})
+	gob.Register(VersionVector{})
 	gob.Register(Log{})
 	gob.Register([]Log{})
 }
@@ -0,0 +1,318 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	. "../session"
+)
+
+/*
+A write-ahead log of elements, so elements a worker accepted but hadn't yet
+handed to the FS and other workers survive a crash. Elements are appended
+before they are applied, and the log is truncated once they are safe
+elsewhere (see Truncate).
+
+Every record is written as its own frame: the length and CRC-32 checksum of
+the record followed by the gob encoded record. A crash in the middle of an
+append leaves a torn frame at the end of the file, which is dropped when the
+log is opened again. Records are numbered by Seq, in the order they were
+appended.
+
+The log file is locked while it is open, so two workers can't share a log by
+mistake: opening a log another process has open fails with a LockedError.
+*/
+
+// Largest frame accepted when reading a log, to tell a corrupt length from
+// a real one
+const MAX_RECORD_SIZE uint32 = 1 << 24
+
+// Bytes before each record: its length and checksum
+const HEADER_SIZE int = 8
+
+type Record struct {
+	Seq     uint64
+	Element Element
+}
+
+type WAL struct {
+	path    string
+	file    *os.File
+	records []Record // Records that haven't been truncated, oldest first
+	last    uint64
+	dropped error // Why the end of the log was dropped when it was opened, if it was
+	mux     sync.Mutex
+}
+
+type CorruptRecordError int64
+
+type LockedError string
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("WAL [%s] is locked by another process", string(e))
+}
+
+func (e CorruptRecordError) Error() string {
+	return fmt.Sprintf("Corrupt WAL record at offset [%d]", int64(e))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PRIVATE METHODS>
+
+// Reads the records of the log file, stopping at the first frame that is
+// incomplete or corrupt. Returns the offset the valid records end at.
+func (l *WAL) read() (int64, error) {
+	reader := bufio.NewReader(l.file)
+
+	var offset int64
+	for {
+		record, size, err := readRecord(reader)
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, CorruptRecordError(offset)
+		}
+
+		l.records = append(l.records, record)
+		if record.Seq > l.last {
+			l.last = record.Seq
+		}
+		offset += int64(size)
+	}
+}
+
+// Takes an exclusive lock on a log file, without waiting for it. The lock is
+// released when the file is closed.
+func lock(file *os.File, path string) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return LockedError(path)
+	}
+
+	return err
+}
+
+// Syncs the directory a file is in, so a file renamed into it is still there
+// after a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Writes a frame for each record to w.
+func writeRecords(w io.Writer, records []Record) error {
+	for _, record := range records {
+		var buffer bytes.Buffer
+		if err := gob.NewEncoder(&buffer).Encode(record); err != nil {
+			return err
+		}
+
+		header := make([]byte, HEADER_SIZE)
+		binary.BigEndian.PutUint32(header[:4], uint32(buffer.Len()))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(buffer.Bytes()))
+		if _, err := w.Write(append(header, buffer.Bytes()...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the next frame. Returns io.EOF if there are no more frames, and
+// io.ErrUnexpectedEOF if the last one is incomplete.
+func readRecord(reader io.Reader) (Record, int, error) {
+	var record Record
+
+	header := make([]byte, HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return record, 0, io.EOF
+		}
+		return record, 0, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > MAX_RECORD_SIZE {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+	return record, HEADER_SIZE + int(length), err
+}
+
+// </PRIVATE METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
+
+//
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PUBLIC METHODS>
+
+// Opens and locks the log at path, creating it if it doesn't exist. Returns
+// a LockedError if another process has it open. Records after a torn or
+// corrupt frame are dropped, so the log can be appended to again (see
+// Dropped).
+func Open(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lock(file, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l := &WAL{path: path, file: file}
+	offset, dropped := l.read()
+	l.dropped = dropped
+
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Appends elements to the log, returning once they are on disk. The file is
+// synced once for all of them, so callers should append the elements they
+// have together. Returns the sequence number of the last record appended.
+func (l *WAL) Append(elements ...Element) (uint64, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	records := make([]Record, len(elements))
+	for i, element := range elements {
+		records[i] = Record{Seq: l.last + uint64(i) + 1, Element: element}
+	}
+
+	// A failed append mustn't leave part of a frame for later records to
+	// follow, or they would be dropped when the log is opened again
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err = writeRecords(l.file, records); err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		if l.file.Truncate(offset) == nil {
+			l.file.Seek(offset, io.SeekStart)
+		}
+		return 0, err
+	}
+
+	l.last += uint64(len(records))
+	l.records = append(l.records, records...)
+
+	return l.last, nil
+}
+
+// Returns the records that haven't been truncated, oldest first.
+func (l *WAL) Records() []Record {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return append([]Record(nil), l.records...)
+}
+
+// Returns a CorruptRecordError if the end of the log was dropped when it was
+// opened, from a torn or corrupt frame on, or nil if every frame was read.
+func (l *WAL) Dropped() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.dropped
+}
+
+// Returns the sequence number of the last record appended, or 0 if there
+// hasn't been any.
+func (l *WAL) Last() uint64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.last
+}
+
+// Drops every record up to and including seq. The records left are written
+// to a new file, which then replaces the log, so a crash leaves either the
+// old log or the new one. The new file is locked before it replaces the log,
+// and the directory is synced after, so the replacement survives a crash.
+func (l *WAL) Truncate(seq uint64) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	n := 0
+	for n < len(l.records) && l.records[n].Seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	records := l.records[n:]
+
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = lock(tmp, tmpPath); err == nil {
+		err = writeRecords(tmp, records)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, l.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	l.file.Close()
+	l.file = tmp
+	l.records = append([]Record(nil), records...)
+
+	if _, err = l.file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	return syncDir(l.path)
+}
+
+func (l *WAL) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.file.Close()
+}
+
+// </PUBLIC METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "../session"
+)
+
+func TestOpenDropsTornTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(data []byte, ends []int) []byte // ends are the offsets the records end at
+		records int
+	}{
+		{"intact", func(data []byte, ends []int) []byte {
+			return data
+		}, 3},
+		{"torn header", func(data []byte, ends []int) []byte {
+			return append(data, 0, 0, 0)
+		}, 3},
+		{"torn record", func(data []byte, ends []int) []byte {
+			return data[:ends[2]-5]
+		}, 2},
+		{"corrupt last record", func(data []byte, ends []int) []byte {
+			data[ends[2]-1] ^= 0xff
+			return data
+		}, 2},
+		{"corrupt middle record", func(data []byte, ends []int) []byte {
+			data[ends[1]-1] ^= 0xff
+			return data
+		}, 1},
+		{"corrupt checksum", func(data []byte, ends []int) []byte {
+			data[ends[0]+HEADER_SIZE-1] ^= 0xff
+			return data
+		}, 1},
+		{"length too large", func(data []byte, ends []int) []byte {
+			header := make([]byte, HEADER_SIZE)
+			binary.BigEndian.PutUint32(header[:4], MAX_RECORD_SIZE+1)
+			return append(data, header...)
+		}, 3},
+	}
+
+	for _, test := range tests {
+		path := tempPath(t)
+		ends := writeLog(t, path)
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damaged := test.damage(data, ends)
+		if err = ioutil.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := Open(path)
+		if err != nil {
+			t.Fatalf("%s: Open: %v", test.name, err)
+		}
+		if records := l.Records(); len(records) != test.records {
+			t.Errorf("%s: %d records after reopening, want %d", test.name, len(records), test.records)
+		}
+		if dropped := l.Dropped(); (dropped != nil) != (len(damaged) != ends[test.records-1]) {
+			t.Errorf("%s: Dropped() = %v", test.name, dropped)
+		}
+
+		// The log can be appended to after the dropped tail, and the new
+		// record is read back with the others
+		last, err := l.Append(Element{SessionID: "new"})
+		if err != nil {
+			t.Fatalf("%s: Append: %v", test.name, err)
+		}
+		if last != uint64(test.records+1) {
+			t.Errorf("%s: appended record %d, want %d", test.name, last, test.records+1)
+		}
+		l.Close()
+
+		l, err = Open(path)
+		if err != nil {
+			t.Fatalf("%s: Open again: %v", test.name, err)
+		}
+		if records := l.Records(); len(records) != test.records+1 || records[test.records].Element.SessionID != "new" {
+			t.Errorf("%s: records after appending = %v", test.name, records)
+		}
+		if dropped := l.Dropped(); dropped != nil {
+			t.Errorf("%s: Dropped() = %v after appending", test.name, dropped)
+		}
+		l.Close()
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		seq  uint64
+		left []uint64
+	}{
+		{"nothing", 0, []uint64{1, 2, 3}},
+		{"first", 1, []uint64{2, 3}},
+		{"all but last", 2, []uint64{3}},
+		{"all", 3, []uint64{}},
+		{"past the end", 10, []uint64{}},
+	}
+
+	for _, test := range tests {
+		path := tempPath(t)
+		writeLog(t, path)
+
+		l, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = l.Truncate(test.seq); err != nil {
+			t.Fatalf("%s: Truncate: %v", test.name, err)
+		}
+		checkSeqs(t, test.name, l.Records(), test.left)
+		if last := l.Last(); last != 3 {
+			t.Errorf("%s: Last() = %d after truncating, want 3", test.name, last)
+		}
+		if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary file left behind", test.name)
+		}
+
+		if _, err = l.Append(Element{SessionID: "new"}); err != nil {
+			t.Fatalf("%s: Append: %v", test.name, err)
+		}
+		l.Close()
+
+		l, err = Open(path)
+		if err != nil {
+			t.Fatalf("%s: Open again: %v", test.name, err)
+		}
+		checkSeqs(t, test.name+" reopened", l.Records(), append(test.left, 4))
+		l.Close()
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	path := tempPath(t)
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Open(path); err != LockedError(path) {
+		t.Errorf("Open of a log open elsewhere = %v, want LockedError", err)
+	}
+
+	l.Close()
+	if l, err = Open(path); err != nil {
+		t.Errorf("Open after closing = %v", err)
+	} else {
+		l.Close()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+func tempPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.wal")
+}
+
+// Appends three records to a new log at path, one at a time. Returns the
+// offsets the records end at.
+func writeLog(t *testing.T, path string) []int {
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ends := make([]int, 0, 3)
+	for _, text := range []string{"a", "bc", "def"} {
+		if _, err = l.Append(Element{SessionID: "s", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, int(info.Size()))
+	}
+
+	return ends
+}
+
+func checkSeqs(t *testing.T, name string, records []Record, seqs []uint64) {
+	if len(records) != len(seqs) {
+		t.Errorf("%s: records %v, want seqs %v", name, records, seqs)
+		return
+	}
+	for i, record := range records {
+		if record.Seq != seqs[i] {
+			t.Errorf("%s: records %v, want seqs %v", name, records, seqs)
+			return
+		}
+	}
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
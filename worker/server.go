@@ -48,9 +48,27 @@ type Worker struct {
 	Strike          int
 }
 
+// The workers, and the overlay of which workers connect to which. The
+// overlay keeps the workers in a ring, in the order they registered, and adds
+// chords between random workers. Each worker is a neighbor of the workers
+// before and after it in the ring, and of the workers it has chords to, and
+// connects to its neighbors (see GetNodes). The ring alone keeps the overlay
+// connected as long as it is mended when workers die, and chords shorten the
+// paths between workers.
 type AllWorkers struct {
 	sync.RWMutex
-	all map[int]*Worker
+	all    map[int]*Worker
+	ring   []int
+	chords map[int]map[int]bool
+}
+
+// A snapshot of the overlay, for inspection. Neighbors and Addresses are by
+// worker ID, and Connected is whether every worker can reach every other
+type OverlayGraph struct {
+	Ring      []int
+	Neighbors map[int][]int
+	Addresses map[int]string
+	Connected bool
 }
 
 var (
@@ -59,10 +77,10 @@ var (
 	outLog               *log.Logger          = log.New(os.Stderr, "[serv] ", log.Lshortfile|log.LUTC|log.Lmicroseconds)
 	golog                *govec.GoLog         = govec.InitGoVector("LBServer", "LBServer")
 	// Workers in the system.
-	allWorkers              AllWorkers = AllWorkers{all: make(map[int]*Worker)}
+	allWorkers              AllWorkers = AllWorkers{all: make(map[int]*Worker), chords: make(map[int]map[int]bool)}
 	HeartBeatInterval                  = 2000 // every two second
 	MinNumWorkerConnections            = 2
-	NumWorkerToReturn                  = 4
+	NumWorkerToReturn                  = 4 // Workers get chords until they have this many neighbors
 	WorkerIDCounter                    = 0
 	sessionIDs                         = make(map[string]bool)
 )
@@ -120,6 +138,7 @@ func monitor(workerID int, heartBeatInterval time.Duration) {
 			if allWorkers.all[workerID].Strike > 0 {
 				outLog.Printf("%s timed out\n", allWorkers.all[workerID].RPCAddress.String())
 				delete(allWorkers.all, workerID)
+				removeFromOverlay(workerID)
 				allWorkers.Unlock()
 				return
 			} else {
@@ -163,6 +182,7 @@ func (s *LBServer) RegisterNewWorker(w WorkerInfo, r *WorkerNetSettings) error {
 	}
 
 	allWorkers.all[newWorkerID] = newWorker
+	addToOverlay(newWorkerID)
 
 	go monitor(newWorkerID, time.Duration(HeartBeatInterval)*time.Millisecond)
 
@@ -206,7 +226,7 @@ func (s *LBServer) RegisterNewClient(sessID string, retWorkerIP *string) error {
 		workerCon, err := rpc.Dial("tcp", worker.RPCAddress.String())
 		if err != nil {
 			fmt.Println(err)
-			fmt.Println("Error connecting to worker %s while registering", worker.RPCAddress.String())
+			fmt.Printf("Error connecting to worker %s while registering\n", worker.RPCAddress.String())
 		} else {
 			defer workerCon.Close()
 			var ignored bool
@@ -234,13 +254,117 @@ func (s *LBServer) RegisterNewClient(sessID string, retWorkerIP *string) error {
 	return nil
 }
 
+// Branches a new session off an existing one at the least busy worker that
+// can load the source session. Responds with the worker's HTTP address, or
+// an empty address if no worker could fork the session.
+func (s *LBServer) ForkSession(request WorkerRequest, retWorkerIP *string) error {
+	srcID := request.Payload[0].(string)
+	newID := request.Payload[1].(string)
+
+	// The new ID is reserved while the workers are called, so that it can't
+	// be forked or created twice, and freed again if no worker forks it
+	allWorkers.Lock()
+	if sessionIDs[newID] {
+		allWorkers.Unlock()
+		return errors.New("Load Balancer: session already exists [" + newID + "]")
+	}
+	sessionIDs[newID] = true
+	allWorkers.Unlock()
+
+	for _, worker := range availableWorkers() {
+		workerCon, err := rpc.Dial("tcp", worker.RPCAddress.String())
+		if err != nil {
+			outLog.Println("Error connecting to worker", worker.RPCAddress.String(), "while forking:", err)
+			continue
+		}
+
+		var ignored bool
+		err = workerCon.Call("Worker.ForkSession", &request, &ignored)
+		workerCon.Close()
+		if err == nil {
+			outLog.Println("Session", srcID, "forked as", newID, "at", worker.HTTPAddress.String())
+			*retWorkerIP = worker.HTTPAddress.String()
+			return nil
+		}
+		outLog.Println("Worker", worker.RPCAddress.String(), "could not fork session", srcID, ":", err)
+	}
+
+	allWorkers.Lock()
+	delete(sessionIDs, newID)
+	allWorkers.Unlock()
+
+	return nil
+}
+
+// Merges the edits made to a forked session back into a session at the
+// least busy worker that can load both. Responds with the number of
+// elements that were applied to the target.
+func (s *LBServer) MergeSession(request WorkerRequest, response *WorkerResponse) error {
+	forkID := request.Payload[0].(string)
+	targetID := request.Payload[1].(string)
+
+	var err error
+	for _, worker := range availableWorkers() {
+		workerCon, dialErr := rpc.Dial("tcp", worker.RPCAddress.String())
+		if dialErr != nil {
+			outLog.Println("Error connecting to worker", worker.RPCAddress.String(), "while merging:", dialErr)
+			continue
+		}
+
+		err = workerCon.Call("Worker.MergeSession", &request, response)
+		workerCon.Close()
+		if err == nil {
+			outLog.Println("Session", forkID, "merged into", targetID, "at", worker.HTTPAddress.String())
+			return nil
+		}
+		outLog.Println("Worker", worker.RPCAddress.String(), "could not merge session", forkID, ":", err)
+	}
+
+	if err == nil {
+		err = errors.New("Load Balancer: no worker available to merge [" + forkID + "]")
+	}
+	return err
+}
+
+// Saves a named snapshot of a session at the least busy worker that can load
+// it. The payload is the session ID and the name, and optionally the Unix
+// time in nanoseconds to take the snapshot at (see Worker.SaveSnapshot).
+func (s *LBServer) SaveSnapshot(request WorkerRequest, _ignored *bool) error {
+	sessionID := request.Payload[0].(string)
+	name := request.Payload[1].(string)
+
+	var err error
+	for _, worker := range availableWorkers() {
+		workerCon, dialErr := rpc.Dial("tcp", worker.RPCAddress.String())
+		if dialErr != nil {
+			outLog.Println("Error connecting to worker", worker.RPCAddress.String(), "while saving a snapshot:", dialErr)
+			continue
+		}
+
+		var ignored bool
+		err = workerCon.Call("Worker.SaveSnapshot", &request, &ignored)
+		workerCon.Close()
+		if err == nil {
+			outLog.Println("Snapshot", name, "of session", sessionID, "saved at", worker.HTTPAddress.String())
+			return nil
+		}
+		outLog.Println("Worker", worker.RPCAddress.String(), "could not save snapshot", name, "of session", sessionID, ":", err)
+	}
+
+	if err == nil {
+		err = errors.New("Load Balancer: no worker available to save a snapshot of [" + sessionID + "]")
+	}
+	return err
+}
+
 type Addresses []net.Addr
 
 func (a Addresses) Len() int           { return len(a) }
 func (a Addresses) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Addresses) Less(i, j int) bool { return a[i].String() < a[j].String() }
 
-// Returns addresses for a subset of workers in the system.
+// Returns the addresses of a worker's neighbors in the overlay. Neighbors
+// change as workers register and die, so workers ask again now and then.
 //
 // Returns:
 // - UnknownKeyError if the server does not know a worker with this id.
@@ -253,29 +377,31 @@ func (s *LBServer) GetNodes(workerID int, addrSet *[]net.Addr) error {
 		return unknownWorkerIDError
 	}
 
-	workerAddresses := make([]net.Addr, 0, len(allWorkers.all)-1)
-
-	for id, worker := range allWorkers.all {
-		if workerID == id {
-			continue
-		}
-		workerAddresses = append(workerAddresses, worker.RPCAddress)
+	neighbors := overlayNeighbors(workerID)
+	workerAddresses := make([]net.Addr, 0, len(neighbors))
+	for id := range neighbors {
+		workerAddresses = append(workerAddresses, allWorkers.all[id].RPCAddress)
 	}
 
 	sort.Sort(Addresses(workerAddresses))
+	*addrSet = workerAddresses
 
-	deterministicRandomNumber := int64(workerID) % 32
-	r := rand.New(rand.NewSource(deterministicRandomNumber))
-	for n := len(workerAddresses); n > 0; n-- {
-		randIndex := r.Intn(n)
-		workerAddresses[n-1], workerAddresses[randIndex] = workerAddresses[randIndex], workerAddresses[n-1]
-	}
+	return nil
+}
 
-	n := len(workerAddresses)
-	if NumWorkerToReturn < n {
-		n = NumWorkerToReturn
+// Returns the current overlay, to inspect how workers are connected.
+func (s *LBServer) GetOverlay(_ignored bool, graph *OverlayGraph) error {
+	allWorkers.RLock()
+	defer allWorkers.RUnlock()
+
+	graph.Ring = append([]int(nil), allWorkers.ring...)
+	graph.Neighbors = make(map[int][]int, len(allWorkers.ring))
+	graph.Addresses = make(map[int]string, len(allWorkers.ring))
+	for _, workerID := range allWorkers.ring {
+		graph.Neighbors[workerID] = sortedNeighbors(workerID)
+		graph.Addresses[workerID] = allWorkers.all[workerID].RPCAddress.String()
 	}
-	*addrSet = workerAddresses[:n]
+	graph.Connected = overlayConnected()
 
 	return nil
 }
@@ -391,6 +517,135 @@ func (s *LBServer) NewJob(wrequest *WorkerRequest, wresponse *WorkerResponse) er
 	return nil
 }
 
+// Adds a worker to the end of the ring, and gives it chords. The workers it
+// is added between stop being neighbors in the ring, so they are given new
+// chords too. allWorkers must be locked.
+func addToOverlay(workerID int) {
+	allWorkers.ring = append(allWorkers.ring, workerID)
+	allWorkers.chords[workerID] = make(map[int]bool)
+	addChords(workerID)
+	if n := len(allWorkers.ring); n > 2 {
+		addChords(allWorkers.ring[0])
+		addChords(allWorkers.ring[n-2])
+	}
+
+	outLog.Printf("Worker %d joined the overlay with neighbors %v\n", workerID, sortedNeighbors(workerID))
+}
+
+// Removes a dead worker from the overlay. The workers before and after it in
+// the ring become neighbors, and its neighbors are given new chords in place
+// of it. allWorkers must be locked.
+func removeFromOverlay(workerID int) {
+	neighbors := overlayNeighbors(workerID)
+	for i, id := range allWorkers.ring {
+		if id == workerID {
+			allWorkers.ring = append(allWorkers.ring[:i], allWorkers.ring[i+1:]...)
+			break
+		}
+	}
+	for id := range allWorkers.chords[workerID] {
+		delete(allWorkers.chords[id], workerID)
+	}
+	delete(allWorkers.chords, workerID)
+
+	for id := range neighbors {
+		addChords(id)
+		outLog.Printf("Worker %d lost worker %d, neighbors now %v\n", id, workerID, sortedNeighbors(id))
+	}
+	if !overlayConnected() {
+		errLog.Println("Overlay is not connected")
+	}
+}
+
+// Adds chords from a worker to random workers until it has NumWorkerToReturn
+// neighbors, only picking workers that have fewer than that themselves.
+// allWorkers must be locked.
+func addChords(workerID int) {
+	neighbors := overlayNeighbors(workerID)
+	for _, i := range rand.Perm(len(allWorkers.ring)) {
+		if len(neighbors) >= NumWorkerToReturn {
+			return
+		}
+
+		id := allWorkers.ring[i]
+		if id == workerID || neighbors[id] || len(overlayNeighbors(id)) >= NumWorkerToReturn {
+			continue
+		}
+		allWorkers.chords[workerID][id] = true
+		allWorkers.chords[id][workerID] = true
+		neighbors[id] = true
+	}
+}
+
+// Returns the neighbors of a worker in the overlay: the workers before and
+// after it in the ring, and the workers it has chords to. allWorkers must be
+// locked.
+func overlayNeighbors(workerID int) map[int]bool {
+	neighbors := make(map[int]bool)
+	ring := allWorkers.ring
+	for i, id := range ring {
+		if id == workerID && len(ring) > 1 {
+			neighbors[ring[(i+len(ring)-1)%len(ring)]] = true
+			neighbors[ring[(i+1)%len(ring)]] = true
+			break
+		}
+	}
+	for id := range allWorkers.chords[workerID] {
+		neighbors[id] = true
+	}
+
+	return neighbors
+}
+
+// Returns the IDs of the neighbors of a worker in the overlay, in order.
+// allWorkers must be locked.
+func sortedNeighbors(workerID int) []int {
+	neighbors := make([]int, 0)
+	for id := range overlayNeighbors(workerID) {
+		neighbors = append(neighbors, id)
+	}
+	sort.Ints(neighbors)
+
+	return neighbors
+}
+
+// Returns whether every worker in the overlay can reach every other through
+// neighbors. allWorkers must be locked.
+func overlayConnected() bool {
+	if len(allWorkers.ring) == 0 {
+		return true
+	}
+
+	reached := map[int]bool{allWorkers.ring[0]: true}
+	toVisit := []int{allWorkers.ring[0]}
+	for len(toVisit) > 0 {
+		workerID := toVisit[0]
+		toVisit = toVisit[1:]
+		for id := range overlayNeighbors(workerID) {
+			if !reached[id] {
+				reached[id] = true
+				toVisit = append(toVisit, id)
+			}
+		}
+	}
+
+	return len(reached) == len(allWorkers.ring)
+}
+
+// Returns copies of the workers, least busy first, so that they can be called
+// without holding allWorkers locked
+func availableWorkers() WorkersList {
+	allWorkers.RLock()
+	defer allWorkers.RUnlock()
+
+	workers := make(WorkersList, 0, len(allWorkers.all))
+	for _, worker := range sortWorkers() {
+		copied := *worker
+		workers = append(workers, &copied)
+	}
+	return workers
+}
+
 func sortWorkers() WorkersList {
 	workersAvailable := make(WorkersList, len(allWorkers.all))
 	i := 0
@@ -409,6 +664,6 @@ func handleErrorFatal(msg string, e error) {
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "Usage: go run server.go [port]\n")
+	fmt.Fprintln(os.Stderr, "Usage: go run server.go [port]")
 	os.Exit(1)
 }
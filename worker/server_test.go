@@ -0,0 +1,93 @@
+package main
+
+// Usage: go test server.go server_test.go
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		removed []int // Removed in this order once every worker joined
+	}{
+		{"one", 1, nil},
+		{"two", 2, nil},
+		{"ring only", NumWorkerToReturn, nil},
+		{"with chords", 20, nil},
+		{"remove first", 10, []int{0}},
+		{"remove last", 10, []int{9}},
+		{"remove neighbors", 10, []int{3, 4, 5}},
+		{"remove all but one", 6, []int{0, 5, 2, 3, 1}},
+		{"remove many", 40, []int{1, 7, 13, 19, 2, 3, 4, 38, 39, 0, 20, 21}},
+	}
+
+	for _, test := range tests {
+		for seed := int64(1); seed <= 20; seed++ {
+			rand.Seed(seed)
+			resetOverlay()
+
+			for id := 0; id < test.workers; id++ {
+				addToOverlay(id)
+				checkOverlay(t, test.name, seed)
+			}
+			for _, id := range test.removed {
+				removeFromOverlay(id)
+				checkOverlay(t, test.name, seed)
+
+				if _, ok := allWorkers.chords[id]; ok {
+					t.Errorf("%s, seed %d: removed worker %d still has chords", test.name, seed, id)
+				}
+				for _, _id := range allWorkers.ring {
+					if _id == id || overlayNeighbors(_id)[id] {
+						t.Errorf("%s, seed %d: removed worker %d still in the overlay", test.name, seed, id)
+					}
+				}
+			}
+
+			if len(allWorkers.ring) != test.workers-len(test.removed) {
+				t.Errorf("%s, seed %d: %d workers in the ring, want %d", test.name, seed, len(allWorkers.ring), test.workers-len(test.removed))
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <HELPER METHODS>
+
+func resetOverlay() {
+	allWorkers.ring = nil
+	allWorkers.chords = make(map[int]map[int]bool)
+}
+
+// Checks that the overlay is connected, that neighbors are symmetric, and that
+// chords were only added while workers had fewer than NumWorkerToReturn
+// neighbors.
+func checkOverlay(t *testing.T, name string, seed int64) {
+	if !overlayConnected() {
+		t.Errorf("%s, seed %d: overlay %v with chords %v is not connected", name, seed, allWorkers.ring, allWorkers.chords)
+	}
+
+	for _, id := range allWorkers.ring {
+		neighbors := overlayNeighbors(id)
+		for neighbor := range neighbors {
+			if !overlayNeighbors(neighbor)[id] {
+				t.Errorf("%s, seed %d: %d is a neighbor of %d but not the other way", name, seed, neighbor, id)
+			}
+		}
+		if want := NumWorkerToReturn; len(allWorkers.ring) > want && len(neighbors) < want {
+			// A worker is only short of neighbors if every other worker
+			// that isn't one already has enough
+			for _, other := range allWorkers.ring {
+				if other != id && !neighbors[other] && len(overlayNeighbors(other)) < want {
+					t.Errorf("%s, seed %d: %d and %d both have fewer than %d neighbors", name, seed, id, other, want)
+				}
+			}
+		}
+	}
+}
+
+// </HELPER METHODS>
+////////////////////////////////////////////////////////////////////////////////////////////
@@ -4,7 +4,16 @@ Port is dynamic
 
 Usage:
 
-$ go run worker.go [loadbalancer ip:port]
+$ go run worker.go [flags] [loadbalancer ip:port] [fileserver ip:port] [WAL path]
+
+The flags set the bounds, expiry and maintenance interval of the cache of
+elements received from other workers (see CacheSettings); run with -h to list
+them.
+
+The WAL path is optional, and defaults to a file named after the worker's RPC
+address (see WAL_PATH_FORMAT). The port is dynamic, so pass the path to
+replay the WAL of a previous run. A worker won't start with a WAL another
+worker has open.
 
 */
 package main
@@ -13,24 +22,33 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"html"
+	"io/ioutil"
 	"log"
-	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	. "../lib/cache"
+	. "../lib/membership"
 	. "../lib/session"
+	. "../lib/stream"
 	. "../lib/types"
+	. "../lib/wal"
 	"github.com/DistributedClocks/GoVector/govec"
 	"github.com/gorilla/websocket"
 )
@@ -40,6 +58,16 @@ type WorkerInfo struct {
 	HTTPAddress net.Addr
 }
 
+// The worker's state is shared by RPC handlers, HTTP handlers, a goroutine
+// reading each websocket, the streams to other workers and the
+// maintainReplication and probeMembers loops, so each group of fields has its
+// own lock, and is only used through the methods under STATE CODE. Apart from
+// walMux, no lock is held while taking another, or while calling another
+// worker, the FS or a client. Sessions, streams and the membership lock
+// themselves.
+//
+// mux serializes writes to websockets, since a websocket only allows one
+// writer at a time.
 type Worker struct {
 	workerID         int
 	loadBalancerConn *rpc.Client
@@ -50,18 +78,97 @@ type Worker struct {
 	localRPCAddr     net.Addr
 	localHTTPAddr    net.Addr
 	externalIP       string
-	clients          map[string]*websocket.Conn
-	workers          map[string]*rpc.Client
+	origin           string
 	logger           *log.Logger
-	sessions         map[string]*Session
-	modifiedSessions map[string]*Session
-	clientSessions   map[string][]string
-	logs             map[string]map[string]Log
-	localElements    []Element
-	elementsToAck    []Element
 	cache            *Cache
+	seen             *Seen
+	members          *Membership
 	golog            *govec.GoLog
 	mux              sync.Mutex
+
+	// Guarded by clientsMux
+	clients        map[string]*websocket.Conn
+	clientSessions map[string][]string
+	clientsMux     sync.RWMutex
+
+	// Guarded by workersMux. Every worker has a stream that replicates
+	// batches to it, interests are the sessions each worker last advertised
+	// it hosts or leads to, and acked is the number up to which each worker
+	// has seen every batch of a source, as of its last response. reports are
+	// the versions of sessions the workers hosting them last reported, by
+	// session and address, see gatherReports
+	workers    map[string]*rpc.Client
+	streams    map[string]*Stream
+	interests  map[string]interest
+	acked      map[string]map[Source]uint64
+	reports    map[string]map[string]HostVersion
+	workersMux sync.RWMutex
+
+	// Guarded by sessionsMux. Sessions being loaded are hosted as far as
+	// other workers are concerned. batchSeqs is the number of the last batch
+	// of each session that originated here. resyncs are the elements each
+	// session dropped from its pending buffer, see resyncSessions
+	sessions         map[string]*Session
+	modifiedSessions map[string]*Session
+	resyncs          map[string][]Element
+	savedVersions    map[string]VersionVector
+	loadingSessions  map[string]bool
+	advertisements   uint64
+	batchSeqs        map[string]uint64
+	sessionsMux      sync.RWMutex
+
+	// Guarded by logsMux
+	logs    map[string]map[string]Log
+	logsMux sync.RWMutex
+
+	// Guarded by elementsMux
+	elementsToAck []pendingAck
+	elementsMux   sync.Mutex
+
+	// Elements are appended to the WAL and then applied and streamed with
+	// walMux read locked, so holding it locked means every element in the
+	// WAL has been pushed to the streams, and every batch seen has been
+	// applied. Checkpoints are only used by the maintainReplication loop
+	wal            *WAL
+	walCheckpoints []walCheckpoint
+	walMux         sync.RWMutex
+}
+
+// The batch of an element from a client waiting to be acked, with the number
+// of batches that had been pushed to each worker's stream once it was pushed
+// there
+type pendingAck struct {
+	batch   Batch
+	targets map[*Stream]uint64
+}
+
+// The sessions a worker hosts or leads to, ie. sessions other workers it is
+// connected to advertised to it, as of its advertisement numbered version.
+// Advertisements can arrive out of order, so older ones are ignored
+type interest struct {
+	version  uint64
+	sessions map[string]bool
+}
+
+// The version of a session a worker hosting it reported at Time, its Unix
+// time in nanoseconds, see hostVersion
+type HostVersion struct {
+	Time    int64
+	Version VersionVector
+}
+
+// A worker's stream stats and the sessions it hosts or leads to
+type PeerStats struct {
+	StreamStats
+	Sessions []string
+}
+
+// A point in the WAL and the number of batches that had been pushed to each
+// worker's stream by then. Once enough workers have delivered that many, and
+// the FS has the sessions, the WAL can be truncated up to seq
+type walCheckpoint struct {
+	seq     uint64
+	targets map[*Stream]uint64
 }
 
 type LogSettings struct {
@@ -74,9 +181,25 @@ type SessionAndLog struct {
 	LogRecord     []Log
 }
 
+// The elements a recovering client is missing, and the version of the
+// session it has once they are applied. If Reload is set the elements can't
+// be found, eg. because the session's history was compacted, and the client
+// has to load the whole session again.
 type ClientRecovery struct {
 	Session   []Element
 	LogRecord []Log
+	Version   VersionVector
+	Reload    bool
+}
+
+// Messages from the browser are elements. A message with a Command is a
+// request to run the command for the client instead, eg. undo its last edit.
+type ClientMessage struct {
+	Element
+	Command string
+	Start   int           // Start of the range to annotate or edit, see ANNOTATE_COMMAND and INSERT_COMMAND
+	End     int           // End of the range to annotate or delete
+	Version VersionVector // Version of the session the client has applied, see ACK_COMMAND
 }
 
 type NoCRDTError string
@@ -85,6 +208,18 @@ func (e NoCRDTError) Error() string {
 	return fmt.Sprintf("Worker doesn't have sessionID [%s]", string(e))
 }
 
+type SessionExistsError string
+
+func (e SessionExistsError) Error() string {
+	return fmt.Sprintf("Worker already has sessionID [%s]", string(e))
+}
+
+type TimeoutError string
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("Worker [%s] didn't respond in time", string(e))
+}
+
 // Used to send heartbeat to the server just shy of 1 second each beat
 const TIME_BUFFER int = 500
 const ELEMENT_DELAY int = 2
@@ -97,211 +232,322 @@ const AUTO_SAVE bool = true
 
 const EXEC_DIR = "./execute"
 
+// Time a job is given to run before it is killed
+const JOB_TIMEOUT time.Duration = 5 * time.Second
+
+// Time to wait for another worker to answer a call made from the
+// maintainReplication loop, so a worker that hangs can't hold it up
+const WORKER_TIMEOUT time.Duration = 2 * time.Second
+
+// Default path of the write-ahead log of elements not yet safe on the FS and
+// other workers, given the worker's RPC address with ':' replaced by '_'
+const WAL_PATH_FORMAT = "./worker-%s.wal"
+
+// Commands browsers can send over the websocket. File commands name the file
+// in the message's Text and its document in the message's Document, and undo
+// and redo apply to the message's Document
+const UNDO_COMMAND = "undo"
+const REDO_COMMAND = "redo"
+const CREATE_FILE_COMMAND = "create_file"
+const RENAME_FILE_COMMAND = "rename_file"
+const DELETE_FILE_COMMAND = "delete_file"
+
+// Edit commands. An insert puts the message's Text at the message's Start in
+// the message's Document, and a delete removes the characters from the
+// message's Start up to its End
+const INSERT_COMMAND = "insert"
+const DELETE_COMMAND = "delete"
+
+// Annotation commands. A new annotation covers the characters from the
+// message's Start up to its End in the message's Document, with the
+// message's Text. Other annotation commands name the annotation by the
+// message's ID
+const ANNOTATE_COMMAND = "annotate"
+const EDIT_ANNOTATION_COMMAND = "edit_annotation"
+const RESOLVE_ANNOTATION_COMMAND = "resolve_annotation"
+const REOPEN_ANNOTATION_COMMAND = "reopen_annotation"
+const DELETE_ANNOTATION_COMMAND = "delete_annotation"
+
+// Tells the worker the message's Version, the operations of the session the
+// client has applied, so the tombstones of the deletes among them can be
+// collected once every replica has applied them too
+const ACK_COMMAND = "ack"
+
 func main() {
-	if len(os.Args) != 3 {
+	cacheSettings := DefaultSettings()
+	flag.DurationVar(&cacheSettings.MaintenanceInterval, "cache-interval", cacheSettings.MaintenanceInterval, "time between removals of expired cached elements")
+	flag.DurationVar(&cacheSettings.ExpiryThreshold, "cache-expiry", cacheSettings.ExpiryThreshold, "time after which cached elements expire")
+	flag.IntVar(&cacheSettings.MaxSessionBytes, "cache-session-bytes", cacheSettings.MaxSessionBytes, "bytes of elements cached per session, 0 for no limit")
+	flag.IntVar(&cacheSettings.MaxBytes, "cache-bytes", cacheSettings.MaxBytes, "bytes of elements cached overall, 0 for no limit")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 && flag.NArg() != 3 {
 		usage()
 	}
-	gob.Register(map[string]*Element{})
+	gob.Register(map[ElementID]*Element{})
 	gob.Register(map[string]Log{})
 	gob.Register(&net.TCPAddr{})
 	gob.Register([]Element{})
 	gob.Register([]*Element{})
 	gob.Register(&Element{})
 	gob.Register(Session{})
+	gob.Register(Delta{})
+	gob.Register(VersionVector{})
 	gob.Register(Job{})
 	gob.Register(Log{})
 	gob.Register([]Log{})
+	gob.Register([]Batch{})
+	gob.Register(map[Source]uint64{})
+	gob.Register([]Update{})
+	gob.Register(map[string]map[string]HostVersion{})
+	rand.Seed(time.Now().UnixNano())
 	worker := new(Worker)
 	worker.logger = log.New(os.Stdout, "[Initializing] ", log.Lshortfile)
-	worker.init()
+	worker.init(cacheSettings)
 	worker.listenRPC()
+	worker.openWAL()
 	worker.listenHTTP()
 	worker.registerWithLB()
 	worker.connectToFS()
 	worker.getWorkers()
-	go worker.sendLocalElements()
+	worker.replayWAL()
+	go worker.maintainReplication()
+	go worker.probeMembers()
 	go worker.cache.Maintain()
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	wg.Wait()
 }
 
-func (w *Worker) init() {
-	args := os.Args[1:]
+func (w *Worker) init(cacheSettings CacheSettings) {
+	args := flag.Args()
 	w.serverAddr = args[0]
 	w.fserverAddr = args[1]
 	w.workers = make(map[string]*rpc.Client)
+	w.streams = make(map[string]*Stream)
+	w.interests = make(map[string]interest)
+	w.acked = make(map[string]map[Source]uint64)
+	w.reports = make(map[string]map[string]HostVersion)
 	w.sessions = make(map[string]*Session)
 	w.clients = make(map[string]*websocket.Conn)
 	w.clientSessions = make(map[string][]string)
 	w.modifiedSessions = make(map[string]*Session)
+	w.resyncs = make(map[string][]Element)
+	w.savedVersions = make(map[string]VersionVector)
+	w.loadingSessions = make(map[string]bool)
+	w.batchSeqs = make(map[string]uint64)
 	w.logs = make(map[string]map[string]Log)
 
 	w.cache = new(Cache)
-	w.cache.Init()
+	w.cache.InitWithSettings(cacheSettings)
+	w.seen = NewSeen()
 	if _, err := os.Stat(EXEC_DIR); os.IsNotExist(err) {
 		os.Mkdir(EXEC_DIR, 0755)
 	}
 }
 
+// Opens the WAL given on the command line, or the one named after the
+// worker's RPC address. Exits if it can't be opened, eg. because another
+// worker has it open.
+func (w *Worker) openWAL() {
+	walPath := fmt.Sprintf(WAL_PATH_FORMAT, strings.Replace(w.localRPCAddr.String(), ":", "_", -1))
+	if flag.NArg() > 2 {
+		walPath = flag.Arg(2)
+	}
+
+	wal, err := Open(walPath)
+	if w.checkError(err) != nil {
+		os.Exit(1)
+	}
+	if err = wal.Dropped(); err != nil {
+		w.logger.Println("Dropped the end of WAL ["+walPath+"]:", err)
+	}
+	w.wal = wal
+	w.logger.Println("Using WAL [" + walPath + "]")
+}
+
 func (w *Worker) connectToFS() {
 	fsServerConn, err := rpc.Dial("tcp", w.fserverAddr)
 	w.checkError(err)
 	w.fsServerConn = fsServerConn
 }
 
-// Send all of the ops made locally on this worker to all other connected workers
-// After sending, wipe all localElements from the worker
-func (w *Worker) sendLocalElements() error {
+// Elements are streamed to the other workers as soon as they are applied
+// (see relay). Every ELEMENT_DELAY seconds this connects to the worker's
+// neighbors (see getWorkers), saves the modified sessions to the FS, pushes
+// client elements again to workers that didn't get them, resyncs sessions
+// that dropped pending elements (see resyncSessions), and truncates the
+// WAL up to the last checkpoint the FS and enough workers have everything
+// before. The WAL is never truncated if AUTO_SAVE is off
+func (w *Worker) maintainReplication() {
 	for {
 		time.Sleep(time.Second * time.Duration(ELEMENT_DELAY))
 
-		if AUTO_SAVE {
-			w.saveModifiedSessionsToFS()
-		}
-
-		numLocalElements := len(w.localElements)
-		numAckElements := len(w.elementsToAck)
-		if numLocalElements > 0 || numAckElements > 0 {
-			numSuccess := 0
-
-			elementQueue := append(w.localElements, w.elementsToAck...)
-			numChunks := int(math.Ceil(float64(len(elementQueue)) / float64(CHUNK_SIZE)))
-			numElements := len(elementQueue)
-
-			w.logger.Println("Sending local elements -- Map of connected workers:", w.workers)
-
-			request := new(WorkerRequest)
-			request.Payload = make([]interface{}, 1)
-			response := new(WorkerResponse)
-			for workerAddr, workerCon := range w.workers {
-				isConnected := false
-
-				// Check if worker is connected
-				workerCon.Call("Worker.PingWorker", "", &isConnected)
-				if !isConnected {
-					w.logger.Println("Lost worker: ", workerAddr)
-
-					delete(w.workers, workerAddr)
-					if len(w.workers) < w.settings.MinNumWorkerConnections {
-						w.getWorkers()
-					}
-				}
+		w.getWorkers()
 
-				// Break elements into chunks and send to worker
-				sentSuccessfully := true
-				chunkNum := 0
-				for chunkNum < numChunks {
-					from := chunkNum * CHUNK_SIZE
-					to := from + CHUNK_SIZE
-					if to > numElements {
-						to = numElements
-					}
-
-					request.Payload[0] = elementQueue[from:to]
-					err := workerCon.Call("Worker.ApplyIncomingElements", request, response)
-					if err != nil {
-						w.logger.Println("Received error when trying to send chunk of elements to worker ", workerAddr, ": \n", err)
-
-						sentSuccessfully = false
-						break
-					}
-
-					chunkNum++
-				}
+		w.walMux.Lock()
+		checkpoint := walCheckpoint{seq: w.wal.Last(), targets: w.streamTargets()}
+		w.walMux.Unlock()
 
-				// If all elements were sent successfully, increment
-				// number of successes
-				if sentSuccessfully {
-					numSuccess++
-				}
-			}
+		if AUTO_SAVE && w.saveModifiedSessionsToFS() && len(checkpoint.targets) >= w.settings.MinNumWorkerConnections {
+			w.walCheckpoints = append(w.walCheckpoints, checkpoint)
+		}
+		w.truncateWAL()
 
-			w.ackElements(numAckElements, numSuccess)
+		w.resendElementsToAck()
+		w.ackElements()
+		w.resyncSessions()
 
-			w.localElements = w.localElements[numLocalElements:]
-		}
+		w.collectTombstones(w.gatherReports())
 	}
-	return nil
 }
 
-// If the worker has the session in it's CRDT map, apply the op
-// If it doesn't, skip over applying the op
-// If it has applied these ops already, skip over applying the op
+// Applies batches of elements streamed from another worker and relays them.
+// The payload is the batches and the sending worker's address. Batches the
+// worker has seen before, by their origin and number, are skipped, so each
+// batch is applied and relayed once however many workers send it. Batches of
+// sessions the worker doesn't host are cached and relayed without being
+// applied: they were sent here to reach workers beyond this one that host the
+// session, to make up the number of replicas, or because the session is being
+// loaded. Responds with the number up to which every batch of each of the
+// batches' sources has been seen, so the sender stops relaying them here.
+// Membership updates are piggybacked on the request and the response
 func (w *Worker) ApplyIncomingElements(request *WorkerRequest, response *WorkerResponse) error {
-	elements := request.Payload[0].([]Element)
-	for _, element := range elements {
-		sessionID := element.SessionID
-		if w.sessions[sessionID] == nil {
-			w.getSessionAndLogs(sessionID)
+	batches := request.Payload[0].([]Batch)
+	sender := request.Payload[1].(string)
+	w.applyGossip(request.Payload[2].([]Update))
+
+	sources := make([]Source, 0, len(batches))
+	unseen := make([]Batch, 0, len(batches))
+	w.walMux.RLock()
+	for _, batch := range batches {
+		sources = append(sources, batch.Source())
+		for _, element := range batch.Elements {
+			w.cache.Add(element)
 		}
 
-		w.cache.Add(element)
-
-		// Send to clients if we actually added to the CRDT
-		// if not, we already had it...
-		if w.addToSession(element) {
-			w.sendToClients(element)
+		if w.seen.Add(batch.Source(), batch.Seq) {
+			unseen = append(unseen, batch)
 		}
 	}
+	applied, _ := w.applyBatches(unseen, sender)
+	w.walMux.RUnlock()
+
+	// Send to clients whatever we actually added to the CRDT
+	// if nothing, we already had it or it's waiting on another element...
+	for _, element := range applied {
+		w.sendToClients(element)
+	}
 
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = w.seen.Vector(sources...)
+	response.Payload[1] = w.members.Gossip()
 	return nil
 }
 
-func (w *Worker) saveModifiedSessionsToFS() {
-	for sessionID, session := range w.modifiedSessions {
-		logMsg := "Saving session [" + sessionID + "] to file system"
-		w.logger.Println(logMsg)
-
-		request := new(FSRequest)
-		request.Payload = make([]interface{}, 2)
-		request.Payload[0] = session
-		request.Payload[1] = w.golog.PrepareSend(logMsg, []byte{})
-		response := new(FSResponse)
+// Saves every modified session to the FS. A session the FS already has a
+// version of is saved as a delta since that version, unless the delta can't
+// be merged, in which case the whole session is saved. Returns whether every
+// session was saved.
+func (w *Worker) saveModifiedSessionsToFS() bool {
+	savedAll := true
+	for sessionID, session := range w.takeModified() {
+		version, saved := w.saveSessionDeltaToFS(session)
+		if !saved {
+			version, saved = w.saveSessionToFS(session)
+		}
 
-		err := w.fsServerConn.Call("Server.SaveSession", request, response)
-		if err == nil && len(response.Payload) > 0 {
-			logMsg = "Session [" + sessionID + "] sent"
-			delete(w.modifiedSessions, sessionID)
-			w.logger.Println(logMsg)
-			var recbuf []byte
-			w.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
+		if saved {
+			w.setSavedVersion(sessionID, version)
+			session.AckVersion(FS_REPLICA, version)
 		} else {
-			w.logger.Println("saveModifiedSessionsToFS:", err)
-			logMsg = "Session [" + sessionID + "] could not be sent"
-			w.logger.Println(logMsg)
-			w.golog.LogLocalEvent(logMsg)
+			w.markModified(session)
+			savedAll = false
 		}
 	}
+
+	return savedAll
 }
 
-// Load balancer calls CreateNewSession when it receives a request from a client
-// using an ID it has not seen before. Worker stores a new Session locally and saves
-// it to the FS
-func (w *Worker) CreateNewSession(sessionID string, _ *bool) error {
-	logMsg := "Saving session [" + sessionID + "] to file system"
+// Saves the operations of a session since its last save to the FS. Returns
+// the version that was saved and whether the FS merged it.
+func (w *Worker) saveSessionDeltaToFS(session *Session) (VersionVector, bool) {
+	since, ok := w.savedVersion(session.ID)
+	if !ok {
+		return nil, false
+	}
+
+	delta := session.DeltaSince(since)
+	logMsg := "Saving delta of session [" + session.ID + "] to file system"
 	w.logger.Println(logMsg)
 
 	request := new(FSRequest)
-	session := &Session{ID: sessionID, CRDT: make(map[string]*Element)}
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = delta
+	request.Payload[1] = w.golog.PrepareSend(logMsg, []byte{})
+	response := new(FSResponse)
+
+	err := w.fsServerConn.Call("Server.SaveSessionDelta", request, response)
+	if err == nil && len(response.Payload) > 0 && response.Payload[0].(bool) {
+		logMsg = "Delta of session [" + session.ID + "] sent"
+		w.logger.Println(logMsg)
+		var recbuf []byte
+		w.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
+
+		return delta.Version, true
+	}
+
+	w.logger.Println("saveSessionDeltaToFS:", err)
+	logMsg = "Delta of session [" + session.ID + "] could not be merged"
+	w.logger.Println(logMsg)
+	w.golog.LogLocalEvent(logMsg)
+
+	return nil, false
+}
+
+// Saves a whole session to the FS. Returns the version that was saved and
+// whether an FS node saved it.
+func (w *Worker) saveSessionToFS(session *Session) (VersionVector, bool) {
+	logMsg := "Saving session [" + session.ID + "] to file system"
+	w.logger.Println(logMsg)
+
+	// The session is copied so it isn't read while it is being edited
+	saved := session.Fork(session.ID)
+	version := saved.Version()
 
-	w.sessions[sessionID] = session
+	request := new(FSRequest)
 	request.Payload = make([]interface{}, 2)
-	request.Payload[0] = w.sessions[sessionID]
+	request.Payload[0] = saved
 	request.Payload[1] = w.golog.PrepareSend(logMsg, []byte{})
 	response := new(FSResponse)
 
 	err := w.fsServerConn.Call("Server.SaveSession", request, response)
-	if err == nil && len(response.Payload) > 0 {
-		logMsg = "Session [" + sessionID + "] sent"
+	if err == nil && len(response.Payload) > 0 && response.Payload[0].(bool) {
+		logMsg = "Session [" + session.ID + "] sent"
 		w.logger.Println(logMsg)
 		var recbuf []byte
 		w.golog.UnpackReceive(logMsg, response.Payload[1].([]byte), &recbuf)
-	} else {
-		w.logger.Println("CreateNewSession:", err)
-		logMsg = "Session [" + sessionID + "] could not be sent"
-		w.logger.Println(logMsg)
-		w.golog.LogLocalEvent(logMsg)
+
+		return version, true
+	}
+
+	w.logger.Println("saveSessionToFS:", err)
+	logMsg = "Session [" + session.ID + "] could not be sent"
+	w.logger.Println(logMsg)
+	w.golog.LogLocalEvent(logMsg)
+
+	return nil, false
+}
+
+// Load balancer calls CreateNewSession when it receives a request from a client
+// using an ID it has not seen before. Worker stores a new Session locally and saves
+// it to the FS
+func (w *Worker) CreateNewSession(sessionID string, _ *bool) error {
+	session := w.addSession(&Session{ID: sessionID, CRDT: make(map[ElementID]*Element)})
+	w.advertiseSessions()
+
+	if version, saved := w.saveSessionToFS(session); saved {
+		w.setSavedVersion(sessionID, version)
 	}
 
 	return nil
@@ -309,107 +555,335 @@ func (w *Worker) CreateNewSession(sessionID string, _ *bool) error {
 
 // If worker doesn't have Session, contact other workers/FS to load the Session
 // Once stored, worker will actively update Session as Elements arrive
+// If worker already has it, catch up on any operations it missed from another worker
 func (w *Worker) LoadSession(sessionID string, response *bool) error {
-	if w.sessions[sessionID] == nil {
+	if session := w.session(sessionID); session == nil {
 		w.getSessionAndLogs(sessionID)
+	} else {
+		w.syncSession(session)
 	}
 
 	return nil
 }
 
+// Merges the operations a connected worker has applied to a session that
+// this worker hasn't, rather than loading the whole session again. Workers
+// that don't answer within WORKER_TIMEOUT are skipped. Returns whether a
+// worker sent them.
+func (w *Worker) syncSession(session *Session) bool {
+	request := new(WorkerRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = session.ID
+	request.Payload[1] = session.Version()
+
+	for workerAddr := range w.allWorkers() {
+		// A worker that timed out can still answer into its response
+		response := new(WorkerResponse)
+		err := w.callWorker(workerAddr, "Worker.GetSessionDelta", request, response, WORKER_TIMEOUT)
+		if err != nil {
+			w.logger.Println("Failed to retrieve delta of session "+session.ID+" from "+workerAddr+"\n", err)
+			continue
+		}
+
+		delta := response.Payload[0].(Delta)
+		for _, log := range response.Payload[1].(map[string]Log) {
+			w.addLogs(session.ID, log)
+		}
+		if !session.Version().Covers(delta.Since) {
+			w.logger.Println("Session " + session.ID + " is missing operations " + workerAddr + " compacted, delta not merged")
+			continue
+		}
+
+		applied := session.Merge(delta)
+		w.logger.Println("Merged", len(applied), "elements of session", session.ID, "from", workerAddr)
+		for _, element := range applied {
+			w.sendToClients(element)
+		}
+		if len(applied) > 0 {
+			w.markModified(session)
+		}
+
+		return true
+	}
+
+	return false
+}
+
 // Get the Session from a connected worker or get it from the FS
 func (w *Worker) getSessionAndLogs(sessionID string) bool {
-	// Mark the session as pending, so the cache doesn't flush
+	// Mark the session as pending, so the cache doesn't flush, and have the
+	// other workers send its elements here while it loads
 	w.cache.AddPending(sessionID)
+	w.setLoading(sessionID, true)
+	w.advertiseSessions()
+
+	loaded := w.getSessionFromWorkers(sessionID)
+
+	// If worker's neighbours cannot provide the session, contact the file server for the session
+	if !loaded && w.session(sessionID) == nil {
+		if session, logs, ok := w.getSessionFromFS(sessionID); ok {
+			w.addLogs(sessionID, logs...)
+			w.addSession(session)
+			loaded = true
+		}
+	}
+
+	// Apply the cached elements to the session
+	if w.session(sessionID) != nil {
+		w.addToSession(sessionID, w.cache.Get(sessionID)...)
+	}
+	// Remove pending status on session
+	w.cache.RemovePending(sessionID)
+	w.setLoading(sessionID, false)
+
+	return loaded
+}
+
+// Gets the session and its logs from a connected worker, asking the workers
+// that host it first. Returns whether a worker had it
+func (w *Worker) getSessionFromWorkers(sessionID string) bool {
+	workers := w.allWorkers()
+	hosts := w.hosts(sessionID)
+	addrs := make([]string, 0, len(workers))
+	for workerAddr := range workers {
+		addrs = append(addrs, workerAddr)
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return hosts[addrs[i]] && !hosts[addrs[j]]
+	})
 
 	response := new(WorkerResponse)
-	for _, workerCon := range w.workers {
-		var isConnected bool
-		workerCon.Call("Worker.PingWorker", "", &isConnected)
-		err := workerCon.Call("Worker.GetSession", sessionID, response)
+	for _, workerAddr := range addrs {
+		err := workers[workerAddr].Call("Worker.GetSession", sessionID, response)
 		if err != nil {
 			w.logger.Println("Failed to retrieve session and logs for session "+sessionID+"\n", err)
 		} else {
 			session := response.Payload[0].(Session)
-			logs := response.Payload[1].(map[string]Log)
-			if len(logs) > 0 {
-				if _, exists := w.logs[sessionID]; exists {
-					for _, log := range logs {
-						w.logs[sessionID][log.Job.JobID] = log
-					}
-				} else {
-					w.logs[sessionID] = logs
-				}
+			for _, log := range response.Payload[1].(map[string]Log) {
+				w.addLogs(sessionID, log)
 			}
-			w.sessions[sessionID] = &session
+			w.addSession(&session)
+
+			// The batches the worker had seen are in the session, so they
+			// don't need to be applied or relayed when they arrive
+			w.seen.Advance(response.Payload[2].(map[Source]uint64))
 			return true
 		}
 	}
 
-	// If worker's neighbours cannot provide the session, contact the file server for the session
-	if w.sessions[sessionID] == nil {
-		logMsg := "Retrieving session [" + sessionID + "] from file system"
+	return false
+}
+
+// Gets the session and its logs from the FS. Returns whether the FS had it
+func (w *Worker) getSessionFromFS(sessionID string) (*Session, []Log, bool) {
+	logMsg := "Retrieving session [" + sessionID + "] from file system"
+	w.logger.Println(logMsg)
+
+	fsRequest := new(FSRequest)
+	fsResponse := new(FSResponse)
+	fsRequest.Payload = make([]interface{}, 2)
+	fsRequest.Payload[0] = sessionID
+	fsRequest.Payload[1] = w.golog.PrepareSend(logMsg, []byte{})
+
+	err := w.fsServerConn.Call("Server.GetSession", fsRequest, fsResponse)
+	if err != nil {
+		w.logger.Println("getSessionFromFS:", err)
+		logMsg = "Session [" + sessionID + "] could not be retrieved"
 		w.logger.Println(logMsg)
+		w.golog.LogLocalEvent(logMsg)
 
-		fsRequest := new(FSRequest)
-		fsResponse := new(FSResponse)
-		fsRequest.Payload = make([]interface{}, 2)
-		fsRequest.Payload[0] = sessionID
-		fsRequest.Payload[1] = w.golog.PrepareSend(logMsg, []byte{})
+		return nil, nil, false
+	}
 
-		err := w.fsServerConn.Call("Server.GetSession", fsRequest, fsResponse)
-		if err != nil {
-			w.logger.Println("getSessionAndLogs:", err)
-			logMsg = "Session [" + sessionID + "] could not be retrieved"
-			w.logger.Println(logMsg)
-			w.golog.LogLocalEvent(logMsg)
-		} else {
-			logMsg = "Session [" + sessionID + "] retrieved"
-			w.logger.Println(logMsg)
-			session := fsResponse.Payload[0].(Session)
-			logs := fsResponse.Payload[1].([]Log)
-			var recbuf []byte
-			w.golog.UnpackReceive(logMsg, fsResponse.Payload[2].([]byte), &recbuf)
+	logMsg = "Session [" + sessionID + "] retrieved"
+	w.logger.Println(logMsg)
+	session := fsResponse.Payload[0].(Session)
+	logs := fsResponse.Payload[1].([]Log)
+	var recbuf []byte
+	w.golog.UnpackReceive(logMsg, fsResponse.Payload[2].([]byte), &recbuf)
 
-			if _, exists := w.logs[sessionID]; exists {
-				for _, log := range logs {
-					w.logs[sessionID][log.Job.JobID] = log
-				}
-			} else {
-				tempLogMap := make(map[string]Log)
-				for _, log := range logs {
-					tempLogMap[log.Job.JobID] = log
-				}
-				w.logs[sessionID] = tempLogMap
-			}
-			w.sessions[sessionID] = &session
-			// TODO handle cached elements
-			return true
-		}
+	return &session, logs, true
+}
+
+// Catches up on the operations of a session that a client has seen, given
+// the version it saw, but the worker hasn't, eg. ones the client's last
+// worker applied before it failed. They are merged from a connected worker
+// or from the FS. Returns whether the worker has all of them now
+func (w *Worker) catchUp(session *Session, version VersionVector) bool {
+	if session.Version().Covers(version) {
+		return true
 	}
 
-	// Apply the cached elements to the session
-	if w.sessions[sessionID] != nil {
-		cachedElements := w.cache.Get(sessionID)
-		for _, element := range cachedElements {
-			w.addToSession(element)
-		}
+	w.syncSession(session)
+	if session.Version().Covers(version) {
+		return true
 	}
-	// Remove pending status on session
-	w.cache.RemovePending(sessionID)
 
-	return false
+	if saved, logs, ok := w.getSessionFromFS(session.ID); ok {
+		w.addLogs(session.ID, logs...)
+		w.publishElements(session, session.Merge(saved.DeltaSince(session.Version())))
+	}
+
+	return session.Version().Covers(version)
 }
 
 // If client tries to get a session, this function can be used to get that session
 // if the worker has it in its CRDT map
+// Also responds with the number up to which the worker has seen every batch
+// of each of the session's sources, all of which are in the session
 func (w *Worker) GetSession(sessionID string, response *WorkerResponse) error {
-	if w.sessions[sessionID] == nil {
+	session := w.session(sessionID)
+	if session == nil {
+		return NoCRDTError(sessionID)
+	}
+
+	// Batches are seen and applied with walMux read locked
+	w.walMux.Lock()
+	seen := w.seen.SessionVector(sessionID)
+	fork := session.Fork(sessionID)
+	w.walMux.Unlock()
+
+	response.Payload = make([]interface{}, 3)
+	response.Payload[0] = fork
+	response.Payload[1] = w.sessionLogs(sessionID)
+	response.Payload[2] = seen
+	return nil
+}
+
+// Load balancer calls SaveSnapshot to save a named snapshot of a session to
+// the FS, loading the session if the worker doesn't have it. The snapshot is
+// of the session as it is now, or as it was at the Unix time in nanoseconds
+// given as the third element of the payload. Names are relative paths like
+// file names.
+func (w *Worker) SaveSnapshot(request *WorkerRequest, _ *bool) error {
+	sessionID := request.Payload[0].(string)
+	name := request.Payload[1].(string)
+	if !ValidFileName(name) {
+		return InvalidFileNameError(name)
+	}
+	session := w.findSession(sessionID)
+	if session == nil {
+		return NoCRDTError(sessionID)
+	}
+
+	version := session.Version()
+	if len(request.Payload) > 2 {
+		version = session.VersionAt(time.Unix(0, request.Payload[2].(int64)))
+	}
+
+	logMsg := "Saving snapshot [" + name + "] of session [" + sessionID + "] to file system"
+	w.logger.Println(logMsg)
+
+	fsRequest := new(FSRequest)
+	fsRequest.Payload = make([]interface{}, 3)
+	fsRequest.Payload[0] = session.SnapshotAt(version)
+	fsRequest.Payload[1] = name
+	fsRequest.Payload[2] = w.golog.PrepareSend(logMsg, []byte{})
+	fsResponse := new(FSResponse)
+
+	err := w.fsServerConn.Call("Server.SaveSnapshot", fsRequest, fsResponse)
+	if err == nil && len(fsResponse.Payload) > 0 {
+		logMsg = "Snapshot [" + name + "] of session [" + sessionID + "] sent"
+		w.logger.Println(logMsg)
+		var recbuf []byte
+		w.golog.UnpackReceive(logMsg, fsResponse.Payload[1].([]byte), &recbuf)
+	} else {
+		w.logger.Println("SaveSnapshot:", err)
+		logMsg = "Snapshot [" + name + "] of session [" + sessionID + "] could not be sent"
+		w.logger.Println(logMsg)
+		w.golog.LogLocalEvent(logMsg)
+	}
+
+	return err
+}
+
+// Returns the versions of sessions reported by the workers hosting them, by
+// session and address, including this worker's own if it hosts them (see
+// hostVersion). The payload is the IDs of the sessions. A worker passes on the
+// reports it gathered from the workers beyond it, so the reports of every host
+// of a session reach every other host, connected or not
+func (w *Worker) GetHostVersions(request *WorkerRequest, response *WorkerResponse) error {
+	sessionIDs := request.Payload[0].([]string)
+
+	reports := make(map[string]map[string]HostVersion, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		reports[sessionID] = w.sessionReports(sessionID)
+		if session := w.session(sessionID); session != nil {
+			reports[sessionID][w.localRPCAddr.String()] = w.hostVersion(session)
+		}
+	}
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = reports
+	return nil
+}
+
+// Returns the operations a worker is missing from a session, given the
+// version of the session it has, along with the session's logs
+func (w *Worker) GetSessionDelta(request *WorkerRequest, response *WorkerResponse) error {
+	sessionID := request.Payload[0].(string)
+	since := request.Payload[1].(VersionVector)
+	session := w.session(sessionID)
+	if session == nil {
 		return NoCRDTError(sessionID)
 	}
+
 	response.Payload = make([]interface{}, 2)
-	response.Payload[0] = w.sessions[sessionID]
-	response.Payload[1] = w.logs[sessionID]
+	response.Payload[0] = session.DeltaSince(since)
+	response.Payload[1] = w.sessionLogs(sessionID)
+	return nil
+}
+
+// Load balancer calls ForkSession to branch a new session off an existing one.
+// The fork keeps the IDs of the source's elements, so it can be merged back
+// later, and is saved to the FS like a new session
+func (w *Worker) ForkSession(request *WorkerRequest, _ *bool) error {
+	srcID := request.Payload[0].(string)
+	newID := request.Payload[1].(string)
+	if w.session(newID) != nil {
+		return SessionExistsError(newID)
+	}
+	src := w.findSession(srcID)
+	if src == nil {
+		return NoCRDTError(srcID)
+	}
+
+	fork := src.Fork(newID)
+	if w.addSession(fork) != fork {
+		return SessionExistsError(newID)
+	}
+	w.logger.Println("Forked session " + srcID + " as " + newID)
+	w.advertiseSessions()
+
+	if version, saved := w.saveSessionToFS(fork); saved {
+		w.setSavedVersion(newID, version)
+	}
+
+	return nil
+}
+
+// Load balancer calls MergeSession to fold the edits made to a fork back into
+// a session. Only the fork's operations the target doesn't have are applied,
+// and they are replicated like any other edits. Responds with the number of
+// elements that were applied
+func (w *Worker) MergeSession(request *WorkerRequest, response *WorkerResponse) error {
+	forkID := request.Payload[0].(string)
+	targetID := request.Payload[1].(string)
+	fork := w.findSession(forkID)
+	if fork == nil {
+		return NoCRDTError(forkID)
+	}
+	target := w.findSession(targetID)
+	if target == nil {
+		return NoCRDTError(targetID)
+	}
+
+	applied := target.Merge(fork.DeltaSince(target.Version()))
+	w.publishElements(target, applied)
+	w.logger.Println("Merged", len(applied), "elements of session", forkID, "into", targetID)
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = len(applied)
 	return nil
 }
 
@@ -434,6 +908,10 @@ func (w *Worker) listenRPC() {
 	w.localRPCAddr = listener.Addr()
 	rpc.Register(w)
 	w.externalIP = externalIP
+	// Batches are numbered from 1 again after a restart, so every run is a
+	// new origin
+	w.origin = w.localRPCAddr.String() + "/" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	w.members = NewMembership(w.localRPCAddr.String(), DefaultMembershipSettings())
 	w.logger.Println("listening for RPC on: ", listener.Addr().String())
 	go func() {
 		for {
@@ -447,6 +925,14 @@ func (w *Worker) listenHTTP() {
 	http.HandleFunc("/session", w.sessionHandler)
 	http.HandleFunc("/recover", w.recoveryHandler)
 	http.HandleFunc("/execute", w.executeHandler)
+	http.HandleFunc("/pending", w.pendingHandler)
+	http.HandleFunc("/blame", w.blameHandler)
+	http.HandleFunc("/files", w.filesHandler)
+	http.HandleFunc("/edit", w.editHandler)
+	http.HandleFunc("/annotations", w.annotationsHandler)
+	http.HandleFunc("/cache", w.cacheHandler)
+	http.HandleFunc("/peers", w.peersHandler)
+	http.HandleFunc("/members", w.membersHandler)
 
 	http.HandleFunc("/ws", w.wsHandler)
 	httpAddr, err := net.ResolveTCPAddr("tcp", w.externalIP)
@@ -480,75 +966,293 @@ func (w *Worker) startHeartBeat() {
 	request := new(WorkerRequest)
 	request.Payload = make([]interface{}, 2)
 	request.Payload[0] = w.workerID
-	request.Payload[1] = len(w.clients)
+	request.Payload[1] = w.numClients()
 	w.loadBalancerConn.Call("LBServer.HeartBeat", request, &ignored)
 	for {
 		time.Sleep(time.Duration(w.settings.HeartBeat-TIME_BUFFER) * time.Millisecond)
-		request.Payload[1] = len(w.clients)
+		request.Payload[1] = w.numClients()
 		w.loadBalancerConn.Call("LBServer.HeartBeat", request, &ignored)
 	}
 }
 
-// Gets workers from server if below MinNumMinerConnections
+// Gets the worker's neighbors in the overlay from the server, and connects to
+// the ones it isn't connected to. The server gives workers new neighbors when
+// others die, which keeps the workers connected. Lost workers are dropped by
+// probeMembers, so nothing here waits on them. If the server can't be reached,
+// or doesn't return enough workers, members known to be alive are connected
+// to until there are MinNumWorkerConnections, so the workers stay connected
+// without it
 func (w *Worker) getWorkers() {
 	var addrSet []net.Addr
-	for workerAddr, workerCon := range w.workers {
-		isConnected := false
-		workerCon.Call("Worker.PingWorker", "", &isConnected)
-		if !isConnected {
-			w.logger.Println("Lost worker: ", workerAddr)
+	err := w.loadBalancerConn.Call("LBServer.GetNodes", w.workerID, &addrSet)
+	if err != nil {
+		w.logger.Println("Failed to get workers from load balancer:", err)
+	}
+	w.connectToWorkers(addrSet)
 
-			delete(w.workers, workerAddr)
+	alive := w.members.Alive()
+	for _, i := range rand.Perm(len(alive)) {
+		if w.numWorkers() >= w.settings.MinNumWorkerConnections {
+			break
+		}
+		if !w.hasWorker(alive[i]) {
+			w.connectToWorker(alive[i])
 		}
-	}
-	if len(w.workers) < int(w.settings.MinNumWorkerConnections) {
-		w.loadBalancerConn.Call("LBServer.GetNodes", w.workerID, &addrSet)
-		w.connectToWorkers(addrSet)
 	}
 }
 
 // Establishes RPC connections with workers in addrs array
 func (w *Worker) connectToWorkers(addrs []net.Addr) {
 	for _, workerAddr := range addrs {
-		if w.workers[workerAddr.String()] == nil {
-			workerCon, err := rpc.Dial("tcp", workerAddr.String())
-			if err != nil {
-				w.checkError(err)
-				delete(w.workers, workerAddr.String())
-			} else {
-				w.workers[workerAddr.String()] = workerCon
-				response := new(WorkerResponse)
-				request := new(WorkerRequest)
-				request.Payload = make([]interface{}, 1)
-				request.Payload[0] = w.localRPCAddr.String()
-				err = workerCon.Call("Worker.BidirectionalSetup", request, response)
-				if err != nil {
-					w.logger.Println("Error calling BidrectionalSetup:", err)
-				}
-			}
+		if !w.hasWorker(workerAddr.String()) {
+			w.connectToWorker(workerAddr.String())
 		}
 	}
 }
 
-func (w *Worker) BidirectionalSetup(request *WorkerRequest, response *WorkerResponse) error {
-	workerAddr := request.Payload[0].(string)
-	workerConn, err := rpc.Dial("tcp", workerAddr)
+// Connects to a worker and has it connect back, giving up on a worker that
+// doesn't answer within WORKER_TIMEOUT. The worker becomes a member if it
+// wasn't one
+func (w *Worker) connectToWorker(workerAddr string) {
+	workerCon, err := dialWorker(workerAddr)
 	if err != nil {
-		delete(w.workers, workerAddr)
-	} else {
-		w.workers[workerAddr] = workerConn
+		w.checkError(err)
+		w.removeWorker(workerAddr)
+		return
 	}
-	return nil
-}
 
-// Pings all workers currently listed in the worker map
-// If a connected worker fails to reply, that worker should be removed from the map
-func (w *Worker) PingWorker(payload string, reply *bool) error {
-	*reply = true
-	return nil
-}
+	w.addWorker(workerAddr, workerCon)
+	w.members.Apply(Update{Addr: workerAddr, State: ALIVE})
 
-func (w *Worker) sessionHandler(wr http.ResponseWriter, r *http.Request) {
+	response := new(WorkerResponse)
+	request := new(WorkerRequest)
+	request.Payload = make([]interface{}, 1)
+	request.Payload[0] = w.localRPCAddr.String()
+	err = w.callWorker(workerAddr, "Worker.BidirectionalSetup", request, response, WORKER_TIMEOUT)
+	if err != nil {
+		w.logger.Println("Error calling BidrectionalSetup:", err)
+	}
+}
+
+func (w *Worker) BidirectionalSetup(request *WorkerRequest, response *WorkerResponse) error {
+	workerAddr := request.Payload[0].(string)
+	workerConn, err := dialWorker(workerAddr)
+	if err != nil {
+		w.removeWorker(workerAddr)
+	} else {
+		w.addWorker(workerAddr, workerConn)
+		w.members.Apply(Update{Addr: workerAddr, State: ALIVE})
+	}
+	return nil
+}
+
+// Records the sessions a worker hosts or leads to, so only the workers that
+// lead to a session are sent its elements. The payload is the worker's
+// address, the IDs of the sessions and the advertisement's version. If the
+// worker leads to sessions this worker didn't, this worker advertises them
+// in turn, so sessions are advertised across workers that aren't connected
+func (w *Worker) AdvertiseSessions(request *WorkerRequest, _ *bool) error {
+	workerAddr := request.Payload[0].(string)
+	sessionIDs := request.Payload[1].([]string)
+	version := request.Payload[2].(uint64)
+
+	sessions := make(map[string]bool, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		sessions[sessionID] = true
+	}
+
+	if w.setInterest(workerAddr, interest{version: version, sessions: sessions}) {
+		go w.advertiseSessions()
+	}
+
+	return nil
+}
+
+// Tells every connected worker which sessions this worker hosts or leads to
+func (w *Worker) advertiseSessions() {
+	for workerAddr, workerCon := range w.allWorkers() {
+		w.advertiseSessionsTo(workerAddr, workerCon)
+	}
+}
+
+// Tells a worker which sessions this worker hosts, and which the other
+// workers connected to it lead to
+func (w *Worker) advertiseSessionsTo(workerAddr string, workerCon *rpc.Client) {
+	hosted, version := w.hostedSessions()
+	sessions := w.sessionsBeyond(workerAddr)
+	for _, sessionID := range hosted {
+		sessions[sessionID] = true
+	}
+
+	sessionIDs := make([]string, 0, len(sessions))
+	for sessionID := range sessions {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	sort.Strings(sessionIDs)
+
+	request := new(WorkerRequest)
+	request.Payload = make([]interface{}, 3)
+	request.Payload[0] = w.localRPCAddr.String()
+	request.Payload[1] = sessionIDs
+	request.Payload[2] = version
+	var ignored bool
+
+	err := workerCon.Call("Worker.AdvertiseSessions", request, &ignored)
+	if err != nil {
+		w.logger.Println("Failed to advertise sessions to "+workerAddr+"\n", err)
+	}
+}
+
+// Answers a probe from another worker. The payload is the worker's address
+// and membership updates, and the response membership updates. A worker that
+// probes this one is alive, so it becomes a member if it wasn't one
+func (w *Worker) Probe(request *WorkerRequest, response *WorkerResponse) error {
+	w.members.Apply(Update{Addr: request.Payload[0].(string), State: ALIVE})
+	w.applyGossip(request.Payload[1].([]Update))
+
+	response.Payload = make([]interface{}, 1)
+	response.Payload[0] = w.members.Gossip()
+	return nil
+}
+
+// Probes a worker on behalf of another that couldn't reach it. The payload
+// is the address of the worker to probe and membership updates. Responds
+// whether the worker answered, and membership updates
+func (w *Worker) ProbeFor(request *WorkerRequest, response *WorkerResponse) error {
+	workerAddr := request.Payload[0].(string)
+	w.applyGossip(request.Payload[1].([]Update))
+
+	response.Payload = make([]interface{}, 2)
+	response.Payload[0] = w.probe(workerAddr)
+	response.Payload[1] = w.members.Gossip()
+	return nil
+}
+
+// Probes a member every ProbeInterval, going round the members. A member
+// that doesn't answer is probed through other members, and suspected if none
+// of them reaches it either. Suspects that don't refute the suspicion in time
+// are declared dead and dropped, so the workers notice lost workers whether
+// or not the load balancer does
+func (w *Worker) probeMembers() {
+	for {
+		time.Sleep(w.members.Settings().ProbeInterval)
+
+		for _, workerAddr := range w.members.Expire() {
+			w.logger.Println("Lost worker: ", workerAddr)
+			w.removeWorker(workerAddr)
+			w.forgetReports(workerAddr)
+		}
+
+		workerAddr, ok := w.members.NextProbe()
+		if !ok || w.probe(workerAddr) || w.probeIndirectly(workerAddr) {
+			continue
+		}
+
+		if w.members.Suspect(workerAddr) {
+			w.logger.Println("Suspecting worker: ", workerAddr)
+		}
+	}
+}
+
+// Probes a worker, piggybacking membership updates. Returns whether it
+// answered within ProbeTimeout
+func (w *Worker) probe(workerAddr string) bool {
+	request := new(WorkerRequest)
+	request.Payload = make([]interface{}, 2)
+	request.Payload[0] = w.localRPCAddr.String()
+	request.Payload[1] = w.members.Gossip()
+	response := new(WorkerResponse)
+
+	err := w.callWorker(workerAddr, "Worker.Probe", request, response, w.members.Settings().ProbeTimeout)
+	if err != nil {
+		return false
+	}
+
+	w.applyGossip(response.Payload[0].([]Update))
+	return true
+}
+
+// Asks other members to probe a worker that didn't answer a probe. Returns
+// whether any of them reached it
+func (w *Worker) probeIndirectly(workerAddr string) bool {
+	helpers := w.members.Helpers(workerAddr)
+	reached := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			request := new(WorkerRequest)
+			request.Payload = make([]interface{}, 2)
+			request.Payload[0] = workerAddr
+			request.Payload[1] = w.members.Gossip()
+			response := new(WorkerResponse)
+
+			// The helper waits up to ProbeTimeout for the worker itself
+			err := w.callWorker(helper, "Worker.ProbeFor", request, response, 2*w.members.Settings().ProbeTimeout)
+			if err != nil {
+				reached <- false
+				return
+			}
+
+			w.applyGossip(response.Payload[1].([]Update))
+			reached <- response.Payload[0].(bool)
+		}(helper)
+	}
+
+	for range helpers {
+		if <-reached {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Calls a worker, dialling it if it isn't connected, and gives up after
+// timeout
+func (w *Worker) callWorker(workerAddr string, method string, request *WorkerRequest, response *WorkerResponse, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	workerCon := w.worker(workerAddr)
+	if workerCon == nil {
+		conn, err := net.DialTimeout("tcp", workerAddr, timeout)
+		if err != nil {
+			return err
+		}
+		workerCon = rpc.NewClient(conn)
+		defer workerCon.Close()
+	}
+
+	call := workerCon.Go(method, request, response, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(time.Until(deadline)):
+		return TimeoutError(workerAddr)
+	}
+}
+
+// Connects to a worker, giving up after WORKER_TIMEOUT
+func dialWorker(workerAddr string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", workerAddr, WORKER_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+// Applies membership updates gossiped by another worker, dropping workers
+// that were declared dead
+func (w *Worker) applyGossip(updates []Update) {
+	for _, update := range w.members.Apply(updates...) {
+		if update.State == DEAD {
+			w.logger.Println("Lost worker: ", update.Addr)
+			w.removeWorker(update.Addr)
+			w.forgetReports(update.Addr)
+		}
+	}
+}
+
+func (w *Worker) sessionHandler(wr http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		_sessionID, _ := r.URL.Query()["sessionID"]
 		if len(_sessionID) == 0 {
@@ -560,10 +1264,8 @@ func (w *Worker) sessionHandler(wr http.ResponseWriter, r *http.Request) {
 		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		wr.Header().Set("Access-Control-Allow-Origin", "*")
 		var sessionAndLog SessionAndLog
-		sessionAndLog.SessionRecord = w.sessions[sessionID]
-		for _, log := range w.logs[sessionID] {
-			sessionAndLog.LogRecord = append(sessionAndLog.LogRecord, log)
-		}
+		sessionAndLog.SessionRecord = w.session(sessionID)
+		sessionAndLog.LogRecord = w.sessionLogList(sessionID)
 		json.NewEncoder(wr).Encode(sessionAndLog)
 	} else if r.Method == "POST" {
 		_sessionID, _ := r.URL.Query()["sessionID"]
@@ -593,22 +1295,281 @@ func (w *Worker) recoveryHandler(wr http.ResponseWriter, r *http.Request) {
 		}
 
 		sessionID := _sessionID[0]
-
-		if w.sessions[sessionID] == nil {
-			w.getSessionAndLogs(sessionID)
+		session := w.findSession(sessionID)
+		if session == nil {
+			http.Error(wr, NoCRDTError(sessionID).Error(), http.StatusNotFound)
+			return
 		}
 
+		// Clients that don't send the version they saw have to reload, as do
+		// clients that still send only the latest clock of each client
+		var version VersionVector
+		_version, _ := r.URL.Query()["version"]
+		reload := len(_version) == 0 || json.Unmarshal([]byte(_version[0]), &version) != nil
+
 		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		wr.Header().Set("Access-Control-Allow-Origin", "*")
 		var clientRec ClientRecovery
-		clientRec.Session = w.cache.Get(sessionID)
-		for _, log := range w.logs[sessionID] {
-			clientRec.LogRecord = append(clientRec.LogRecord, log)
+		if reload || !w.catchUp(session, version) {
+			clientRec.Reload = true
+		} else if delta := session.DeltaSince(version); !version.Covers(delta.Since) {
+			// The client is missing operations that were compacted
+			clientRec.Reload = true
+		} else {
+			for _, op := range delta.Operations {
+				clientRec.Session = append(clientRec.Session, clientElements(op.Element)...)
+			}
+			clientRec.Version = delta.Version
 		}
+		clientRec.LogRecord = w.sessionLogList(sessionID)
 		json.NewEncoder(wr).Encode(clientRec)
 	}
 }
 
+// Returns the elements of a session that are waiting for the elements they
+// depend on, to help diagnose edits that never show up
+func (w *Worker) pendingHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		_sessionID, _ := r.URL.Query()["sessionID"]
+		if len(_sessionID) == 0 {
+			http.Error(wr, "Missing sessionID in URL parameter", http.StatusBadRequest)
+			return
+		}
+
+		session := w.session(_sessionID[0])
+		if session == nil {
+			http.Error(wr, NoCRDTError(_sessionID[0]).Error(), http.StatusNotFound)
+			return
+		}
+
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		wr.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(wr).Encode(session.PendingElements())
+	}
+}
+
+// Returns the counters of the worker's element cache, eg. its hits, misses
+// and evictions
+func (w *Worker) cacheHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		wr.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(wr).Encode(w.cache.Stats())
+	}
+}
+
+// Returns every member the worker knows of, with its state and incarnation
+func (w *Worker) membersHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		wr.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(wr).Encode(w.members.Members())
+	}
+}
+
+// Returns the stats of the stream to each worker and the sessions it hosts,
+// by address. Lag and Latency are in nanoseconds
+func (w *Worker) peersHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		stats := make(map[string]PeerStats)
+		for workerAddr, stream := range w.allStreams() {
+			stats[workerAddr] = PeerStats{StreamStats: stream.Stats(), Sessions: w.workerSessions(workerAddr)}
+		}
+
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		wr.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(wr).Encode(stats)
+	}
+}
+
+// Returns who wrote each line of a session, as runs of characters with the
+// client that inserted them and, for deleted text, the client that deleted it
+// Blames the main file, or the file of the document given in the URL
+func (w *Worker) blameHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		_sessionID, _ := r.URL.Query()["sessionID"]
+		if len(_sessionID) == 0 {
+			http.Error(wr, "Missing sessionID in URL parameter", http.StatusBadRequest)
+			return
+		}
+
+		sessionID := _sessionID[0]
+		session := w.findSession(sessionID)
+		if session == nil {
+			http.Error(wr, NoCRDTError(sessionID).Error(), http.StatusNotFound)
+			return
+		}
+
+		blame, err := session.Blame(r.URL.Query().Get("document"))
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		wr.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(wr).Encode(blame)
+	}
+}
+
+// GET returns the files of a session, as a map of document IDs to file names.
+// The main file's document ID is the empty string
+// POST creates, renames or deletes a file, given the sessionID, userID,
+// command (create_file, rename_file or delete_file), document and name as
+// form values, and returns the file element
+func (w *Worker) filesHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionID := r.FormValue("sessionID")
+	if len(sessionID) == 0 {
+		http.Error(wr, "Missing sessionID", http.StatusBadRequest)
+		return
+	}
+
+	session := w.findSession(sessionID)
+	if session == nil {
+		http.Error(wr, NoCRDTError(sessionID).Error(), http.StatusNotFound)
+		return
+	}
+
+	wr.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "GET" {
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(wr).Encode(session.FileNames())
+		return
+	}
+
+	userID := r.FormValue("userID")
+	if len(userID) == 0 {
+		http.Error(wr, "Missing userID", http.StatusBadRequest)
+		return
+	}
+
+	element, err := w.fileCommand(sessionID, userID, r.FormValue("command"), r.FormValue("document"), r.FormValue("name"))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(wr).Encode(element)
+}
+
+// POST inserts text into, deletes text from, or undoes or redoes an edit in a
+// document of a session, given the sessionID, userID, command (insert,
+// delete, undo or redo), document, start, end and text as form values, and
+// returns the elements that were applied
+func (w *Worker) editHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionID := r.FormValue("sessionID")
+	if len(sessionID) == 0 {
+		http.Error(wr, "Missing sessionID", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.FormValue("userID")
+	if len(userID) == 0 {
+		http.Error(wr, "Missing userID", http.StatusBadRequest)
+		return
+	}
+
+	if w.findSession(sessionID) == nil {
+		http.Error(wr, NoCRDTError(sessionID).Error(), http.StatusNotFound)
+		return
+	}
+
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	end, _ := strconv.Atoi(r.FormValue("end"))
+
+	elements, err := w.editCommand(sessionID, userID, r.FormValue("command"), r.FormValue("document"), start, end, r.FormValue("text"))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wr.Header().Set("Access-Control-Allow-Origin", "*")
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(wr).Encode(elements)
+}
+
+// GET returns the annotations of a document of a session, given the
+// sessionID and document as form values, with their positions
+// POST adds, edits, resolves, reopens or deletes an annotation, given the
+// sessionID, userID, command, document, id, start, end and text as form
+// values, and returns the annotation element
+func (w *Worker) annotationsHandler(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionID := r.FormValue("sessionID")
+	if len(sessionID) == 0 {
+		http.Error(wr, "Missing sessionID", http.StatusBadRequest)
+		return
+	}
+
+	session := w.findSession(sessionID)
+	if session == nil {
+		http.Error(wr, NoCRDTError(sessionID).Error(), http.StatusNotFound)
+		return
+	}
+
+	wr.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "GET" {
+		annotations, err := session.DocumentAnnotations(r.FormValue("document"))
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(wr).Encode(annotations)
+		return
+	}
+
+	userID := r.FormValue("userID")
+	if len(userID) == 0 {
+		http.Error(wr, "Missing userID", http.StatusBadRequest)
+		return
+	}
+
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	end, _ := strconv.Atoi(r.FormValue("end"))
+	id := ParseElementID(r.FormValue("id"))
+
+	element, err := w.annotationCommand(sessionID, userID, r.FormValue("command"), r.FormValue("document"), id, start, end, r.FormValue("text"))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(wr).Encode(element)
+}
+
 //**WEBSOCKET CODE**//
 
 // HTTP point to bootstrap websocket connection between client and worker
@@ -638,8 +1599,8 @@ func (w *Worker) wsHandler(wr http.ResponseWriter, r *http.Request) {
 
 	w.logger.Println("New socket connection from: ", clientID, sessionID)
 
-	w.clients[clientID] = conn
-	w.clientSessions[sessionID] = append(w.clientSessions[sessionID], clientID)
+	w.addClient(sessionID, clientID, conn)
+	w.sendAnnotations(clientID, sessionID)
 
 	go w.onElement(conn, clientID)
 }
@@ -668,6 +1629,11 @@ func (w *Worker) executeHandler(wr http.ResponseWriter, r *http.Request) {
 		log.Job = *new(Job)
 		log.Job.SessionID = sessionID
 		log.Job.Snippet = snippet
+		if session := w.session(sessionID); session != nil {
+			// The browser's snippet is the most recent main file
+			log.Job.Files = session.Tree()
+			log.Job.Files[session.FileNames()[""]] = snippet
+		}
 		t := time.Now()
 		jobID := sessionID + t.Format("20060102150405")
 		log.Job.JobID = jobID
@@ -734,76 +1700,178 @@ func (w *Worker) executeHandler(wr http.ResponseWriter, r *http.Request) {
 // Different commands should be handled here.
 func (w *Worker) onElement(conn *websocket.Conn, userID string) {
 	for {
-		element := &Element{}
-		err := conn.ReadJSON(element)
+		message := &ClientMessage{}
+		err := conn.ReadJSON(message)
 		if err != nil {
 			w.logger.Println("Error reading from websocket: ", err)
-			delete(w.clients, userID)
+			w.removeClient(userID, conn)
 			return
-		} else {
-			w.logger.Println("Got element from "+userID+": ", element)
+		} else if message.Command != "" {
+			w.onCommand(userID, message)
+			continue
 		}
 
-		if w.addToSession(*element) {
-			w.sendToClients(*element)
+		element := &message.Element
+		w.logger.Println("Got element from "+userID+": ", element)
+
+		// The element is stamped before it is relayed, so that every
+		// worker logs it with the same stamp
+		if session := w.session(element.SessionID); session != nil {
+			session.Stamp(element)
 		}
 
-		w.elementsToAck = append(w.elementsToAck, *element)
-	}
+		w.walMux.RLock()
+		batch := w.newBatch(element.SessionID, []Element{*element})
+		applied, targets := w.applyBatches([]Batch{batch}, "")
+		w.walMux.RUnlock()
+
+		for _, _applied := range applied {
+			w.sendToClients(_applied)
+		}
+
+		w.queueElementToAck(batch, targets[0])
+	}
 }
 
-func (w *Worker) cleanAcks(numAcks int) int {
-	if numAcks > len(w.elementsToAck) {
-		numAcks = len(w.elementsToAck)
+func (w *Worker) onCommand(userID string, message *ClientMessage) {
+	w.logger.Println("Got command from "+userID+": ", message.Command)
+
+	sessionID := message.SessionID
+	var err error
+	switch message.Command {
+	case INSERT_COMMAND, DELETE_COMMAND, UNDO_COMMAND, REDO_COMMAND:
+		_, err = w.editCommand(sessionID, userID, message.Command, message.Document, message.Start, message.End, message.Text)
+	case CREATE_FILE_COMMAND, RENAME_FILE_COMMAND, DELETE_FILE_COMMAND:
+		_, err = w.fileCommand(sessionID, userID, message.Command, message.Document, message.Text)
+	case ANNOTATE_COMMAND, EDIT_ANNOTATION_COMMAND, RESOLVE_ANNOTATION_COMMAND, REOPEN_ANNOTATION_COMMAND, DELETE_ANNOTATION_COMMAND:
+		_, err = w.annotationCommand(sessionID, userID, message.Command, message.Document, message.ID, message.Start, message.End, message.Text)
+	case ACK_COMMAND:
+		if session := w.session(sessionID); session != nil {
+			session.AckVersion(userID, message.Version)
+		}
+	default:
+		w.logger.Println("Unknown command from "+userID+": ", message.Command)
 	}
-	_numAcks := numAcks
 
-	for i := 0; i < _numAcks; i++ {
-		element := w.elementsToAck[i]
-		clientID := element.ClientID
+	w.checkError(err)
+}
 
-		conn := w.clients[clientID]
-		if conn == nil {
-			w.elementsToAck = append(w.elementsToAck[:i], w.elementsToAck[i+1:]...)
+// Inserts, deletes, undoes or redoes an edit in a document of a session on
+// behalf of userID. The elements are also sent to the client itself, since
+// it didn't make them
+func (w *Worker) editCommand(sessionID, userID, command, document string, start, end int, text string) ([]Element, error) {
+	var elements []Element
+	var err error
+	switch command {
+	case INSERT_COMMAND:
+		elements, err = w.Insert(sessionID, document, start, text, userID)
+	case DELETE_COMMAND:
+		elements, err = w.DeleteRange(sessionID, document, start, end-start, userID)
+	case UNDO_COMMAND:
+		elements, err = w.Undo(sessionID, document, userID)
+	case REDO_COMMAND:
+		elements, err = w.Redo(sessionID, document, userID)
+	default:
+		return nil, fmt.Errorf("Unknown edit command [%s]", command)
+	}
 
-			_numAcks--
-		}
+	for _, element := range elements {
+		w.sendToClient(userID, element)
 	}
 
-	return _numAcks
+	return elements, err
 }
 
-func (w *Worker) ackElements(numAcks int, numSuccess int) {
-	// Clean for non-existent clients
-	_numAcks := w.cleanAcks(numAcks)
+// Creates, renames or deletes a file of a session on behalf of userID. The
+// file element is also sent to the client itself, so it learns the new
+// file's document ID
+func (w *Worker) fileCommand(sessionID, userID, command, document, name string) (Element, error) {
+	var element Element
+	var err error
+	switch command {
+	case CREATE_FILE_COMMAND:
+		element, err = w.CreateFile(sessionID, name, userID)
+	case RENAME_FILE_COMMAND:
+		element, err = w.RenameFile(sessionID, document, name, userID)
+	case DELETE_FILE_COMMAND:
+		element, err = w.DeleteFile(sessionID, document, userID)
+	default:
+		return Element{}, fmt.Errorf("Unknown file command [%s]", command)
+	}
 
-	// Exit if the original number of acks is too high
-	// something wasn't right...
-	// Otherwise update numAcks for new num
-	if numAcks > len(w.elementsToAck) {
-		return
-	} else {
-		numAcks = _numAcks
+	if err == nil {
+		w.sendToClient(userID, element)
 	}
 
-	// If we sent to minimum number of workers, ack all elements
-	if numSuccess >= w.settings.MinNumWorkerConnections {
-		for i := 0; i < numAcks; i++ {
-			element := w.elementsToAck[i]
-			clientID := element.ClientID
+	return element, err
+}
 
-			w.sendToClient(clientID, element)
+// Adds, edits, resolves, reopens or deletes an annotation of a session on
+// behalf of userID
+func (w *Worker) annotationCommand(sessionID, userID, command, document string, id ElementID, start, end int, text string) (Element, error) {
+	switch command {
+	case ANNOTATE_COMMAND:
+		return w.Annotate(sessionID, document, start, end, text, userID)
+	case EDIT_ANNOTATION_COMMAND:
+		return w.EditAnnotation(sessionID, id, text, userID)
+	case RESOLVE_ANNOTATION_COMMAND:
+		return w.ResolveAnnotation(sessionID, id, true, userID)
+	case REOPEN_ANNOTATION_COMMAND:
+		return w.ResolveAnnotation(sessionID, id, false, userID)
+	case DELETE_ANNOTATION_COMMAND:
+		return w.DeleteAnnotation(sessionID, id, userID)
+	}
+
+	return Element{}, fmt.Errorf("Unknown annotation command [%s]", command)
+}
+
+// Acks elements from clients once enough workers have them. Elements whose
+// clients have disconnected are dropped
+func (w *Worker) ackElements() {
+	acked := make([]Element, 0)
+
+	elementsToAck := w.takeElementsToAck()
+	rest := make([]pendingAck, 0, len(elementsToAck))
+	for _, pending := range elementsToAck {
+		element := pending.batch.Elements[0]
+		if w.client(element.ClientID) == nil {
+			continue
+		}
+
+		if numDelivered(pending.targets) >= w.settings.MinNumWorkerConnections {
+			acked = append(acked, element)
+		} else {
+			rest = append(rest, pending)
 		}
+	}
+	w.restoreElementsToAck(rest)
+
+	for _, element := range acked {
+		w.sendToClient(element.ClientID, element)
+	}
+}
 
-		w.elementsToAck = w.elementsToAck[numAcks:]
+// Pushes the batches of the elements waiting to be acked to the workers they
+// are routed to but weren't pushed to, eg. workers connected since
+func (w *Worker) resendElementsToAck() {
+	elementsToAck := w.takeElementsToAck()
+	for _, pending := range elementsToAck {
+		for workerAddr, stream := range w.routes(pending.batch, "") {
+			if _, ok := pending.targets[stream]; !ok {
+				if target, ok := w.relayTo(workerAddr, stream, pending.batch); ok {
+					pending.targets[stream] = target
+				}
+			}
+		}
 	}
+	w.restoreElementsToAck(elementsToAck)
 }
 
 func (w *Worker) sendToClients(element Element) {
 	sessionID := element.SessionID
 	clientID := element.ClientID
 
-	for _, _clientID := range w.clientSessions[sessionID] {
+	for _, _clientID := range w.sessionClients(sessionID) {
 		if _clientID == clientID {
 			continue
 		}
@@ -815,10 +1883,20 @@ func (w *Worker) sendToClients(element Element) {
 func (w *Worker) sendToClient(clientID string, element Element) (sent bool, err error) {
 	sent = true
 
-	conn := w.clients[clientID]
+	// Browsers only understand single character elements
+	chars := clientElements(element)
+	if len(chars) == 0 {
+		return
+	}
+
+	conn := w.client(clientID)
 	if conn != nil {
 		w.mux.Lock()
-		err = conn.WriteJSON(element)
+		for _, char := range chars {
+			if err = conn.WriteJSON(char); err != nil {
+				break
+			}
+		}
 		w.mux.Unlock()
 		if err != nil {
 			w.logger.Println("Failed to send message to client '"+clientID+"':", err)
@@ -835,6 +1913,33 @@ func (w *Worker) sendToClient(clientID string, element Element) (sent bool, err
 	return
 }
 
+// Sends the annotations of every document of a session to a client that
+// just connected, as annotation elements
+func (w *Worker) sendAnnotations(clientID string, sessionID string) {
+	session := w.session(sessionID)
+	if session == nil {
+		return
+	}
+
+	for document := range session.FileNames() {
+		annotations, err := session.DocumentAnnotations(document)
+		if err != nil {
+			continue
+		}
+
+		for _, annotation := range annotations {
+			_annotation := annotation.Annotation
+			element := Element{
+				SessionID:  sessionID,
+				ClientID:   annotation.Author,
+				ID:         annotation.Edit,
+				Annotation: &_annotation}
+
+			w.sendToClient(clientID, element)
+		}
+	}
+}
+
 // Runs a job called by the load balancer
 //  Steps:
 //		- Gets log from File System
@@ -883,36 +1988,50 @@ func (w *Worker) RunJob(request *WorkerRequest, response *WorkerResponse) error
 		//		- Runs the job
 		fileName := "runSnippet_" + jobID + ".go"
 		filePath := path.Join(EXEC_DIR, fileName)
-		file, _ := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
-		defer file.Close()
-		file.Write([]byte(log.Job.Snippet))
-		file.Sync()
-
-		cmd := exec.Command("go", "run", filePath)
-		var output, stderr bytes.Buffer
-		cmd.Stdout = &output
-		cmd.Stderr = &stderr
-		var timedout bool
-		timeoutCh := make(chan error, 1)
-		go func() {
-			timeoutCh <- cmd.Run()
-		}()
-		select {
-		case <-timeoutCh:
-			timedout = false
-		case <-time.After(5 * time.Second):
-			timedout = true
-		}
-
-		// Write the proper output to the log file
-		if timedout {
-			log.Output = "program timed out"
-		} else if len(stderr.String()) == 0 {
-			// No errors case
-			log.Output = output.String()
+		fileNames := []string{fileName}
+		var cmd *exec.Cmd
+		if len(log.Job.Files) > 0 {
+			// Sessions with files are run as a package from a directory
+			// holding all of them
+			dir, files, err := materializeJob(jobID, log.Job.Files)
+			defer os.RemoveAll(dir)
+			if err != nil {
+				w.logger.Println("RunJob:", err)
+				log.Output = "could not prepare job: " + err.Error()
+			} else if len(files) == 0 {
+				log.Output = "no Go files with a package clause to run"
+			} else {
+				cmd = exec.Command("go", append([]string{"run"}, files...)...)
+				cmd.Dir = dir
+				fileNames = files
+			}
 		} else {
-			// There was a compile or runtime error
-			log.Output = sliceOutput(stderr.String(), fileName)
+			file, _ := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
+			defer file.Close()
+			file.Write([]byte(log.Job.Snippet))
+			file.Sync()
+
+			cmd = exec.Command("go", "run", filePath)
+		}
+		// A job that couldn't be prepared already has its output
+		if cmd != nil {
+			var output, stderr bytes.Buffer
+			cmd.Stdout = &output
+			cmd.Stderr = &stderr
+			timedout, err := runWithTimeout(cmd, JOB_TIMEOUT)
+
+			// Write the proper output to the log file
+			if timedout {
+				log.Output = "program timed out"
+			} else if err != nil && stderr.Len() == 0 && output.Len() == 0 {
+				log.Output = "could not run job: " + err.Error()
+			} else if stderr.Len() == 0 {
+				// No errors case
+				log.Output = output.String()
+			} else {
+				// There was a compile or runtime error
+				log.Output = sliceOutput(stderr.String(), fileNames...)
+			}
 		}
 		log.Job.Done = true
 
@@ -960,19 +2079,13 @@ func (w *Worker) SendLog(request *WorkerRequest, response *WorkerResponse) error
 	var recbuf []byte
 	w.golog.UnpackReceive(logMsg, request.Payload[1].([]byte), &recbuf)
 
-	if _, exists := w.logs[log.Job.SessionID]; exists {
-		w.logs[log.Job.SessionID][log.Job.JobID] = log
-	} else {
-		tempLogMap := make(map[string]Log)
-		tempLogMap[log.Job.JobID] = log
-		w.logs[log.Job.SessionID] = tempLogMap
-	}
-	//w.logs[log.Job.SessionID][log.Job.JobID] = log
-	//w.logs[log.Job.SessionID] = append(w.logs[log.Job.SessionID], log)
+	w.addLogs(log.Job.SessionID, log)
 	var clientsToDelete []string
-	for clientID, clientConn := range w.clients {
+	for clientID, clientConn := range w.allClients() {
 		if clientConn != nil {
+			w.mux.Lock()
 			err := clientConn.WriteJSON(log)
+			w.mux.Unlock()
 			w.checkError(err)
 		} else {
 			clientsToDelete = append(clientsToDelete, clientID)
@@ -988,9 +2101,225 @@ func (w *Worker) SendLog(request *WorkerRequest, response *WorkerResponse) error
 	return nil
 }
 
-//**UTIL CODE**//
+//**STATE CODE**//
+
+// Returns the session with the given ID, or nil if the worker doesn't have it
+func (w *Worker) session(sessionID string) *Session {
+	w.sessionsMux.RLock()
+	defer w.sessionsMux.RUnlock()
+
+	return w.sessions[sessionID]
+}
+
+// Returns the session with the given ID, getting it from a connected worker
+// or the FS if the worker doesn't have it yet. Returns nil if neither has it
+func (w *Worker) findSession(sessionID string) *Session {
+	if session := w.session(sessionID); session != nil {
+		return session
+	}
+
+	w.getSessionAndLogs(sessionID)
+	return w.session(sessionID)
+}
+
+// Returns every session the worker has
+func (w *Worker) allSessions() []*Session {
+	w.sessionsMux.RLock()
+	defer w.sessionsMux.RUnlock()
+
+	sessions := make([]*Session, 0, len(w.sessions))
+	for _, session := range w.sessions {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// Stores a session unless the worker already has one with its ID, eg. one
+// loaded concurrently. Returns the session the worker has
+func (w *Worker) addSession(session *Session) *Session {
+	// Elements the worker makes for clients get IDs of its own
+	session.SetReplica(w.origin)
+
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	if existing := w.sessions[session.ID]; existing != nil {
+		return existing
+	}
+
+	w.sessions[session.ID] = session
+	return session
+}
+
+// Marks a session as modified, so it is saved to the FS
+func (w *Worker) markModified(session *Session) {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	w.modifiedSessions[session.ID] = session
+}
+
+// Records elements a session dropped from its pending buffer, so the session
+// is resynced
+func (w *Worker) addResync(sessionID string, dropped []Element) {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	w.resyncs[sessionID] = append(w.resyncs[sessionID], dropped...)
+}
+
+// Returns the sessions to resync and the elements they dropped, which are no
+// longer recorded
+func (w *Worker) takeResyncs() map[string][]Element {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	resyncs := w.resyncs
+	w.resyncs = make(map[string][]Element)
+
+	return resyncs
+}
+
+// Returns the sessions modified since the last call, which are no longer
+// marked as modified
+func (w *Worker) takeModified() map[string]*Session {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	modified := w.modifiedSessions
+	w.modifiedSessions = make(map[string]*Session)
+
+	return modified
+}
+
+// Returns the version of a session last saved to the FS, if the FS has one
+// that deltas can be merged into
+func (w *Worker) savedVersion(sessionID string) (VersionVector, bool) {
+	w.sessionsMux.RLock()
+	defer w.sessionsMux.RUnlock()
+
+	version, ok := w.savedVersions[sessionID]
+	return version, ok
+}
+
+// Records the version of a session last saved to the FS, or that deltas
+// can't be merged into it if version is nil
+func (w *Worker) setSavedVersion(sessionID string, version VersionVector) {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	if version == nil {
+		delete(w.savedVersions, sessionID)
+	} else {
+		w.savedVersions[sessionID] = version
+	}
+}
+
+// Marks a session as being loaded, or no longer being loaded
+func (w *Worker) setLoading(sessionID string, loading bool) {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	if loading {
+		w.loadingSessions[sessionID] = true
+	} else {
+		delete(w.loadingSessions, sessionID)
+	}
+}
+
+// Returns the IDs of the sessions the worker has or is loading, in order, and
+// a version for advertising them that is greater than the last one returned
+func (w *Worker) hostedSessions() ([]string, uint64) {
+	w.sessionsMux.Lock()
+	defer w.sessionsMux.Unlock()
+
+	sessionIDs := make([]string, 0, len(w.sessions)+len(w.loadingSessions))
+	for sessionID := range w.sessions {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	for sessionID := range w.loadingSessions {
+		if w.sessions[sessionID] == nil {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	sort.Strings(sessionIDs)
+
+	w.advertisements++
+	return sessionIDs, w.advertisements
+}
+
+// Numbers a new batch of elements of a session originating here, and records
+// it as seen
+func (w *Worker) newBatch(sessionID string, elements []Element) Batch {
+	w.sessionsMux.Lock()
+	w.batchSeqs[sessionID]++
+	batch := Batch{Origin: w.origin, SessionID: sessionID, Seq: w.batchSeqs[sessionID], Elements: elements}
+	w.sessionsMux.Unlock()
+
+	w.seen.Add(batch.Source(), batch.Seq)
+	return batch
+}
+
+// Returns the websocket of a client, or nil if it isn't connected
+func (w *Worker) client(clientID string) *websocket.Conn {
+	w.clientsMux.RLock()
+	defer w.clientsMux.RUnlock()
+
+	return w.clients[clientID]
+}
+
+// Returns the websocket of every connected client, by client ID
+func (w *Worker) allClients() map[string]*websocket.Conn {
+	w.clientsMux.RLock()
+	defer w.clientsMux.RUnlock()
+
+	clients := make(map[string]*websocket.Conn, len(w.clients))
+	for clientID, conn := range w.clients {
+		clients[clientID] = conn
+	}
+
+	return clients
+}
+
+func (w *Worker) numClients() int {
+	w.clientsMux.RLock()
+	defer w.clientsMux.RUnlock()
+
+	return len(w.clients)
+}
+
+// Returns the clients of a session
+func (w *Worker) sessionClients(sessionID string) []string {
+	w.clientsMux.RLock()
+	defer w.clientsMux.RUnlock()
+
+	return append([]string(nil), w.clientSessions[sessionID]...)
+}
+
+func (w *Worker) addClient(sessionID string, clientID string, conn *websocket.Conn) {
+	w.clientsMux.Lock()
+	defer w.clientsMux.Unlock()
+
+	w.clients[clientID] = conn
+	w.clientSessions[sessionID] = append(w.clientSessions[sessionID], clientID)
+}
+
+// Forgets the websocket of a client whose connection was lost
+func (w *Worker) removeClient(clientID string, conn *websocket.Conn) {
+	w.clientsMux.Lock()
+	defer w.clientsMux.Unlock()
+
+	// The client may have reconnected on a new websocket since
+	if w.clients[clientID] == conn {
+		delete(w.clients, clientID)
+	}
+}
 
 func (w *Worker) deleteClients(sessionID string, clients []string) {
+	w.clientsMux.Lock()
+	defer w.clientsMux.Unlock()
+
 	for _, clientID := range clients {
 		delete(w.clients, clientID)
 
@@ -1003,74 +2332,1045 @@ func (w *Worker) deleteClients(sessionID string, clients []string) {
 	}
 }
 
-// Function gets rid of weird command line outputs from errors
-func sliceOutput(output string, fileName string) string {
-	arr := strings.Split(output, "\n")
-	var logOutput string
-	for _, str := range arr {
-		if str != "# command-line-arguments" {
-			s := html.EscapeString(str)
-			index := strings.Index(s, fileName)
-			if index >= 0 {
-				s = html.UnescapeString(s[len(fileName)+index+1:])
-			} else {
-				s = html.UnescapeString(s)
-			}
-			if len(logOutput) > 0 {
-				logOutput += "\n" + s
-			} else {
-				logOutput += s
+// Returns the connection to every connected worker, by address
+func (w *Worker) allWorkers() map[string]*rpc.Client {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	workers := make(map[string]*rpc.Client, len(w.workers))
+	for workerAddr, workerCon := range w.workers {
+		workers[workerAddr] = workerCon
+	}
+
+	return workers
+}
+
+func (w *Worker) numWorkers() int {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	return len(w.workers)
+}
+
+// Returns the connection to a worker, or nil if it isn't connected
+func (w *Worker) worker(workerAddr string) *rpc.Client {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	return w.workers[workerAddr]
+}
+
+func (w *Worker) hasWorker(workerAddr string) bool {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	return w.workers[workerAddr] != nil
+}
+
+// Returns the streams to every worker, by address
+func (w *Worker) allStreams() map[string]*Stream {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	streams := make(map[string]*Stream, len(w.streams))
+	for workerAddr, stream := range w.streams {
+		streams[workerAddr] = stream
+	}
+
+	return streams
+}
+
+// Returns the number of batches pushed to each worker's stream so far
+func (w *Worker) streamTargets() map[*Stream]uint64 {
+	targets := make(map[*Stream]uint64)
+	for _, stream := range w.allStreams() {
+		targets[stream], _ = stream.Progress()
+	}
+
+	return targets
+}
+
+// Records the sessions a worker advertised, unless it has advertised since.
+// Returns whether the worker leads to sessions no worker led to before
+func (w *Worker) setInterest(workerAddr string, _interest interest) bool {
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
+
+	current, ok := w.interests[workerAddr]
+	if ok && current.version >= _interest.version {
+		return false
+	}
+
+	grew := false
+	for sessionID := range _interest.sessions {
+		if !w.ledTo(sessionID) {
+			grew = true
+			break
+		}
+	}
+	w.interests[workerAddr] = _interest
+
+	return grew
+}
+
+// Returns whether any worker leads to a session. workersMux must be held
+func (w *Worker) ledTo(sessionID string) bool {
+	for _, _interest := range w.interests {
+		if _interest.sessions[sessionID] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the sessions that the workers other than workerAddr lead to
+func (w *Worker) sessionsBeyond(workerAddr string) map[string]bool {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	beyond := make(map[string]bool)
+	for _workerAddr, _interest := range w.interests {
+		if _workerAddr != workerAddr {
+			for sessionID := range _interest.sessions {
+				beyond[sessionID] = true
 			}
 		}
 	}
-	return logOutput
+
+	return beyond
 }
 
-func (w *Worker) checkError(err error) error {
-	if err != nil {
-		w.logger.Println("Error:", err)
-		return err
+// Returns the sessions a worker advertised, in order
+func (w *Worker) workerSessions(workerAddr string) []string {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	sessionIDs := make([]string, 0, len(w.interests[workerAddr].sessions))
+	for sessionID := range w.interests[workerAddr].sessions {
+		sessionIDs = append(sessionIDs, sessionID)
 	}
+	sort.Strings(sessionIDs)
 
-	return nil
+	return sessionIDs
 }
 
-func usage() {
-	fmt.Fprintln(os.Stderr, "Usage: go run worker.go [LBServer ip:port] [FSServer ip:port]\n")
-	os.Exit(1)
+// Returns the connected workers that host a session or lead to it
+func (w *Worker) hosts(sessionID string) map[string]bool {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	hosts := make(map[string]bool)
+	for workerAddr := range w.workers {
+		if w.interests[workerAddr].sessions[sessionID] {
+			hosts[workerAddr] = true
+		}
+	}
+
+	return hosts
 }
 
-//**CRDT CODE**//
+// Returns the latest version each other worker hosting a session reported,
+// by address
+func (w *Worker) sessionReports(sessionID string) map[string]HostVersion {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
 
-// Adds a character to the right of the prevID specified in the args
-func (w *Worker) addRight(prevID, content, sessionID string) error {
-	session := w.sessions[sessionID]
-	elementID := strconv.Itoa(session.Next) + strconv.Itoa(w.workerID)
-	newElement := &Element{sessionID, strconv.Itoa(w.workerID), elementID, prevID, "", content, false, time.Now().Unix()}
-	w.addToSession(*newElement)
+	reports := make(map[string]HostVersion, len(w.reports[sessionID]))
+	for workerAddr, report := range w.reports[sessionID] {
+		reports[workerAddr] = report
+	}
 
-	return nil
+	return reports
 }
 
-func (w *Worker) addToSession(element Element) (processed bool) {
-	sessionID := element.SessionID
-	session := w.sessions[sessionID]
-	if session == nil {
-		return false
+// Records the versions of sessions other workers reported, by session and
+// address, keeping the latest report of each worker. Reports of this worker
+// and of workers that are dead are ignored, since a report of a dead worker
+// can still be on its way through the workers that relayed it
+func (w *Worker) addReports(reports map[string]map[string]HostVersion) {
+	dead := make(map[string]bool)
+	for _, member := range w.members.Members() {
+		if member.State == DEAD {
+			dead[member.Addr] = true
+		}
 	}
+	self := w.localRPCAddr.String()
 
-	if element.Deleted == true {
-		processed = session.Delete(element)
-	} else {
-		processed = session.Add(element)
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
+
+	for sessionID, hosts := range reports {
+		for workerAddr, report := range hosts {
+			if workerAddr == self || dead[workerAddr] {
+				continue
+			}
+
+			if w.reports[sessionID] == nil {
+				w.reports[sessionID] = make(map[string]HostVersion)
+			}
+			if report.Time > w.reports[sessionID][workerAddr].Time {
+				w.reports[sessionID][workerAddr] = report
+			}
+		}
 	}
+}
+
+// Forgets the versions a dead worker reported, so it no longer holds back
+// the collection of tombstones
+func (w *Worker) forgetReports(workerAddr string) {
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
 
-	if processed {
-		w.modifiedSessions[sessionID] = session
-		w.localElements = append(w.localElements, element)
+	for _, hosts := range w.reports {
+		delete(hosts, workerAddr)
 	}
+}
 
-	return
+// Returns the streams to the workers a batch is relayed to: the workers that
+// host its session or lead to it and, if the batch originated here (sender is
+// empty) and fewer than MinNumWorkerConnections do, enough others to make up
+// the number. The others are picked in order of address, so the same workers
+// keep getting the session's batches. The worker that sent the batch and the
+// one it originated on are left out
+func (w *Worker) routes(batch Batch, sender string) map[string]*Stream {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	routes := make(map[string]*Stream)
+	others := make([]string, 0)
+	for workerAddr, stream := range w.streams {
+		// Origins are the worker's address followed by its start time
+		if workerAddr == sender || strings.HasPrefix(batch.Origin, workerAddr+"/") {
+			continue
+		}
+
+		if w.interests[workerAddr].sessions[batch.SessionID] {
+			routes[workerAddr] = stream
+		} else {
+			others = append(others, workerAddr)
+		}
+	}
+
+	if sender != "" {
+		return routes
+	}
+
+	sort.Strings(others)
+	for _, workerAddr := range others {
+		if len(routes) >= w.settings.MinNumWorkerConnections {
+			break
+		}
+		routes[workerAddr] = w.streams[workerAddr]
+	}
+
+	return routes
+}
+
+// Returns whether a worker has responded that it has seen a batch
+func (w *Worker) hasAcked(workerAddr string, batch Batch) bool {
+	w.workersMux.RLock()
+	defer w.workersMux.RUnlock()
+
+	return w.acked[workerAddr][batch.Source()] >= batch.Seq
+}
+
+// Records the number up to which a worker has seen every batch of each
+// source in vector
+func (w *Worker) setAcked(workerAddr string, vector map[Source]uint64) {
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
+
+	acked := w.acked[workerAddr]
+	if acked == nil {
+		return
+	}
+	for source, seq := range vector {
+		if seq > acked[source] {
+			acked[source] = seq
+		}
+	}
+}
+
+// Adds a worker and starts a stream to it, replacing any stream the worker
+// already had
+func (w *Worker) addWorker(workerAddr string, workerCon *rpc.Client) {
+	stream := w.newStream(workerAddr, workerCon)
+
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
+
+	if existing := w.streams[workerAddr]; existing != nil {
+		existing.Close()
+	}
+	w.workers[workerAddr] = workerCon
+	w.streams[workerAddr] = stream
+	// The worker may have restarted and forgotten what it had seen
+	w.acked[workerAddr] = make(map[Source]uint64)
+
+	go w.advertiseSessionsTo(workerAddr, workerCon)
+}
+
+func (w *Worker) removeWorker(workerAddr string) {
+	w.workersMux.Lock()
+	defer w.workersMux.Unlock()
+
+	if stream := w.streams[workerAddr]; stream != nil {
+		stream.Close()
+	}
+	delete(w.workers, workerAddr)
+	delete(w.streams, workerAddr)
+	delete(w.interests, workerAddr)
+	delete(w.acked, workerAddr)
+}
+
+// Returns the logs of a session, by job ID
+func (w *Worker) sessionLogs(sessionID string) map[string]Log {
+	w.logsMux.RLock()
+	defer w.logsMux.RUnlock()
+
+	logs := make(map[string]Log, len(w.logs[sessionID]))
+	for jobID, log := range w.logs[sessionID] {
+		logs[jobID] = log
+	}
+
+	return logs
+}
+
+// Returns the logs of a session as a list
+func (w *Worker) sessionLogList(sessionID string) []Log {
+	var logs []Log
+	for _, log := range w.sessionLogs(sessionID) {
+		logs = append(logs, log)
+	}
+
+	return logs
+}
+
+// Adds logs to a session's logs, replacing the ones with the same job ID
+func (w *Worker) addLogs(sessionID string, logs ...Log) {
+	w.logsMux.Lock()
+	defer w.logsMux.Unlock()
+
+	if _, exists := w.logs[sessionID]; !exists {
+		w.logs[sessionID] = make(map[string]Log)
+	}
+	for _, log := range logs {
+		w.logs[sessionID][log.Job.JobID] = log
+	}
+}
+
+// Queues the batch of an element from a client to be acked once enough
+// workers have it, given the streams it was relayed to (see relay)
+func (w *Worker) queueElementToAck(batch Batch, targets map[*Stream]uint64) {
+	pending := pendingAck{batch: batch, targets: targets}
+
+	w.elementsMux.Lock()
+	defer w.elementsMux.Unlock()
+
+	w.elementsToAck = append(w.elementsToAck, pending)
+}
+
+// Removes and returns the elements waiting to be acked, so they can be
+// checked without holding the lock
+func (w *Worker) takeElementsToAck() []pendingAck {
+	w.elementsMux.Lock()
+	defer w.elementsMux.Unlock()
+
+	elementsToAck := w.elementsToAck
+	w.elementsToAck = nil
+	return elementsToAck
+}
+
+// Puts back elements taken by takeElementsToAck, ahead of the ones queued
+// since
+func (w *Worker) restoreElementsToAck(elementsToAck []pendingAck) {
+	w.elementsMux.Lock()
+	defer w.elementsMux.Unlock()
+
+	w.elementsToAck = append(elementsToAck, w.elementsToAck...)
+}
+
+//**UTIL CODE**//
+
+// Writes the files of a job into a new directory under EXEC_DIR. Returns the
+// directory and the Go files in it to run, ie. the ones that aren't tests and
+// start with a package clause. Empty files, eg. ones just created, are left
+// out rather than failing the build
+func materializeJob(jobID string, files map[string]string) (string, []string, error) {
+	dir, err := ioutil.TempDir(EXEC_DIR, "job_"+jobID+"_")
+	if err != nil {
+		return dir, nil, err
+	}
+
+	toRun := make([]string, 0)
+	for name, contents := range files {
+		name = path.Clean(name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+
+		filePath := path.Join(dir, name)
+		if err = os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			return dir, nil, err
+		}
+		if err = ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			return dir, nil, err
+		}
+
+		if path.Dir(name) == "." && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") && hasPackageClause(contents) {
+			toRun = append(toRun, name)
+		}
+	}
+	sort.Strings(toRun)
+
+	return dir, toRun, nil
+}
+
+// Runs a command, killing it if it hasn't finished within timeout. go run
+// runs the program it builds as a child, so the command is started in its own
+// process group and the whole group is killed. Returns whether the command
+// timed out, and otherwise the error it finished with. Either way the command
+// has exited when this returns, so its files can be removed
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return true, nil
+	}
+}
+
+// Returns whether the contents of a Go file start with a package clause
+func hasPackageClause(contents string) bool {
+	_, err := parser.ParseFile(token.NewFileSet(), "", contents, parser.PackageClauseOnly)
+	return err == nil
+}
+
+// Returns an element as browsers understand it: one element per character,
+// each naming its document. File and annotation elements are kept whole,
+// since they don't hold any characters
+func clientElements(element Element) []Element {
+	if element.File {
+		return []Element{element}
+	}
+
+	return element.Chars()
+}
+
+// Function gets rid of weird command line outputs from errors, ie. the
+// command-line-arguments header and the path before the name of the file an
+// error is in, given the names of the files that were run
+func sliceOutput(output string, fileNames ...string) string {
+	arr := strings.Split(output, "\n")
+	var logOutput string
+	for _, str := range arr {
+		if str != "# command-line-arguments" {
+			s := html.EscapeString(str)
+			if index, fileName := fileIndex(s, fileNames); index >= 0 {
+				s = html.UnescapeString(s[len(fileName)+index+1:])
+			} else {
+				s = html.UnescapeString(s)
+			}
+			if len(logOutput) > 0 {
+				logOutput += "\n" + s
+			} else {
+				logOutput += s
+			}
+		}
+	}
+	return logOutput
+}
+
+// Returns where the first of fileNames that a line of output names starts, as
+// in "<dir>/<name>:<line>", and that name. Returns -1 if it names none of them
+func fileIndex(line string, fileNames []string) (int, string) {
+	for _, fileName := range fileNames {
+		index := strings.Index(line, fileName+":")
+		if index == 0 || (index > 0 && line[index-1] == '/') {
+			return index, fileName
+		}
+	}
+
+	return -1, ""
+}
+
+func (w *Worker) checkError(err error) error {
+	if err != nil {
+		w.logger.Println("Error:", err)
+		return err
+	}
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: go run worker.go [flags] [LBServer ip:port] [FSServer ip:port] [WAL path]\n")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+//**CRDT CODE**//
+
+// Inserts text at the given offset of a document of a session on behalf of
+// clientID, as if the client had typed it in the browser. The generated
+// elements are replicated to other workers and sent to the clients in the
+// session. Clients never receive elements carrying their own clientID, so
+// callers editing for a client send them to it themselves (see editCommand).
+func (w *Worker) Insert(sessionID string, document string, offset int, text string, clientID string) ([]Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return nil, NoCRDTError(sessionID)
+	}
+
+	elements, err := session.DocumentInsert(document, offset, text, clientID)
+	w.publishElements(session, elements)
+
+	return elements, err
+}
+
+// Deletes length characters starting at the given offset of a document of a
+// session on behalf of clientID. The deletes are replicated and sent to
+// clients like any other element.
+func (w *Worker) DeleteRange(sessionID string, document string, offset int, length int, clientID string) ([]Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return nil, NoCRDTError(sessionID)
+	}
+
+	elements, err := session.DocumentDeleteRange(document, offset, length, clientID)
+	w.publishElements(session, elements)
+
+	return elements, err
+}
+
+// Creates a file in a session on behalf of clientID. The file element is
+// replicated like any other element, and its Document is the new file's
+// document ID.
+func (w *Worker) CreateFile(sessionID string, name string, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.CreateFile(name, clientID)
+	if err == nil {
+		w.publishElements(session, []Element{element})
+	}
+
+	return element, err
+}
+
+// Renames the file of a document in a session on behalf of clientID.
+func (w *Worker) RenameFile(sessionID string, document string, name string, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.RenameFile(document, name, clientID)
+	if err == nil {
+		w.publishElements(session, []Element{element})
+	}
+
+	return element, err
+}
+
+// Deletes the file of a document in a session on behalf of clientID.
+func (w *Worker) DeleteFile(sessionID string, document string, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.DeleteFile(document, clientID)
+	if err == nil {
+		w.publishElements(session, []Element{element})
+	}
+
+	return element, err
+}
+
+// Annotates the characters in positions [start, end) of a document of a
+// session on behalf of clientID. The annotation element is replicated like
+// any other element, and is also sent to the client itself so it learns the
+// new annotation's ID.
+func (w *Worker) Annotate(sessionID string, document string, start int, end int, text string, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.Annotate(document, start, end, text, clientID)
+	if err == nil {
+		w.publishAnnotation(session, element)
+	}
+
+	return element, err
+}
+
+// Replaces the text of an annotation of a session on behalf of clientID.
+func (w *Worker) EditAnnotation(sessionID string, id ElementID, text string, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.EditAnnotation(id, text, clientID)
+	if err == nil {
+		w.publishAnnotation(session, element)
+	}
+
+	return element, err
+}
+
+// Marks an annotation of a session resolved, or unresolved, on behalf of
+// clientID.
+func (w *Worker) ResolveAnnotation(sessionID string, id ElementID, resolved bool, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.ResolveAnnotation(id, resolved, clientID)
+	if err == nil {
+		w.publishAnnotation(session, element)
+	}
+
+	return element, err
+}
+
+// Removes an annotation of a session on behalf of clientID.
+func (w *Worker) DeleteAnnotation(sessionID string, id ElementID, clientID string) (Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return Element{}, NoCRDTError(sessionID)
+	}
+
+	element, err := session.DeleteAnnotation(id, clientID)
+	if err == nil {
+		w.publishAnnotation(session, element)
+	}
+
+	return element, err
+}
+
+// Undoes the last edit clientID made to a document of a session. The inverse
+// elements are replicated like any other element.
+func (w *Worker) Undo(sessionID string, document string, clientID string) ([]Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return nil, NoCRDTError(sessionID)
+	}
+
+	elements, err := session.DocumentUndo(document, clientID)
+	w.publishElements(session, elements)
+
+	return elements, err
+}
+
+// Redoes the last edit clientID undid in a document of a session. See Undo.
+func (w *Worker) Redo(sessionID string, document string, clientID string) ([]Element, error) {
+	session := w.session(sessionID)
+	if session == nil {
+		return nil, NoCRDTError(sessionID)
+	}
+
+	elements, err := session.DocumentRedo(document, clientID)
+	w.publishElements(session, elements)
+
+	return elements, err
+}
+
+// Queues elements that were already applied to the session for replication
+// and sends them to the session's clients.
+func (w *Worker) publishElements(session *Session, elements []Element) {
+	if len(elements) == 0 {
+		return
+	}
+
+	w.walMux.RLock()
+	w.appendToWAL(elements...)
+	w.markModified(session)
+	w.relay(w.newBatch(session.ID, elements), "")
+	w.walMux.RUnlock()
+
+	for _, element := range elements {
+		w.sendToClients(element)
+	}
+}
+
+// Publishes an annotation element, sending it to the client that made it
+// as well as every other client of the session
+func (w *Worker) publishAnnotation(session *Session, element Element) {
+	w.publishElements(session, []Element{element})
+	w.sendToClient(element.ClientID, element)
+}
+
+// Applies elements to their session without relaying them. Elements that
+// arrive before the element they depend on are buffered by the session, so
+// applying one element may apply several. The elements are appended to the
+// WAL first, so they are applied again if the worker restarts before they
+// are safe elsewhere. Returns every element that was applied.
+func (w *Worker) addToSession(sessionID string, elements ...Element) []Element {
+	session := w.session(sessionID)
+	if session == nil || len(elements) == 0 {
+		return nil
+	}
+
+	w.walMux.RLock()
+	defer w.walMux.RUnlock()
+
+	w.appendToWAL(elements...)
+	applied := make([]Element, 0)
+	for _, element := range elements {
+		applied = append(applied, w.applyToSession(session, element)...)
+	}
+
+	return applied
+}
+
+// Applies an element to a session, marking it modified if anything was
+// applied. Elements the session had to drop from its pending buffer to make
+// room are recorded so the session is resynced (see resyncSessions).
+func (w *Worker) applyToSession(session *Session, element Element) []Element {
+	applied := session.Apply(element)
+	if len(applied) > 0 {
+		w.markModified(session)
+	}
+
+	if dropped := session.TakeDropped(); len(dropped) > 0 {
+		w.logger.Println("Session ["+session.ID+"] dropped", len(dropped), "pending elements, resyncing")
+		w.addResync(session.ID, dropped)
+	}
+
+	return applied
+}
+
+// Catches up the sessions that dropped elements from their pending buffer
+// on what they are missing, from a connected worker or else from the FS, and
+// then applies the dropped elements again, so they aren't lost. Elements that
+// still can't be applied are buffered, and dropped again if there is no room.
+func (w *Worker) resyncSessions() {
+	for sessionID, dropped := range w.takeResyncs() {
+		session := w.session(sessionID)
+		if session == nil {
+			continue
+		}
+
+		if !w.syncSession(session) {
+			if saved, logs, ok := w.getSessionFromFS(sessionID); ok {
+				w.addLogs(sessionID, logs...)
+				w.publishElements(session, session.Merge(saved.DeltaSince(session.Version())))
+			}
+		}
+
+		for _, element := range dropped {
+			for _, applied := range w.applyToSession(session, element) {
+				w.sendToClients(applied)
+			}
+		}
+	}
+}
+
+// Applies batches to their sessions, if the worker hosts them, and relays
+// them. The elements are appended to the WAL first, all together so the WAL
+// is synced once. Returns the elements that were applied, and for each batch
+// the number of batches pushed to each stream it was relayed to once it was
+// pushed there. walMux must be read locked.
+func (w *Worker) applyBatches(batches []Batch, sender string) ([]Element, []map[*Stream]uint64) {
+	sessions := make([]*Session, len(batches))
+	hosted := make([]Element, 0)
+	for i, batch := range batches {
+		if sessions[i] = w.session(batch.SessionID); sessions[i] != nil {
+			hosted = append(hosted, batch.Elements...)
+		}
+	}
+	if len(hosted) > 0 {
+		w.appendToWAL(hosted...)
+	}
+
+	var applied []Element
+	targets := make([]map[*Stream]uint64, len(batches))
+	for i, batch := range batches {
+		if sessions[i] != nil {
+			for _, element := range batch.Elements {
+				applied = append(applied, w.applyToSession(sessions[i], element)...)
+			}
+		}
+		targets[i] = w.relay(batch, sender)
+	}
+
+	return applied, targets
+}
+
+// Appends elements to the WAL. An element that can't be appended is still
+// applied, it just won't survive a restart.
+func (w *Worker) appendToWAL(elements ...Element) {
+	if _, err := w.wal.Append(elements...); err != nil {
+		w.logger.Println("Error appending to WAL: ", err)
+	}
+}
+
+// Drops the elements in the WAL up to the latest checkpoint the workers have
+// delivered, along with the checkpoints before it. Elements are only routed to
+// some workers, so every worker still connected must have delivered what was
+// pushed to it, and at least MinNumWorkerConnections of them must have, so a
+// checkpoint whose workers are all gone isn't taken as delivered. Checkpoints
+// are only taken once an FS node has saved the sessions.
+func (w *Worker) truncateWAL() {
+	confirmed := -1
+	for i, checkpoint := range w.walCheckpoints {
+		delivered := numDelivered(checkpoint.targets)
+		if delivered >= w.settings.MinNumWorkerConnections && delivered == numConnected(checkpoint.targets) {
+			confirmed = i
+		}
+	}
+	if confirmed < 0 {
+		return
+	}
+
+	seq := w.walCheckpoints[confirmed].seq
+	w.walCheckpoints = w.walCheckpoints[confirmed+1:]
+	if err := w.wal.Truncate(seq); err != nil {
+		w.logger.Println("Error truncating WAL: ", err)
+	}
+}
+
+// Applies the elements left in the WAL by a previous run, loading their
+// sessions from the FS, and relays them to the other workers again, as
+// batches of this run. They stay in the WAL until they are safe elsewhere.
+func (w *Worker) replayWAL() {
+	records := w.wal.Records()
+	if len(records) == 0 {
+		return
+	}
+
+	w.logger.Println("Replaying", len(records), "elements from WAL")
+	for _, record := range records {
+		element := record.Element
+		session := w.findSession(element.SessionID)
+		if session == nil {
+			w.logger.Println("Can't replay element of unknown session [" + element.SessionID + "]")
+			continue
+		}
+
+		w.applyToSession(session, element)
+		w.relay(w.newBatch(element.SessionID, []Element{element}), "")
+	}
+}
+
+// Streams a batch to the workers it is routed to (see routes), except those
+// that have responded they have seen it. Returns the number of batches that
+// had been pushed to each of their streams once it was pushed there
+func (w *Worker) relay(batch Batch, sender string) map[*Stream]uint64 {
+	targets := make(map[*Stream]uint64)
+	for workerAddr, stream := range w.routes(batch, sender) {
+		if target, ok := w.relayTo(workerAddr, stream, batch); ok {
+			targets[stream] = target
+		}
+	}
+
+	return targets
+}
+
+// Pushes a batch to a worker's stream, unless the worker has seen it, in which
+// case nothing needs to be delivered for it to have the batch. Returns the
+// number of batches that have to be delivered for the worker to have it
+func (w *Worker) relayTo(workerAddr string, stream *Stream, batch Batch) (uint64, bool) {
+	if w.hasAcked(workerAddr, batch) {
+		return 0, true
+	}
+
+	return w.push(workerAddr, stream, batch)
+}
+
+// Pushes batches to a worker's stream. Returns the number of batches pushed
+// to the stream once they are. A worker whose queue is full isn't keeping
+// up, so it is dropped like a lost worker, to be replaced by getWorkers
+func (w *Worker) push(workerAddr string, stream *Stream, batches ...Batch) (uint64, bool) {
+	if !stream.Push(batches...) {
+		w.logger.Println("Dropping worker that fell behind: ", workerAddr, stream.Stats())
+		w.removeWorker(workerAddr)
+		return 0, false
+	}
+
+	pushed, _ := stream.Progress()
+	return pushed, true
+}
+
+// Starts a stream of batches to a worker. The batches the worker responds it
+// has seen aren't relayed to it again, and membership updates are exchanged
+// with every call. Deletes are acked for the worker, and elements from
+// clients acked, as batches are delivered
+func (w *Worker) newStream(workerAddr string, workerCon *rpc.Client) *Stream {
+	settings := DefaultStreamSettings()
+	settings.BatchSize = CHUNK_SIZE
+
+	send := func(batches []Batch) error {
+		request := new(WorkerRequest)
+		request.Payload = make([]interface{}, 3)
+		request.Payload[0] = batches
+		request.Payload[1] = w.localRPCAddr.String()
+		request.Payload[2] = w.members.Gossip()
+		response := new(WorkerResponse)
+
+		err := workerCon.Call("Worker.ApplyIncomingElements", request, response)
+		if err != nil {
+			w.logger.Println("Received error when trying to send elements to worker ", workerAddr, ": \n", err)
+		} else if len(response.Payload) > 1 {
+			w.setAcked(workerAddr, response.Payload[0].(map[Source]uint64))
+			w.applyGossip(response.Payload[1].([]Update))
+		}
+
+		return err
+	}
+
+	delivered := func(batches []Batch) {
+		for _, batch := range batches {
+			w.ackDeletes(workerAddr, batch.Elements)
+		}
+		w.ackElements()
+	}
+
+	return NewStream(settings, send, delivered)
+}
+
+// Returns how many of the streams in targets are still open, ie. to workers
+// that are still connected
+func numConnected(targets map[*Stream]uint64) int {
+	n := 0
+	for stream := range targets {
+		if !stream.Closed() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Returns how many of the open streams in targets have delivered the number
+// of batches in targets
+func numDelivered(targets map[*Stream]uint64) int {
+	n := 0
+	for stream, target := range targets {
+		if _, delivered := stream.Progress(); delivered >= target && !stream.Closed() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Records that a worker has applied the deletes among the given elements
+func (w *Worker) ackDeletes(workerAddr string, elements []Element) {
+	deletes := make(map[string][]ElementID)
+	for _, element := range elements {
+		if element.Deleted {
+			for _, char := range element.Chars() {
+				deletes[element.SessionID] = append(deletes[element.SessionID], char.ID)
+			}
+		}
+	}
+
+	for sessionID, ids := range deletes {
+		if session := w.session(sessionID); session != nil {
+			session.AckDeletes(workerAddr, ids)
+		}
+	}
+}
+
+// Returns the version of a session that this worker and every client of the
+// session connected to it have applied, as this worker's report to the other
+// workers hosting it
+func (w *Worker) hostVersion(session *Session) HostVersion {
+	return HostVersion{Time: time.Now().UnixNano(), Version: session.StableVersion(w.sessionClients(session.ID))}
+}
+
+// Asks every connected worker for the versions reported by the hosts of the
+// sessions it advertised, see GetHostVersions. Returns the workers that
+// answered
+func (w *Worker) gatherReports() map[string]bool {
+	answered := make(map[string]bool)
+	for workerAddr := range w.allWorkers() {
+		sessionIDs := w.workerSessions(workerAddr)
+		if len(sessionIDs) == 0 {
+			continue
+		}
+
+		request := new(WorkerRequest)
+		request.Payload = make([]interface{}, 1)
+		request.Payload[0] = sessionIDs
+		response := new(WorkerResponse)
+
+		err := w.callWorker(workerAddr, "Worker.GetHostVersions", request, response, WORKER_TIMEOUT)
+		if err != nil {
+			w.logger.Println("Failed to retrieve host versions from "+workerAddr+"\n", err)
+			continue
+		}
+
+		w.addReports(response.Payload[0].(map[string]map[string]HostVersion))
+		answered[workerAddr] = true
+	}
+
+	return answered
+}
+
+// Garbage collects tombstones whose deletes have been acknowledged by the
+// file system, every client of the session connected here and every other
+// worker hosting the session, connected or not. The other hosts acknowledge
+// the version they last reported, which only includes what their own clients
+// have acknowledged too (see hostVersion), so a tombstone is collected once
+// every replica of the session has applied its delete. A session is skipped
+// unless every connected worker that leads to it has answered, given as
+// answered, so that no host is left out because its report didn't arrive.
+// Sessions that shrink are saved again so the file system copy is compacted
+// too.
+func (w *Worker) collectTombstones(answered map[string]bool) {
+	for _, session := range w.allSessions() {
+		if len(session.TombstoneIDs()) == 0 || !w.reported(session.ID, answered) {
+			continue
+		}
+
+		replicas := append([]string{FS_REPLICA}, w.sessionClients(session.ID)...)
+		for workerAddr, report := range w.sessionReports(session.ID) {
+			session.AckVersion(workerAddr, report.Version)
+			replicas = append(replicas, workerAddr)
+		}
+
+		collected := session.Collect(replicas)
+		if len(collected) > 0 {
+			w.logger.Println("Collected", len(collected), "tombstones from session", session.ID)
+			w.markModified(session)
+
+			// Collecting isn't an operation, so it can't be saved as a delta
+			w.setSavedVersion(session.ID, nil)
+		}
+	}
+}
+
+// Returns whether every connected worker that leads to a session is in
+// answered
+func (w *Worker) reported(sessionID string, answered map[string]bool) bool {
+	for workerAddr := range w.hosts(sessionID) {
+		if !answered[workerAddr] {
+			return false
+		}
+	}
+
+	return true
 }
 
 //****POC CODE***//